@@ -0,0 +1,56 @@
+// Command tun2proxy-server runs the server side of the tunnel
+// transports of this module, so they can be used end to end.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"os"
+
+	"tun2proxylib/mux"
+	"tun2proxylib/udprelay"
+)
+
+func main() {
+	muxAddr := flag.String("mux", "", "listen address of the mux server, e.g. :9000")
+	relayAddr := flag.String("relay", "", "UDP and TCP listen address of the udppackage relay, e.g. :5353")
+	username := flag.String("user", "", "username required from the mux clients")
+	password := flag.String("pass", "", "password required from the mux clients")
+	certFile := flag.String("tls-cert", "", "certificate securing the TCP side of the relay")
+	keyFile := flag.String("tls-key", "", "key of -tls-cert")
+	debug := flag.Bool("debug", false, "log at debug level")
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if *muxAddr == "" && *relayAddr == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	errs := make(chan error, 2)
+	if *muxAddr != "" {
+		srv := &mux.Server{Username: *username, Password: *password, Logger: logger}
+		logger.Info("mux server listening", "addr", *muxAddr)
+		go func() { errs <- srv.ListenAndServe(*muxAddr) }()
+	}
+	if *relayAddr != "" {
+		srv := &udprelay.Server{Logger: logger}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				logger.Error("load tls certificate failed", "err", err)
+				os.Exit(1)
+			}
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		logger.Info("relay server listening", "addr", *relayAddr, "tls", srv.TLS != nil)
+		go func() { errs <- srv.ListenAndServe(*relayAddr) }()
+	}
+	logger.Error("server failed", "err", <-errs)
+	os.Exit(1)
+}
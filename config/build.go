@@ -0,0 +1,293 @@
+package config
+
+import (
+	"log/slog"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/dialer"
+	"tun2proxylib/gvisorcore/proxy"
+	"tun2proxylib/health"
+	"tun2proxylib/hijack"
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/dns/cache"
+	ss "tun2proxylib/lwipcore/common/shadowsocks"
+	"tun2proxylib/lwipcore/core"
+	"tun2proxylib/lwipcore/proxy/http"
+	"tun2proxylib/lwipcore/proxy/shadowsocks"
+	"tun2proxylib/lwipcore/proxy/socks"
+	"tun2proxylib/metrics"
+	"tun2proxylib/mobile"
+	"tun2proxylib/outbound"
+	"tun2proxylib/resolver"
+	"tun2proxylib/sniff"
+	"tun2proxylib/tracker"
+	"tun2proxylib/tunnel"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const defaultStopTimeout = 5 * time.Second
+
+// Pipeline is a tunnel assembled from a Config, ready to be started.
+type Pipeline struct {
+	Backend tunnel.Backend
+	Handler tunnel.Handler
+	Tracker *tracker.Tracker
+	Metrics *metrics.Registry
+
+	// Health checks the outbounds while the pipeline runs, nil without
+	// a health section.
+	Health *health.Prober
+
+	stopTimeout time.Duration
+	outbounds   []outbound.Outbound
+}
+
+// Start starts reading packets from the tun device.
+func (p *Pipeline) Start() error {
+	if err := p.Backend.Start(p.Handler); err != nil {
+		return err
+	}
+	if p.Health != nil {
+		p.Health.Start()
+	}
+	return nil
+}
+
+// Stop stops the backend, live flows get timeouts.stop to finish. The
+// outbounds are closed once they are done.
+func (p *Pipeline) Stop() error {
+	if p.Health != nil {
+		p.Health.Stop()
+	}
+	err := p.Backend.Stop(p.stopTimeout)
+	for _, ob := range p.outbounds {
+		outbound.Close(ob)
+	}
+	return err
+}
+
+// Build assembles the pipeline described by c for the tun device fd.
+// protect may be nil, the outbound sockets are then bound as described
+// by the dialer section. Build sets dialer.DefaultDialer, so the last
+// built configuration wins.
+func (c *Config) Build(fd int, protect mobile.ProtectSocket, logger *slog.Logger) (*Pipeline, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	dialer.DefaultDialer.InterfaceName.Store(c.Dialer.InterfaceName)
+	dialer.DefaultDialer.InterfaceIndex.Store(int32(c.Dialer.InterfaceIndex))
+	dialer.DefaultDialer.RoutingMark.Store(int32(c.Dialer.RoutingMark))
+
+	mtu := c.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+	kind := tunnel.Kind(c.Backend)
+	if kind == "" {
+		kind = tunnel.GVisor
+	}
+	icmpMode, _ := gvisorcore.ParseICMPMode(c.Stack.ICMP)
+	backend, err := tunnel.New(kind, tunnel.Options{
+		FD:           fd,
+		MTU:          mtu,
+		Logger:       logger,
+		StackOptions: c.Stack.options(),
+		ICMP:         gvisorcore.ICMPOptions{Mode: icmpMode, Protect: protect},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pipeline{
+		Backend:     backend,
+		Tracker:     tracker.New(),
+		Metrics:     metrics.NewRegistry(),
+		stopTimeout: time.Duration(c.Timeouts.Stop),
+	}
+	if p.stopTimeout == 0 {
+		p.stopTimeout = defaultStopTimeout
+	}
+
+	var fake dns.FakeDns
+	if c.DNS.FakeIP != nil {
+		fake, _ = c.DNS.FakeIP.fakeDNS()
+	}
+
+	// The outbounds of the default handler, shared with the hijack
+	// upstreams.
+	var tcpOb, udpOb outbound.Outbound
+
+	// The DNS cache of the socks handler, shared with the hijack
+	// resolver.
+	var dnsCache *cache.DNSCache
+
+	var h tunnel.Handler
+	switch c.Handler {
+	case "socks":
+		if c.DNS.Cache {
+			dnsCache = cache.NewDNSCache()
+			p.Metrics.Register(metrics.DNSCacheCollector(dnsCache))
+		}
+		udpTimeout := time.Duration(c.Timeouts.UDP)
+		if udpTimeout == 0 {
+			udpTimeout = proxy.DefaultTimeout
+		}
+		tcp, _ := outbound.Parse(c.Outbounds.TCP, outbound.SOCKS5)
+		udp, _ := outbound.Parse(c.Outbounds.UDP, outbound.Relay)
+		h = tunnel.FromLWIP(
+			lwipTCPHandler(tcp, fake, protect, logger),
+			lwipUDPHandler(udp, udpTimeout, dnsCache, fake, protect, logger),
+		)
+	default:
+		tcpOb, err = c.Outbounds.outbound(c.Outbounds.TCP, outbound.SOCKS5, protect, logger)
+		if err != nil {
+			return nil, err
+		}
+		udpOb, err = c.Outbounds.outbound(c.Outbounds.UDP, outbound.Relay, protect, logger)
+		if err != nil {
+			return nil, err
+		}
+		p.outbounds = []outbound.Outbound{tcpOb, udpOb}
+		// The proxy shares the outbounds, and so the sessions of a mux
+		// one, with hijack and health.
+		dp := proxy.NewDefaultProxy(c.Outbounds.TCP, c.Outbounds.UDP, protect)
+		dp.TCPOutbound, dp.UDPOutbound = tcpOb, udpOb
+		if g, ok := tcpOb.(metrics.Group); ok {
+			p.Metrics.Register(metrics.GroupCollector(g))
+		}
+		if g, ok := udpOb.(metrics.Group); ok {
+			p.Metrics.Register(metrics.GroupCollector(g))
+		}
+		if c.Health != nil {
+			p.Health = c.Health.prober(&c.Outbounds, tcpOb, udpOb, protect, logger)
+			p.Metrics.Register(metrics.HealthCollector(p.Health))
+		}
+		dp.Timeout = time.Duration(c.Timeouts.Idle)
+		dp.FakeDNS = fake
+		dp.NAT, _ = proxy.ParseNATMode(c.NAT)
+		dp.Logger = logger
+		p.Metrics.Register(metrics.ProxyCollector(dp))
+		h = dp
+		if c.Routing.routed() {
+			direct := proxy.NewDefaultProxy("direct://", "direct://", protect)
+			direct.Timeout = dp.Timeout
+			direct.FakeDNS = fake
+			direct.NAT = dp.NAT
+			direct.Logger = logger
+			rt, err := c.Routing.handler(dp, direct, logger)
+			if err != nil {
+				return nil, err
+			}
+			rt.FakeDNS = fake
+			h = rt
+		}
+	}
+	if c.Sniff.Enabled {
+		h = sniff.Handler(h, time.Duration(c.Sniff.Timeout))
+	}
+	if hj := c.DNS.Hijack; hj != nil {
+		direct, _ := outbound.New(&outbound.Spec{Scheme: outbound.Direct}, protect)
+		upstream, err := hj.resolver(&splitOutbound{tcp: tcpOb, udp: udpOb}, direct)
+		if err != nil {
+			return nil, err
+		}
+		pipeline := &resolver.Pipeline{FakeDNS: fake, Upstream: upstream}
+		pipeline.Hosts, _ = hj.hosts()
+		if c.DNS.Cache && dnsCache == nil {
+			dnsCache = cache.NewDNSCache()
+			p.Metrics.Register(metrics.DNSCacheCollector(dnsCache))
+		}
+		pipeline.Cache = dnsCache
+		addrs, _ := hj.addrs()
+		hh := hijack.New(h, pipeline, addrs...)
+		hh.Logger = logger
+		h = hh
+	}
+	p.Handler = p.Tracker.Handler(h)
+	p.Metrics.Register(metrics.TrackerCollector(p.Tracker))
+
+	if b, ok := backend.(interface{ Stack() *stack.Stack }); ok {
+		p.Metrics.Register(metrics.StackCollector(b.Stack))
+	} else if kind == tunnel.LWIP {
+		p.Metrics.Register(metrics.LWIPCollector())
+	}
+	return p, nil
+}
+
+func lwipTCPHandler(s *outbound.Spec, fake dns.FakeDns, protect mobile.ProtectSocket, logger *slog.Logger) core.TCPConnHandler {
+	if s.Scheme == outbound.HTTP || s.Scheme == outbound.HTTPS {
+		opts := []http.Option{http.WithLogger(logger), http.WithProtect(protect), http.WithFakeDNS(fake)}
+		if s.Username != "" {
+			opts = append(opts, http.WithAuth(s.Username, s.Password))
+		}
+		if s.Scheme == outbound.HTTPS {
+			opts = append(opts, http.WithTLS(nil))
+		}
+		return http.NewTCPHandler(s.Host, s.Port, opts...)
+	}
+	if s.Scheme == outbound.Shadowsocks {
+		// Validate has checked the method and key already.
+		c, _ := ss.NewCipher(s.Username, s.Password)
+		return shadowsocks.NewTCPHandler(s.Host, s.Port, c,
+			shadowsocks.WithLogger(logger), shadowsocks.WithProtect(protect), shadowsocks.WithFakeDNS(fake))
+	}
+	opts := []socks.Option{socks.WithLogger(logger), socks.WithFakeDNS(fake)}
+	if s.Username != "" {
+		opts = append(opts, socks.WithAuth(s.Username, s.Password))
+	}
+	return socks.NewTCPHandler(s.Host, s.Port, opts...)
+}
+
+func lwipUDPHandler(s *outbound.Spec, timeout time.Duration, dnsCache *cache.DNSCache, fake dns.FakeDns, protect mobile.ProtectSocket, logger *slog.Logger) core.UDPConnHandler {
+	if s.Scheme == outbound.Shadowsocks {
+		c, _ := ss.NewCipher(s.Username, s.Password)
+		return shadowsocks.NewUDPHandler(s.Host, s.Port, c, timeout,
+			shadowsocks.WithLogger(logger), shadowsocks.WithProtect(protect), shadowsocks.WithFakeDNS(fake))
+	}
+	return socks.NewUDPHandler(s.Host, s.Port, timeout, dnsCache, socks.WithLogger(logger), socks.WithFakeDNS(fake),
+		socks.WithRelayDial(outbound.RelayDialer(s, protect).DialContext), socks.WithRelayVersion(s.Version))
+}
+
+// options maps the stack section to gvisorcore options, unset knobs
+// keep the values of gvisorcore.WithDefault.
+func (s Stack) options() []gvisorcore.Option {
+	var opts []gvisorcore.Option
+	if s.TTL != nil {
+		opts = append(opts, gvisorcore.WithDefaultTTL(*s.TTL))
+	}
+	if s.Forwarding != nil {
+		opts = append(opts, gvisorcore.WithForwarding(*s.Forwarding))
+	}
+	if s.ICMPBurst != nil {
+		opts = append(opts, gvisorcore.WithICMPBurst(*s.ICMPBurst))
+	}
+	if s.ICMPLimit != nil {
+		opts = append(opts, gvisorcore.WithICMPLimit(rate.Limit(*s.ICMPLimit)))
+	}
+	if s.TCPCongestionControl != "" {
+		opts = append(opts, gvisorcore.WithTCPCongestionControl(s.TCPCongestionControl))
+	}
+	if s.TCPDelay != nil {
+		opts = append(opts, gvisorcore.WithTCPDelay(*s.TCPDelay))
+	}
+	if s.TCPModerateReceiveBuffer != nil {
+		opts = append(opts, gvisorcore.WithTCPModerateReceiveBuffer(*s.TCPModerateReceiveBuffer))
+	}
+	if s.TCPSACK != nil {
+		opts = append(opts, gvisorcore.WithTCPSACKEnabled(*s.TCPSACK))
+	}
+	if r := s.TCPSendBuffer; r != nil {
+		opts = append(opts, gvisorcore.WithTCPSendBufferSizeRange(r.Min, r.Default, r.Max))
+	}
+	if r := s.TCPReceiveBuffer; r != nil {
+		opts = append(opts, gvisorcore.WithTCPReceiveBufferSizeRange(r.Min, r.Default, r.Max))
+	}
+	return opts
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tun2proxylib/outbound"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+		"backend": "gvisor",
+		"mtu": 1400,
+		"nat": "full_cone",
+		"stack": {"ttl": 64, "tcp_sack": true, "tcp_send_buffer": {"min": 4096, "default": 65536, "max": 1048576}},
+		"outbounds": {"tcp": "127.0.0.1:1080", "udp": "127.0.0.1:1081"},
+		"timeouts": {"idle": "1m", "stop": 2}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MTU != 1400 || *c.Stack.TTL != 64 || c.Stack.TCPSendBuffer.Max != 1048576 {
+		t.Fatal("unexpected config", c)
+	}
+	if time.Duration(c.Timeouts.Idle) != time.Minute || time.Duration(c.Timeouts.Stop) != 2*time.Second {
+		t.Fatal("unexpected timeouts", c.Timeouts)
+	}
+	// ttl, tcp_sack and tcp_send_buffer, the rest keep their defaults.
+	if n := len(c.Stack.options()); n != 3 {
+		t.Fatal("unexpected stack options", n)
+	}
+
+	c, err = Parse([]byte(`{
+		"outbounds": {"tcp": "main", "udp": "127.0.0.1:1081", "groups": [
+			{"name": "main", "members": ["socks5://10.0.0.1:1080", "10.0.0.2:1080"], "retry": "1m"},
+			{"name": "lb", "type": "source_hash", "members": ["socks5://10.0.0.1:1080", "socks5://10.0.0.2:1080"]}
+		]},
+		"health": {"interval": "10s", "url": "http://example.com/", "udp_echo": "1.1.1.1:7"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob, err := c.Outbounds.outbound("main", "socks5", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := ob.(*outbound.Failover)
+	if !ok || f.Name != "main" || f.Retry != time.Minute || len(f.Members) != 2 ||
+		f.Members[0].Name != "socks5://10.0.0.1:1080" || f.Members[1].Name != "socks5://10.0.0.2:1080" {
+		t.Fatal("unexpected group", ob)
+	}
+	udp, _ := c.Outbounds.outbound("127.0.0.1:1081", "relay", nil, nil)
+	p := c.Health.prober(&c.Outbounds, ob, udp, nil, nil)
+	if len(p.Targets) != 3 || !p.Targets[1].TCP || len(p.Targets[1].Members) != 1 || !p.Targets[2].UDP {
+		t.Fatal("unexpected targets", p.Targets)
+	}
+	if ob, _ := c.Outbounds.outbound("lb", "socks5", nil, nil); ob.(*outbound.Balancer).Strategy != outbound.SourceHash {
+		t.Fatal("unexpected group", ob)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse([]byte(`{
+		"backend": "tap",
+		"nat": "cone",
+		"stack": {"tcp_receive_buffer": {"min": 4096, "default": 1024, "max": 8192}, "icmp": "echo"},
+		"outbounds": {"tcp": "127.0.0.1", "udp": "127.0.0.1:1081", "groups": [{"name": "a:b", "members": []}]},
+		"health": {"url": "ftp://example.com/", "count": -1},
+		"routing": {"rules": [{"ports": ["90-80"], "outbound": "vpn"}]},
+		"dns": {"hijack": {"upstreams": [{"url": "quic://dns.google"}], "strategy": "random"}}
+	}`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := map[string]string{
+		"backend":                          `unknown backend "tap", want gvisor or lwip`,
+		"nat":                              `unknown nat mode "cone", want symmetric, restricted or full_cone`,
+		"stack.tcp_receive_buffer.default": "1024 is less than min 4096",
+		"stack.icmp":                       `unknown icmp mode "echo", want local, forward or drop`,
+		"outbounds.tcp":                    "address 127.0.0.1: missing port in address",
+		"outbounds.groups[0].name":         "must not contain ':' or '/'",
+		"outbounds.groups[0].members":      "must not be empty",
+		"health.url":                       `unsupported scheme "ftp", want http or https`,
+		"health.count":                     "must not be negative",
+		"routing.rules[0].ports[0]":        `invalid port range "90-80"`,
+		"routing.rules[0].outbound":        `unknown outbound "vpn", want proxy, direct or reject`,
+		"dns.hijack.upstreams[0].url":      `unknown upstream scheme "quic"`,
+		"dns.hijack.strategy":              `unknown strategy "random", want fallback or parallel`,
+	}
+	errs := err.(interface{ Unwrap() []error }).Unwrap()
+	if len(errs) != len(want) {
+		t.Fatal("unexpected errors", err)
+	}
+	for _, e := range errs {
+		var fe *FieldError
+		if !errors.As(e, &fe) {
+			t.Fatal("not a FieldError", e)
+		}
+		if msg, ok := want[fe.Field]; !ok || fe.Err.Error() != msg {
+			t.Fatal("unexpected error", fe)
+		}
+	}
+
+	if _, err := Parse([]byte(`{"mtu": 1500, "stak": {}}`)); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+	var fe *FieldError
+	if _, err := Parse([]byte(`{"mtu": "big"}`)); !errors.As(err, &fe) || fe.Field != "mtu" {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"tun2proxylib/lwipcore/common/dns/fakedns"
+)
+
+// fakeDNS builds the pool of f, errors are FieldErrors relative to the
+// fake_ip section.
+func (f *FakeIP) fakeDNS() (*fakedns.FakeDNS, []error) {
+	var errs []error
+	var opts []fakedns.Option
+	if f.IPv4Range != "" {
+		p, err := netip.ParsePrefix(f.IPv4Range)
+		if err != nil || !p.Addr().Is4() {
+			errs = append(errs, &FieldError{Field: "ipv4_range", Err: fmt.Errorf("invalid IPv4 CIDR %q", f.IPv4Range)})
+		}
+		opts = append(opts, fakedns.WithIPv4Range(p))
+	}
+	if f.IPv6Range != "" {
+		p, err := netip.ParsePrefix(f.IPv6Range)
+		if err != nil || !p.Addr().Is6() {
+			errs = append(errs, &FieldError{Field: "ipv6_range", Err: fmt.Errorf("invalid IPv6 CIDR %q", f.IPv6Range)})
+		}
+		opts = append(opts, fakedns.WithIPv6Range(p))
+	}
+	if f.Size < 0 {
+		errs = append(errs, &FieldError{Field: "size", Err: errors.New("must not be negative")})
+	} else if f.Size > 0 {
+		opts = append(opts, fakedns.WithSize(f.Size))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	d, err := fakedns.New(opts...)
+	if err != nil {
+		return nil, []error{&FieldError{Field: "ipv4_range", Err: err}}
+	}
+	return d, nil
+}
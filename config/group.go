@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"tun2proxylib/mobile"
+	"tun2proxylib/outbound"
+)
+
+// group returns the group called name, nil if there is none.
+func (o *Outbounds) group(name string) *Group {
+	for i := range o.Groups {
+		if o.Groups[i].Name == name {
+			return &o.Groups[i]
+		}
+	}
+	return nil
+}
+
+// outbound returns the outbound raw names: a group or an outbound URL
+// whose default scheme is def.
+func (o *Outbounds) outbound(raw string, def outbound.Scheme, protect mobile.ProtectSocket, logger *slog.Logger) (outbound.Outbound, error) {
+	if g := o.group(raw); g != nil {
+		return g.outbound(def, protect, logger)
+	}
+	spec, err := outbound.Parse(raw, def)
+	if err != nil {
+		return nil, err
+	}
+	ob, err := outbound.New(spec, protect)
+	if err != nil {
+		return nil, err
+	}
+	return &named{Outbound: ob, name: spec.String()}, nil
+}
+
+// named is an outbound reported by the name of its spec, as the ones
+// DefaultProxy builds itself are.
+type named struct {
+	outbound.Outbound
+	name string
+}
+
+func (n *named) String() string { return n.name }
+func (n *named) Close() error   { return outbound.Close(n.Outbound) }
+
+func (g *Group) outbound(def outbound.Scheme, protect mobile.ProtectSocket, logger *slog.Logger) (outbound.Outbound, error) {
+	f := outbound.Failover{
+		Name:     g.Name,
+		MaxFails: g.MaxFails,
+		Retry:    time.Duration(g.Retry),
+		Timeout:  time.Duration(g.Timeout),
+		Logger:   logger,
+	}
+	for _, raw := range g.Members {
+		spec, err := outbound.Parse(raw, def)
+		if err != nil {
+			return nil, err
+		}
+		ob, err := outbound.New(spec, protect)
+		if err != nil {
+			return nil, err
+		}
+		f.Members = append(f.Members, outbound.NewMember(spec.String(), ob))
+	}
+	if g.Type == "" || g.Type == "failover" {
+		return &f, nil
+	}
+	strategy, err := outbound.ParseStrategy(g.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &outbound.Balancer{Failover: f, Strategy: strategy}, nil
+}
+
+// validate checks g, errors are FieldErrors relative to the group.
+func (g *Group) validate() []error {
+	var errs []error
+	fail := func(field string, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+	switch {
+	case g.Name == "":
+		fail("name", "must not be empty")
+	case strings.ContainsAny(g.Name, ":/"):
+		// It would read as an outbound URL.
+		fail("name", "must not contain ':' or '/'")
+	}
+	if g.Type != "" && g.Type != "failover" {
+		if _, err := outbound.ParseStrategy(g.Type); err != nil {
+			fail("type", "unknown group type %q, want failover, round_robin, least_conn, source_hash or lowest_latency", g.Type)
+		}
+	}
+	if len(g.Members) == 0 {
+		errs = append(errs, &FieldError{Field: "members", Err: errors.New("must not be empty")})
+	}
+	for i, raw := range g.Members {
+		spec, err := outbound.Parse(raw, outbound.SOCKS5)
+		if err == nil {
+			_, err = outbound.New(spec, nil)
+		}
+		if err != nil {
+			fail(fmt.Sprintf("members[%d]", i), "%s", err)
+		}
+	}
+	if g.MaxFails < 0 {
+		fail("max_fails", "must not be negative")
+	}
+	if g.Retry < 0 {
+		fail("retry", "must not be negative")
+	}
+	if g.Timeout < 0 {
+		fail("timeout", "must not be negative")
+	}
+	return errs
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"log/slog"
+	"time"
+
+	"tun2proxylib/health"
+	"tun2proxylib/mobile"
+	"tun2proxylib/outbound"
+)
+
+// prober returns the prober of the tcp and udp outbounds built from o,
+// every member of a group is a target of its own.
+func (h *Health) prober(o *Outbounds, tcp, udp outbound.Outbound, protect mobile.ProtectSocket, logger *slog.Logger) *health.Prober {
+	p := &health.Prober{
+		Interval:  time.Duration(h.Interval),
+		Timeout:   time.Duration(h.Timeout),
+		URL:       h.URL,
+		UDPEcho:   h.UDPEcho,
+		EchoCount: h.Count,
+		Protect:   protect,
+		Logger:    logger,
+	}
+	add := func(t health.Target) {
+		// The same server used for both networks is checked once.
+		for i := range p.Targets {
+			if p.Targets[i].Name == t.Name {
+				p.Targets[i].TCP = p.Targets[i].TCP || t.TCP
+				p.Targets[i].UDP = p.Targets[i].UDP || t.UDP
+				p.Targets[i].Members = append(p.Targets[i].Members, t.Members...)
+				return
+			}
+		}
+		p.Targets = append(p.Targets, t)
+	}
+	targets := func(raw string, def outbound.Scheme, ob outbound.Outbound, isTCP bool) {
+		g := o.group(raw)
+		if g == nil {
+			spec, _ := outbound.Parse(raw, def)
+			add(health.Target{Name: spec.String(), Spec: spec, Outbound: ob, TCP: isTCP, UDP: !isTCP})
+			return
+		}
+		// The members of the group were built in the order of g.Members.
+		for i, m := range members(ob) {
+			spec, _ := outbound.Parse(g.Members[i], def)
+			add(health.Target{
+				Name:     m.Name,
+				Spec:     spec,
+				Outbound: m.Outbound,
+				TCP:      isTCP,
+				UDP:      !isTCP,
+				Members:  []*outbound.Member{m},
+			})
+		}
+	}
+	targets(o.TCP, outbound.SOCKS5, tcp, true)
+	targets(o.UDP, outbound.Relay, udp, false)
+	return p
+}
+
+// members returns the members of a group outbound.
+func members(ob outbound.Outbound) []*outbound.Member {
+	switch g := ob.(type) {
+	case *outbound.Failover:
+		return g.Members
+	case *outbound.Balancer:
+		return g.Members
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"tun2proxylib/outbound"
+	"tun2proxylib/resolver"
+)
+
+// addrs parses the hijacked addresses, errors are FieldErrors relative
+// to the hijack section.
+func (h *Hijack) addrs() ([]netip.AddrPort, []error) {
+	var errs []error
+	var addrs []netip.AddrPort
+	for i, s := range h.Addresses {
+		addr, err := netip.ParseAddrPort(s)
+		if err != nil {
+			errs = append(errs, &FieldError{Field: fmt.Sprintf("addresses[%d]", i), Err: fmt.Errorf("invalid ip:port %q", s)})
+			continue
+		}
+		addrs = append(addrs, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+	}
+	return addrs, errs
+}
+
+func (h *Hijack) upstreams() []Upstream {
+	if len(h.Upstreams) == 0 && len(h.Addresses) > 0 {
+		return []Upstream{{URL: h.Addresses[0]}}
+	}
+	return h.Upstreams
+}
+
+// resolver returns the upstream group of h. Upstreams go through proxy
+// or, when direct, through direct.
+func (h *Hijack) resolver(proxy, direct outbound.Outbound) (resolver.Resolver, error) {
+	g := &resolver.Group{Parallel: h.Strategy == "parallel"}
+	for _, up := range h.upstreams() {
+		ob := proxy
+		if up.Direct {
+			ob = direct
+		}
+		r, err := resolver.NewUpstream(up.URL, ob)
+		if err != nil {
+			return nil, err
+		}
+		g.Upstreams = append(g.Upstreams, r)
+	}
+	if len(g.Upstreams) == 1 {
+		return g.Upstreams[0], nil
+	}
+	return g, nil
+}
+
+func (h *Hijack) hosts() (resolver.Hosts, []error) {
+	var errs []error
+	hosts := make(resolver.Hosts, len(h.Hosts))
+	for name, ips := range h.Hosts {
+		domain := strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, s := range ips {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: "hosts." + name, Err: fmt.Errorf("invalid IP %q", s)})
+				continue
+			}
+			hosts[domain] = append(hosts[domain], addr.Unmap())
+		}
+		if len(ips) == 0 {
+			hosts[domain] = nil
+		}
+	}
+	return hosts, errs
+}
+
+func (h *Hijack) validate() []error {
+	_, errs := h.addrs()
+	_, hostErrs := h.hosts()
+	errs = append(errs, hostErrs...)
+	ups := h.upstreams()
+	if len(ups) == 0 {
+		errs = append(errs, &FieldError{Field: "upstreams", Err: errors.New("required when no address is given")})
+	}
+	for i, up := range ups {
+		if _, err := resolver.NewUpstream(up.URL, nil); err != nil {
+			errs = append(errs, &FieldError{Field: fmt.Sprintf("upstreams[%d].url", i), Err: err})
+		}
+	}
+	switch h.Strategy {
+	case "", "fallback", "parallel":
+	default:
+		errs = append(errs, &FieldError{Field: "strategy", Err: fmt.Errorf("unknown strategy %q, want fallback or parallel", h.Strategy)})
+	}
+	return errs
+}
+
+// splitOutbound carries TCP and UDP through different outbounds, as the
+// outbounds section does.
+type splitOutbound struct {
+	tcp, udp outbound.Outbound
+}
+
+func (s *splitOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	return s.tcp.DialTCP(ctx, target)
+}
+
+func (s *splitOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	return s.udp.ListenUDP(ctx, src)
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/router"
+)
+
+// Outbound names usable by routing rules. Proxy is the outbounds
+// section, Direct connects without a proxy.
+const (
+	OutboundProxy  = "proxy"
+	OutboundDirect = "direct"
+)
+
+// Routing sends flows to an outbound picked by the first matching rule.
+// It is supported by the default handler only.
+type Routing struct {
+	Rules []Rule `json:"rules"`
+
+	// Default is the outbound of the flows no rule matches, "proxy" by
+	// default.
+	Default string `json:"default"`
+}
+
+// Rule is a router.Rule. Addresses are CIDRs or single IPs, ports are
+// "443" or "8000-8080" and networks are "tcp" or "udp".
+type Rule struct {
+	Name        string   `json:"name"`
+	Network     []string `json:"network"`
+	Destination []string `json:"destination"`
+	Ports       []string `json:"ports"`
+	Source      []string `json:"source"`
+	Domains     []string `json:"domains"`
+	Outbound    string   `json:"outbound"`
+}
+
+// routed reports whether flows go through a router.
+func (r *Routing) routed() bool {
+	return len(r.Rules) > 0 || r.Default != ""
+}
+
+func (r *Routing) defaultOutbound() string {
+	if r.Default == "" {
+		return OutboundProxy
+	}
+	return r.Default
+}
+
+// handler returns a router over the proxy and direct outbounds.
+func (r *Routing) handler(proxy, direct gvisorcore.TransportHandler, logger *slog.Logger) (*router.Router, error) {
+	rules := make([]router.Rule, len(r.Rules))
+	for i := range r.Rules {
+		rules[i], _ = r.Rules[i].rule()
+	}
+	rt, err := router.New(rules, r.defaultOutbound(), map[string]gvisorcore.TransportHandler{
+		OutboundProxy:  proxy,
+		OutboundDirect: direct,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rt.Logger = logger
+	return rt, nil
+}
+
+// rule converts r, errors are FieldErrors relative to the rule.
+func (r *Rule) rule() (router.Rule, []error) {
+	var errs []error
+	fail := func(field string, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+
+	rr := router.Rule{Name: r.Name, Domains: r.Domains, Outbound: r.Outbound}
+	for i, n := range r.Network {
+		if n != "tcp" && n != "udp" {
+			fail("network["+strconv.Itoa(i)+"]", "unknown network %q, want tcp or udp", n)
+		}
+		rr.Networks = append(rr.Networks, n)
+	}
+	rr.DestinationCIDRs = parsePrefixes("destination", r.Destination, fail)
+	rr.SourceCIDRs = parsePrefixes("source", r.Source, fail)
+	for i, s := range r.Ports {
+		pr, err := router.ParsePortRange(s)
+		if err != nil {
+			fail("ports["+strconv.Itoa(i)+"]", "%s", err)
+		}
+		rr.DestinationPorts = append(rr.DestinationPorts, pr)
+	}
+	for i, d := range r.Domains {
+		if strings.TrimSuffix(d, ".") == "" {
+			fail("domains["+strconv.Itoa(i)+"]", "must not be empty")
+		}
+	}
+	if err := checkOutbound(r.Outbound); err != nil {
+		fail("outbound", "%s", err)
+	}
+	return rr, errs
+}
+
+func parsePrefixes(field string, values []string, fail func(string, string, ...any)) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for i, s := range values {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(s); err == nil {
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			fail(field+"["+strconv.Itoa(i)+"]", "invalid address or CIDR %q", s)
+			continue
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
+
+func checkOutbound(name string) error {
+	switch name {
+	case OutboundProxy, OutboundDirect, router.Reject:
+		return nil
+	}
+	return fmt.Errorf("unknown outbound %q, want proxy, direct or reject", name)
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/proxy"
+	"tun2proxylib/outbound"
+)
+
+// Validate checks every field of c and returns all the problems found,
+// each one as a *FieldError.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field string, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+
+	switch c.Backend {
+	case "", "gvisor", "lwip":
+	default:
+		fail("backend", "unknown backend %q, want gvisor or lwip", c.Backend)
+	}
+	if c.MTU != 0 && (c.MTU < 576 || c.MTU > 65535) {
+		fail("mtu", "%d is out of range [576, 65535]", c.MTU)
+	}
+	switch c.Handler {
+	case "", "default", "socks":
+	default:
+		fail("handler", "unknown handler %q, want default or socks", c.Handler)
+	}
+	if _, err := proxy.ParseNATMode(c.NAT); err != nil {
+		fail("nat", "%s", err)
+	} else if c.NAT != "" && c.Handler == "socks" {
+		fail("nat", "only supported by the default handler")
+	}
+
+	s := c.Stack
+	if s.TTL != nil && *s.TTL == 0 {
+		fail("stack.ttl", "must be greater than 0")
+	}
+	if s.ICMPBurst != nil && *s.ICMPBurst < 0 {
+		fail("stack.icmp_burst", "must not be negative")
+	}
+	if s.ICMPLimit != nil && *s.ICMPLimit < 0 {
+		fail("stack.icmp_limit", "must not be negative")
+	}
+	switch s.TCPCongestionControl {
+	case "", "reno", "cubic":
+	default:
+		fail("stack.tcp_congestion_control", "unknown algorithm %q, want reno or cubic", s.TCPCongestionControl)
+	}
+	validateBuffer := func(field string, r *BufferRange) {
+		switch {
+		case r == nil:
+		case r.Min <= 0:
+			fail(field+".min", "must be greater than 0")
+		case r.Default < r.Min:
+			fail(field+".default", "%d is less than min %d", r.Default, r.Min)
+		case r.Max < r.Default:
+			fail(field+".max", "%d is less than default %d", r.Max, r.Default)
+		}
+	}
+	validateBuffer("stack.tcp_send_buffer", s.TCPSendBuffer)
+	validateBuffer("stack.tcp_receive_buffer", s.TCPReceiveBuffer)
+	if _, err := gvisorcore.ParseICMPMode(s.ICMP); err != nil {
+		fail("stack.icmp", "%s", err)
+	}
+
+	names := map[string]bool{}
+	for i := range c.Outbounds.Groups {
+		g := &c.Outbounds.Groups[i]
+		if names[g.Name] {
+			fail(fmt.Sprintf("outbounds.groups[%d].name", i), "duplicate group %q", g.Name)
+		}
+		names[g.Name] = true
+		if g.Type == string(outbound.LowestLatency) && c.Health == nil {
+			fail(fmt.Sprintf("outbounds.groups[%d].type", i), "lowest_latency needs the health section")
+		}
+		for _, err := range g.validate() {
+			fe := err.(*FieldError)
+			fe.Field = fmt.Sprintf("outbounds.groups[%d].%s", i, fe.Field)
+			errs = append(errs, fe)
+		}
+	}
+	// A group leaves tcp or udp nil, the scheme checks below skip it.
+	var tcp, udp *outbound.Spec
+	if c.Outbounds.group(c.Outbounds.TCP) == nil {
+		var err error
+		tcp, err = outbound.Parse(c.Outbounds.TCP, outbound.SOCKS5)
+		if err == nil {
+			_, err = outbound.New(tcp, nil)
+		}
+		if err != nil {
+			fail("outbounds.tcp", "%s", err)
+		}
+	} else if c.Handler == "socks" {
+		fail("outbounds.tcp", "groups are not supported by the socks handler")
+	}
+	if c.Outbounds.group(c.Outbounds.UDP) == nil {
+		var err error
+		udp, err = outbound.Parse(c.Outbounds.UDP, outbound.Relay)
+		if err == nil {
+			_, err = outbound.New(udp, nil)
+		}
+		if err != nil {
+			fail("outbounds.udp", "%s", err)
+		}
+	} else if c.Handler == "socks" {
+		fail("outbounds.udp", "groups are not supported by the socks handler")
+	}
+	if c.Handler == "socks" {
+		// The lwip handlers speak SOCKS5, HTTP CONNECT or Shadowsocks
+		// for TCP and the relay format or Shadowsocks for UDP.
+		if tcp != nil && (tcp.Scheme == outbound.Direct || tcp.Scheme == outbound.Relay || tcp.Scheme == outbound.Mux) {
+			fail("outbounds.tcp", "%s outbound is not supported by the socks handler", tcp.Scheme)
+		}
+		if udp != nil && udp.Scheme != outbound.Relay && udp.Scheme != outbound.Shadowsocks {
+			fail("outbounds.udp", "%s outbound is not supported by the socks handler", udp.Scheme)
+		}
+	}
+
+	if hc := c.Health; hc != nil {
+		if c.Handler == "socks" {
+			fail("health", "only supported by the default handler")
+		}
+		if hc.Interval < 0 {
+			fail("health.interval", "must not be negative")
+		}
+		if hc.Timeout < 0 {
+			fail("health.timeout", "must not be negative")
+		}
+		if hc.URL != "" {
+			if u, err := url.Parse(hc.URL); err != nil {
+				fail("health.url", "%s", err)
+			} else if u.Scheme != "http" && u.Scheme != "https" {
+				fail("health.url", "unsupported scheme %q, want http or https", u.Scheme)
+			}
+		}
+		if hc.UDPEcho != "" {
+			if _, _, err := net.SplitHostPort(hc.UDPEcho); err != nil {
+				fail("health.udp_echo", "%s", err)
+			}
+		}
+		if hc.Count < 0 {
+			fail("health.count", "must not be negative")
+		}
+	}
+
+	if c.Routing.routed() && c.Handler == "socks" {
+		fail("routing", "only supported by the default handler")
+	}
+	for i := range c.Routing.Rules {
+		_, ruleErrs := c.Routing.Rules[i].rule()
+		for _, err := range ruleErrs {
+			fe := err.(*FieldError)
+			fe.Field = fmt.Sprintf("routing.rules[%d].%s", i, fe.Field)
+			errs = append(errs, fe)
+		}
+	}
+	if err := checkOutbound(c.Routing.defaultOutbound()); err != nil {
+		fail("routing.default", "%s", err)
+	}
+
+	if c.Sniff.Enabled && c.Handler == "socks" {
+		fail("sniff", "only supported by the default handler")
+	}
+	if c.Sniff.Timeout < 0 {
+		fail("sniff.timeout", "must not be negative")
+	}
+
+	if c.DNS.Hijack != nil {
+		if c.Handler == "socks" {
+			fail("dns.hijack", "only supported by the default handler")
+		}
+		for _, err := range c.DNS.Hijack.validate() {
+			fe := err.(*FieldError)
+			fe.Field = "dns.hijack." + fe.Field
+			errs = append(errs, fe)
+		}
+	}
+	if c.DNS.Cache && c.DNS.Hijack == nil && (c.Handler != "socks" || udp != nil && udp.Scheme != outbound.Relay) {
+		fail("dns.cache", "only supported by dns.hijack or the socks handler with a relay UDP outbound")
+	}
+
+	if c.DNS.FakeIP != nil {
+		_, fakeErrs := c.DNS.FakeIP.fakeDNS()
+		for _, err := range fakeErrs {
+			fe := err.(*FieldError)
+			fe.Field = "dns.fake_ip." + fe.Field
+			errs = append(errs, fe)
+		}
+	}
+
+	if c.Timeouts.Idle < 0 {
+		fail("timeouts.idle", "must not be negative")
+	}
+	if c.Timeouts.UDP < 0 {
+		fail("timeouts.udp", "must not be negative")
+	}
+	if c.Timeouts.Stop < 0 {
+		fail("timeouts.stop", "must not be negative")
+	}
+
+	if c.Dialer.InterfaceIndex < 0 {
+		fail("dialer.interface_index", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
@@ -5,14 +5,17 @@ go 1.25.1
 require (
 	github.com/miekg/dns v1.1.68
 	go.uber.org/atomic v1.11.0
+	golang.org/x/crypto v0.42.0
 	golang.org/x/net v0.44.0
 	golang.org/x/sys v0.36.0
 	golang.org/x/time v0.12.0
 	gvisor.dev/gvisor v0.0.0-20250828211149-1f30edfbb5d4
+	lukechampine.com/blake3 v1.4.1
 )
 
 require (
 	github.com/google/btree v1.1.2 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	golang.org/x/mod v0.28.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/tools v0.37.0 // indirect
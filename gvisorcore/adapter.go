@@ -2,7 +2,9 @@ package gvisorcore
 
 import (
 	"net"
+	"net/netip"
 
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
@@ -22,3 +24,21 @@ type UDPConn interface {
 	// ID returns the transport endpoint id of UDPConn.
 	ID() *stack.TransportEndpointID
 }
+
+// ReverseUDPConn is a UDP flow that can open a flow back to its client
+// from another remote address, for the datagrams of remotes the client
+// has not sent to, as a full-cone NAT delivers them.
+type ReverseUDPConn interface {
+	UDPConn
+
+	// Reverse returns a flow from remote to the client of the
+	// ReverseUDPConn. The flow gets the datagrams the client sends to
+	// remote from then on.
+	Reverse(remote netip.AddrPort) (UDPConn, error)
+}
+
+// endpointAddr formats one end of a transport endpoint id for logging.
+func endpointAddr(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(ip, port)
+}
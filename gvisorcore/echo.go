@@ -0,0 +1,307 @@
+//go:build !windows
+// +build !windows
+
+package gvisorcore
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tun2proxylib/socketbase"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// echoTTL is the TTL, or hop limit, of the replies written to the
+	// tun device.
+	echoTTL = 64
+
+	// maxEchoForwards bounds the echo requests waiting for a forwarded
+	// reply, the others are dropped.
+	maxEchoForwards = 128
+)
+
+// echo is an echo request or reply.
+type echo struct {
+	src, dst netip.Addr
+	id, seq  uint16
+	data     []byte
+}
+
+// parseEcho returns the unicast echo request carried by the IP packet b.
+// IPv6 extension headers and fragments are not looked into.
+func parseEcho(b []byte) (*echo, bool) {
+	e, ok := parseEchoPacket(b)
+	if !ok || e.dst.IsMulticast() || e.dst == netip.IPv4Unspecified() || e.dst == broadcast {
+		return nil, false
+	}
+	return e, true
+}
+
+var broadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+func parseEchoPacket(b []byte) (*echo, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		ip := header.IPv4(b)
+		if !ip.IsValid(len(b)) || ip.Protocol() != uint8(header.ICMPv4ProtocolNumber) ||
+			ip.More() || ip.FragmentOffset() != 0 {
+			return nil, false
+		}
+		icmp := header.ICMPv4(b[ip.HeaderLength():ip.TotalLength()])
+		if len(icmp) < header.ICMPv4MinimumSize || icmp.Type() != header.ICMPv4Echo {
+			return nil, false
+		}
+		return &echo{
+			src:  netip.AddrFrom4(ip.SourceAddress().As4()),
+			dst:  netip.AddrFrom4(ip.DestinationAddress().As4()),
+			id:   icmp.Ident(),
+			seq:  icmp.Sequence(),
+			data: icmp[header.ICMPv4MinimumSize:],
+		}, true
+	case header.IPv6Version:
+		ip := header.IPv6(b)
+		if !ip.IsValid(len(b)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return nil, false
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		if len(icmp) < header.ICMPv6EchoMinimumSize || icmp.Type() != header.ICMPv6EchoRequest {
+			return nil, false
+		}
+		return &echo{
+			src:  netip.AddrFrom16(ip.SourceAddress().As16()),
+			dst:  netip.AddrFrom16(ip.DestinationAddress().As16()),
+			id:   icmp.Ident(),
+			seq:  icmp.Sequence(),
+			data: icmp[header.ICMPv6EchoMinimumSize:],
+		}, true
+	}
+	return nil, false
+}
+
+// reply returns the IP packet answering e with data, from the
+// destination of e to its source.
+func (e *echo) reply(data []byte) []byte {
+	if e.src.Is4() {
+		b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(data))
+		ip := header.IPv4(b)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(b)),
+			TTL:         echoTTL,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     tcpip.AddrFrom4(e.dst.As4()),
+			DstAddr:     tcpip.AddrFrom4(e.src.As4()),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		icmp := header.ICMPv4(b[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4EchoReply)
+		icmp.SetIdent(e.id)
+		icmp.SetSequence(e.seq)
+		copy(icmp[header.ICMPv4MinimumSize:], data)
+		icmp.SetChecksum(header.ICMPv4Checksum(icmp, 0))
+		return b
+	}
+
+	b := make([]byte, header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize+len(data))
+	src, dst := tcpip.AddrFrom16(e.dst.As16()), tcpip.AddrFrom16(e.src.As16())
+	ip := header.IPv6(b)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(b) - header.IPv6MinimumSize),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          echoTTL,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	icmp := header.ICMPv6(b[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6EchoReply)
+	icmp.SetIdent(e.id)
+	icmp.SetSequence(e.seq)
+	copy(icmp[header.ICMPv6EchoMinimumSize:], data)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: icmp, Src: src, Dst: dst}))
+	return b
+}
+
+// icmpEndpoint sits between the link endpoint and the stack and answers
+// the echo requests as its mode says, other packets go through.
+//
+// The stack itself cannot do it: in promiscuous mode ipv4 never replies
+// to pings and ipv6 always does, locally.
+type icmpEndpoint struct {
+	nested.Endpoint
+
+	opts   ICMPOptions
+	logger *slog.Logger
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	forwards sync.WaitGroup
+	slots    chan struct{}
+}
+
+func newICMPEndpoint(child stack.LinkEndpoint, opts ICMPOptions, logger *slog.Logger) *icmpEndpoint {
+	if opts.Mode == "" {
+		opts.Mode = ICMPLocal
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultICMPTimeout
+	}
+	e := &icmpEndpoint{
+		opts:   opts,
+		logger: logger,
+		slots:  make(chan struct{}, maxEchoForwards),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (e *icmpEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	req, ok := e.echoRequest(protocol, pkt)
+	if !ok {
+		e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+		return
+	}
+
+	switch e.opts.Mode {
+	case ICMPLocal:
+		e.write(req.reply(req.data))
+	case ICMPForward:
+		select {
+		case e.slots <- struct{}{}:
+		default:
+			e.logger.Debug("too many pings in flight, dropped", "dst", req.dst)
+			return
+		}
+		e.forwards.Add(1)
+		go func() {
+			defer func() {
+				<-e.slots
+				e.forwards.Done()
+			}()
+			e.forward(req)
+		}()
+	case ICMPDrop:
+	}
+}
+
+// echoRequest copies the echo request out of pkt, if it is one. Only
+// ICMP packets are copied.
+func (e *icmpEndpoint) echoRequest(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) (*echo, bool) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		hdr, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		if !ok || tcpip.TransportProtocolNumber(header.IPv4(hdr).Protocol()) != header.ICMPv4ProtocolNumber {
+			return nil, false
+		}
+	case header.IPv6ProtocolNumber:
+		hdr, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		if !ok || header.IPv6(hdr).TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	return parseEcho(pkt.Data().AsRange().ToSlice())
+}
+
+// forward sends req to its destination and relays the reply.
+func (e *icmpEndpoint) forward(req *echo) {
+	conn, err := socketbase.IcmpListen(req.dst.Is6(), e.opts.Protect)
+	if err != nil {
+		e.logger.Debug("open icmp socket failed", "dst", req.dst, "err", err)
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(e.ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(e.opts.Timeout))
+
+	msg := make([]byte, 8+len(req.data))
+	msg[0] = uint8(header.ICMPv4Echo)
+	if req.dst.Is6() {
+		msg[0] = uint8(header.ICMPv6EchoRequest)
+	}
+	// The kernel sets the identifier and the checksum.
+	binary.BigEndian.PutUint16(msg[6:], req.seq)
+	copy(msg[8:], req.data)
+	dst := &net.UDPAddr{IP: req.dst.AsSlice(), Zone: req.dst.Zone()}
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		e.logger.Debug("forward ping failed", "dst", req.dst, "err", err)
+		return
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e.ctx.Err() == nil {
+				e.logger.Debug("no ping reply", "dst", req.dst, "err", err)
+			}
+			return
+		}
+		data, ok := echoReply(buf[:n], req)
+		if !ok {
+			continue
+		}
+		if e.ctx.Err() != nil {
+			return
+		}
+		e.write(req.reply(data))
+		return
+	}
+}
+
+// echoReply returns the data of b if it is the reply to req. Some
+// systems, darwin for one, leave the IPv4 header in front of it.
+func echoReply(b []byte, req *echo) ([]byte, bool) {
+	want := uint8(header.ICMPv6EchoReply)
+	if req.dst.Is4() {
+		want = uint8(header.ICMPv4EchoReply)
+		if len(b) >= header.IPv4MinimumSize && header.IPVersion(b) == header.IPv4Version {
+			b = b[header.IPv4(b).HeaderLength():]
+		}
+	}
+	if len(b) < 8 || b[0] != want || binary.BigEndian.Uint16(b[6:]) != req.seq {
+		return nil, false
+	}
+	return b[8:], true
+}
+
+// write sends the IP packet b to the tun device.
+func (e *icmpEndpoint) write(b []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(b),
+	})
+	defer pkt.DecRef()
+	pkt.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	if header.IPVersion(b) == header.IPv6Version {
+		pkt.NetworkProtocolNumber = header.IPv6ProtocolNumber
+	}
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+	if _, err := e.Endpoint.WritePackets(pkts); err != nil {
+		e.logger.Debug("write ping reply failed", "err", err)
+	}
+}
+
+// Close stops the forwarded pings before closing the link endpoint, so
+// that no reply is written to it afterwards.
+func (e *icmpEndpoint) Close() {
+	e.cancel()
+	e.forwards.Wait()
+	e.Endpoint.Close()
+}
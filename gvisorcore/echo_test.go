@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package gvisorcore
+
+import (
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// countDispatcher counts the packets that reach the stack.
+type countDispatcher struct {
+	n int
+}
+
+func (d *countDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+	d.n++
+}
+
+func (d *countDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {}
+
+// request builds an echo request from src to dst, the reverse of a reply.
+func request(src, dst string, data []byte) []byte {
+	e := &echo{src: netip.MustParseAddr(dst), dst: netip.MustParseAddr(src), id: 7, seq: 42}
+	b := e.reply(data)
+	if e.src.Is4() {
+		header.ICMPv4(b[header.IPv4MinimumSize:]).SetType(header.ICMPv4Echo)
+	} else {
+		header.ICMPv6(b[header.IPv6MinimumSize:]).SetType(header.ICMPv6EchoRequest)
+	}
+	return b
+}
+
+func inject(ch *channel.Endpoint, b []byte) {
+	proto := header.IPv4ProtocolNumber
+	if header.IPVersion(b) == header.IPv6Version {
+		proto = header.IPv6ProtocolNumber
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+	ch.InjectInbound(proto, pkt)
+	pkt.DecRef()
+}
+
+func TestEchoLocal(t *testing.T) {
+	ch := channel.New(4, 1500, "")
+	ep := newICMPEndpoint(ch, ICMPOptions{}, slog.Default())
+	d := &countDispatcher{}
+	ep.Attach(d)
+	defer ep.Close()
+
+	data := []byte("ping payload")
+	for _, addrs := range [][2]string{{"10.0.0.2", "1.1.1.1"}, {"fd00::2", "2001:db8::1"}} {
+		inject(ch, request(addrs[0], addrs[1], data))
+		pkt := ch.Read()
+		if pkt == nil {
+			t.Fatal("no reply to", addrs[1])
+		}
+		b := pkt.ToView().AsSlice()
+		pkt.DecRef()
+
+		t.Log(len(b), "bytes reply from", addrs[1])
+		if header.IPVersion(b) == header.IPv4Version {
+			ip := header.IPv4(b)
+			icmp := header.ICMPv4(ip.Payload())
+			if icmp.Type() != header.ICMPv4EchoReply || ip.SourceAddress().String() != addrs[1] ||
+				icmp.Ident() != 7 || icmp.Sequence() != 42 || !ip.IsChecksumValid() {
+				t.Fatal("unexpected reply")
+			}
+			if header.ICMPv4Checksum(icmp, 0) != icmp.Checksum() || !bytes.Equal(icmp.Payload(), data) {
+				t.Fatal("bad icmp checksum or payload")
+			}
+		} else {
+			ip := header.IPv6(b)
+			icmp := header.ICMPv6(ip.Payload())
+			if icmp.Type() != header.ICMPv6EchoReply || ip.SourceAddress().String() != addrs[1] ||
+				icmp.Ident() != 7 || icmp.Sequence() != 42 {
+				t.Fatal("unexpected reply")
+			}
+			sum := header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: icmp, Src: ip.SourceAddress(), Dst: ip.DestinationAddress()})
+			if sum != icmp.Checksum() || !bytes.Equal(icmp[header.ICMPv6EchoMinimumSize:], data) {
+				t.Fatal("bad icmp checksum or payload")
+			}
+		}
+	}
+	if d.n != 0 {
+		t.Fatal(d.n, "echo requests reached the stack")
+	}
+}
+
+func TestEchoDrop(t *testing.T) {
+	ch := channel.New(4, 1500, "")
+	ep := newICMPEndpoint(ch, ICMPOptions{Mode: ICMPDrop}, slog.Default())
+	d := &countDispatcher{}
+	ep.Attach(d)
+	defer ep.Close()
+
+	inject(ch, request("10.0.0.2", "1.1.1.1", nil))
+	if pkt := ch.Read(); pkt != nil {
+		pkt.DecRef()
+		t.Fatal("dropped echo got a reply")
+	}
+
+	// Not an echo request, left to the stack.
+	b := request("10.0.0.2", "1.1.1.1", nil)
+	header.ICMPv4(b[header.IPv4MinimumSize:]).SetType(header.ICMPv4EchoReply)
+	inject(ch, b)
+	if d.n != 1 {
+		t.Fatal("echo reply did not reach the stack")
+	}
+}
@@ -0,0 +1,264 @@
+//go:build !windows
+// +build !windows
+
+package gvisorcore
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// DefaultStopTimeout is the time Stop gives live flows to finish
+// before they are aborted.
+const DefaultStopTimeout = 5 * time.Second
+
+var (
+	ErrEngineRunning = errors.New("engine is already running")
+	ErrEngineStopped = errors.New("engine is stopped")
+)
+
+type engineState int
+
+const (
+	engineIdle engineState = iota
+	engineRunning
+	engineStopping
+	engineStopped
+)
+
+type EngineOptions struct {
+	// FD is the file descriptor of the tun device. The engine takes
+	// ownership of it and closes it on Stop.
+	FD int
+
+	// MTU is the MTU of the tun device.
+	MTU uint32
+
+	// TransportHandler handles every TCP/UDP flow accepted by the stack.
+	TransportHandler TransportHandler
+
+	// Logger receives the diagnostics of the engine and its stack.
+	// Defaults to slog.Default.
+	Logger *slog.Logger
+
+	// StackOptions tune the stack, see StackOptions.Options.
+	StackOptions []Option
+
+	// ICMP says how echo requests are answered, see StackOptions.ICMP.
+	ICMP ICMPOptions
+}
+
+// Engine owns the link endpoint, the gVisor stack and every flow handed
+// to the TransportHandler, so that a tunnel can be stopped and started
+// again without leaking goroutines or file descriptors.
+type Engine struct {
+	opts EngineOptions
+
+	mu    sync.Mutex
+	state engineState
+	stack *stack.Stack
+	flows *FlowSet
+	done  chan struct{}
+}
+
+func NewEngine(opts EngineOptions) *Engine {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Engine{
+		opts:  opts,
+		flows: NewFlowSet(),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start creates the link endpoint and the stack and starts dispatching
+// packets from the tun device. If it fails the tun fd is closed and the
+// engine is stopped.
+func (e *Engine) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case engineRunning:
+		return ErrEngineRunning
+	case engineStopping, engineStopped:
+		return ErrEngineStopped
+	}
+
+	ep, err := CreateLinkEndpoint(e.opts.FD, e.opts.MTU)
+	if err != nil {
+		e.fail()
+		return err
+	}
+	s, err := CreateStack(StackOptions{
+		TransportHandler: engineHandler{e},
+		LinkEndpoint:     ep,
+		Logger:           e.opts.Logger,
+		Options:          e.opts.StackOptions,
+		ICMP:             e.opts.ICMP,
+	})
+	if err != nil {
+		ep.Close()
+		e.fail()
+		return err
+	}
+	e.stack = s
+	e.state = engineRunning
+	return nil
+}
+
+// fail closes the fd of an engine that could not start, e.mu held.
+func (e *Engine) fail() {
+	unix.Close(e.opts.FD)
+	e.state = engineStopped
+	close(e.done)
+}
+
+// Stack returns the underlying stack, or nil if the engine is not running.
+func (e *Engine) Stack() *stack.Stack {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != engineRunning {
+		return nil
+	}
+	return e.stack
+}
+
+// Stop stops accepting new flows and waits up to timeout for live flows
+// to finish, then aborts the remaining ones, tears down the stack and
+// closes the tun fd. A non-positive timeout aborts live flows at once.
+func (e *Engine) Stop(timeout time.Duration) error {
+	e.mu.Lock()
+	if e.state != engineRunning {
+		if e.state == engineIdle {
+			// The fd is ours even if the engine never ran.
+			err := unix.Close(e.opts.FD)
+			e.state = engineStopped
+			close(e.done)
+			e.mu.Unlock()
+			return err
+		}
+		e.mu.Unlock()
+		return ErrEngineStopped
+	}
+	e.state = engineStopping
+	e.mu.Unlock()
+
+	if n := e.flows.Shutdown(timeout); n > 0 {
+		e.opts.Logger.Debug("aborted live flows", "count", n)
+	}
+
+	// Destroy removes the NIC, which stops the fdbased dispatchers, so
+	// nothing reads from the fd once it returns.
+	e.stack.Destroy()
+	err := unix.Close(e.opts.FD)
+	e.opts.Logger.Info("engine stopped")
+
+	e.mu.Lock()
+	e.state = engineStopped
+	e.stack = nil
+	e.mu.Unlock()
+	close(e.done)
+	return err
+}
+
+// Wait blocks until the engine is stopped.
+func (e *Engine) Wait() {
+	<-e.done
+}
+
+// track registers c as a live flow. It returns false if the engine is
+// no longer accepting flows.
+func (e *Engine) track(c io.Closer) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != engineRunning {
+		return false
+	}
+	return e.flows.Add(c)
+}
+
+func (e *Engine) untrack(c io.Closer) {
+	e.flows.Remove(c)
+}
+
+// engineHandler sits between the stack and the user TransportHandler
+// and keeps track of the flows passed through it.
+type engineHandler struct {
+	e *Engine
+}
+
+func (h engineHandler) HandleTCP(conn TCPConn) {
+	c := &engineTCPConn{TCPConn: conn, e: h.e}
+	if !h.e.track(c) {
+		conn.Close()
+		return
+	}
+	h.e.opts.TransportHandler.HandleTCP(c)
+}
+
+func (h engineHandler) HandleUDP(conn UDPConn) {
+	c := &engineUDPConn{UDPConn: conn, e: h.e}
+	if !h.e.track(c) {
+		conn.Close()
+		return
+	}
+	h.e.opts.TransportHandler.HandleUDP(c)
+}
+
+type engineTCPConn struct {
+	TCPConn
+	e    *Engine
+	once sync.Once
+	err  error
+}
+
+func (c *engineTCPConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.TCPConn.Close()
+		c.e.untrack(c)
+	})
+	return c.err
+}
+
+type engineUDPConn struct {
+	UDPConn
+	e    *Engine
+	once sync.Once
+	err  error
+}
+
+func (c *engineUDPConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.UDPConn.Close()
+		c.e.untrack(c)
+	})
+	return c.err
+}
+
+// Reverse tracks the reverse flows as the others, see ReverseUDPConn.
+func (c *engineUDPConn) Reverse(remote netip.AddrPort) (UDPConn, error) {
+	r, ok := c.UDPConn.(ReverseUDPConn)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	conn, err := r.Reverse(remote)
+	if err != nil {
+		return nil, err
+	}
+	rc := &engineUDPConn{UDPConn: conn, e: c.e}
+	if !c.e.track(rc) {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	return rc, nil
+}
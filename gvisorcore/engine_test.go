@@ -0,0 +1,150 @@
+//go:build !windows
+// +build !windows
+
+package gvisorcore
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+type udpHandler chan UDPConn
+
+func (h udpHandler) HandleTCP(conn TCPConn) { conn.Close() }
+func (h udpHandler) HandleUDP(conn UDPConn) { h <- conn }
+
+// datagram builds an IPv4 UDP packet, without UDP checksum.
+func datagram(src, dst netip.AddrPort, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	u := header.UDP(ip.Payload())
+	u.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(u.Payload(), payload)
+	return b
+}
+
+// tunPair returns the fd of a fake tun device for the engine and the
+// peer end packets are written to.
+func tunPair(t *testing.T) (int, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	return fds[0], fds[1]
+}
+
+func closed(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return errors.Is(err, unix.EBADF)
+}
+
+func TestEngineLifecycle(t *testing.T) {
+	fd, peer := tunPair(t)
+	h := make(udpHandler, 1)
+	e := NewEngine(EngineOptions{FD: fd, MTU: 1500, TransportHandler: h})
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(); err != ErrEngineRunning {
+		t.Fatal("second Start:", err)
+	}
+
+	// A flow the handler never closes is aborted once the drain
+	// timeout expires.
+	client := netip.MustParseAddrPort("10.0.0.2:5000")
+	server := netip.MustParseAddrPort("1.1.1.1:53")
+	if _, err := unix.Write(peer, datagram(client, server, []byte("query"))); err != nil {
+		t.Fatal(err)
+	}
+	var conn UDPConn
+	select {
+	case conn = <-h:
+	case <-time.After(time.Second):
+		t.Fatal("no flow")
+	}
+	read := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		conn.Read(buf)
+		_, err := conn.Read(buf)
+		read <- err
+	}()
+
+	start := time.Now()
+	if err := e.Stop(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("stopped in", time.Since(start))
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("live flow not given the drain timeout")
+	}
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("aborted flow still readable")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flow not aborted")
+	}
+	e.Wait()
+	if !closed(fd) || e.Stack() != nil {
+		t.Fatal("tun fd or stack left behind")
+	}
+	if err := e.Stop(0); err != ErrEngineStopped {
+		t.Fatal("second Stop:", err)
+	}
+	if err := e.Start(); err != ErrEngineStopped {
+		t.Fatal("Start after Stop:", err)
+	}
+}
+
+func TestEngineNeverStarted(t *testing.T) {
+	fd, _ := tunPair(t)
+	e := NewEngine(EngineOptions{FD: fd, MTU: 1500, TransportHandler: make(udpHandler)})
+	if err := e.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	e.Wait()
+	if !closed(fd) {
+		t.Fatal("idle Stop left the tun fd open")
+	}
+}
+
+func TestEngineStartFailure(t *testing.T) {
+	// An O_PATH fd cannot be made non-blocking, so the link endpoint
+	// fails.
+	fd, err := unix.Open(".", unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(EngineOptions{FD: fd, MTU: 1500, TransportHandler: make(udpHandler)})
+	if err := e.Start(); err == nil {
+		t.Fatal("Start succeeded")
+	}
+	e.Wait()
+	if !closed(fd) {
+		t.Fatal("failed Start left the tun fd open")
+	}
+	if err := e.Stop(0); err != ErrEngineStopped {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package gvisorcore
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// FlowSet keeps the live flows of a backend so that stopping it can
+// drain and abort them.
+type FlowSet struct {
+	mu     sync.Mutex
+	closed bool
+	flows  map[io.Closer]struct{}
+	live   sync.WaitGroup
+}
+
+func NewFlowSet() *FlowSet {
+	return &FlowSet{flows: make(map[io.Closer]struct{})}
+}
+
+// Add registers c. It returns false once the set is shut down.
+func (s *FlowSet) Add(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.flows[c] = struct{}{}
+	s.live.Add(1)
+	return true
+}
+
+// Remove forgets c, flows call it once closed.
+func (s *FlowSet) Remove(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.flows[c]; ok {
+		delete(s.flows, c)
+		s.live.Done()
+	}
+}
+
+// Shutdown refuses new flows, waits up to timeout for the live ones to
+// finish and closes whatever is left. A non-positive timeout closes
+// them at once. It returns the number of flows it closed.
+func (s *FlowSet) Shutdown(timeout time.Duration) int {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	if timeout > 0 {
+		drained := make(chan struct{})
+		go func() {
+			s.live.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(timeout):
+		}
+	}
+
+	s.mu.Lock()
+	flows := make([]io.Closer, 0, len(s.flows))
+	for c := range s.flows {
+		flows = append(flows, c)
+	}
+	s.mu.Unlock()
+	for _, c := range flows {
+		c.Close()
+	}
+	s.live.Wait()
+	return len(flows)
+}
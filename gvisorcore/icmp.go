@@ -0,0 +1,54 @@
+package gvisorcore
+
+import (
+	"fmt"
+	"time"
+
+	"tun2proxylib/mobile"
+)
+
+// ICMPMode selects how the echo requests read from the tun device are
+// answered.
+type ICMPMode string
+
+const (
+	// ICMPLocal replies to every echo request at once, whatever the
+	// destination. It is the default.
+	ICMPLocal ICMPMode = "local"
+
+	// ICMPForward sends the echo requests to their destination on an
+	// unprivileged ICMP datagram socket and relays the real replies.
+	// On Linux the process must be in net.ipv4.ping_group_range.
+	ICMPForward ICMPMode = "forward"
+
+	// ICMPDrop drops echo requests, pings time out.
+	ICMPDrop ICMPMode = "drop"
+)
+
+// DefaultICMPTimeout bounds the wait for a forwarded echo reply.
+const DefaultICMPTimeout = 5 * time.Second
+
+// ParseICMPMode returns the mode named s, "" is ICMPLocal.
+func ParseICMPMode(s string) (ICMPMode, error) {
+	switch m := ICMPMode(s); m {
+	case "":
+		return ICMPLocal, nil
+	case ICMPLocal, ICMPForward, ICMPDrop:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown icmp mode %q, want local, forward or drop", s)
+	}
+}
+
+type ICMPOptions struct {
+	// Mode defaults to ICMPLocal.
+	Mode ICMPMode
+
+	// Protect keeps the sockets of ICMPForward out of the tunnel, see
+	// socketbase.IcmpListen.
+	Protect mobile.ProtectSocket
+
+	// Timeout bounds the wait for a forwarded reply, DefaultICMPTimeout
+	// when 0.
+	Timeout time.Duration
+}
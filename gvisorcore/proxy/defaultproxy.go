@@ -1,27 +1,110 @@
 package proxy
 
 import (
-	"io"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"tun2proxylib/gvisorcore"
 	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/lwipcore/common/dns"
 	"tun2proxylib/mobile"
-	"tun2proxylib/socketbase"
-	"tun2proxylib/udppackage"
+	"tun2proxylib/outbound"
+	"tun2proxylib/tracker"
 
-	"golang.org/x/net/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-var timeout = 30 * time.Second
+// DefaultTimeout is the idle timeout of relayed flows.
+const DefaultTimeout = 30 * time.Second
 
 type DefaultProxy struct {
+	// TCPUrl and UDPUrl are outbound URLs, see outbound.Parse. A bare
+	// host:port is a SOCKS5 server for TCP and a udppackage relay for
+	// UDP, a socks5:// UDPUrl relays UDP with UDP ASSOCIATE.
 	TCPUrl string
 	UDPUrl string
 	Func   mobile.ProtectSocket
+
+	// TCPOutbound and UDPOutbound, when set, are used instead of TCPUrl
+	// and UDPUrl, e.g. an outbound.Failover or outbound.Balancer group. An outbound that
+	// implements fmt.Stringer is named after it.
+	TCPOutbound outbound.Outbound
+	UDPOutbound outbound.Outbound
+
+	// Timeout closes a relayed flow after this long without traffic.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// FakeDNS, when set, answers the A and AAAA queries of UDP flows to
+	// port 53 with fake IPs, and flows to fake IPs are sent to the
+	// outbound by domain.
+	FakeDNS dns.FakeDns
+
+	// NAT is how UDP flows share outbound sessions, NATSymmetric when
+	// empty. Flows to fake IPs always get a session of their own.
+	NAT NATMode
+
+	// Logger receives per flow diagnostics at debug level, so they stay
+	// silent unless enabled. Defaults to slog.Default.
+	Logger *slog.Logger
+
+	tcp, udp lazyOutbound
+	nat      natTable
+
+	stats struct {
+		tcpDialSuccess atomic.Uint64
+		tcpDialFailure atomic.Uint64
+		tcpAuthFailure atomic.Uint64
+		udpDialSuccess atomic.Uint64
+		udpDialFailure atomic.Uint64
+	}
+}
+
+// Stats counts the outbound dials made by a DefaultProxy. Dials
+// rejected by the proxy credentials count as TCPAuthFailure only.
+type Stats struct {
+	TCPDialSuccess uint64
+	TCPDialFailure uint64
+	TCPAuthFailure uint64
+	UDPDialSuccess uint64
+	UDPDialFailure uint64
+}
+
+// lazyOutbound builds an outbound from its URL on first use, unless one
+// is given.
+type lazyOutbound struct {
+	once sync.Once
+	name string
+	ob   outbound.Outbound
+	err  error
+}
+
+func (l *lazyOutbound) get(ob outbound.Outbound, raw string, def outbound.Scheme, p mobile.ProtectSocket) (outbound.Outbound, string, error) {
+	l.once.Do(func() {
+		if ob != nil {
+			l.ob, l.name = ob, "custom"
+			if s, ok := ob.(fmt.Stringer); ok {
+				l.name = s.String()
+			}
+			return
+		}
+		l.name = raw
+		spec, err := outbound.Parse(raw, def)
+		if err != nil {
+			l.err = err
+			return
+		}
+		l.name = spec.String()
+		l.ob, l.err = outbound.New(spec, p)
+	})
+	return l.ob, l.name, l.err
 }
 
 func NewDefaultProxy(tcpUrl, udpUrl string, p mobile.ProtectSocket) *DefaultProxy {
@@ -32,61 +115,163 @@ func NewDefaultProxy(tcpUrl, udpUrl string, p mobile.ProtectSocket) *DefaultProx
 	}
 }
 
+// Stats returns the dial counters of p.
+func (p *DefaultProxy) Stats() Stats {
+	return Stats{
+		TCPDialSuccess: p.stats.tcpDialSuccess.Load(),
+		TCPDialFailure: p.stats.tcpDialFailure.Load(),
+		TCPAuthFailure: p.stats.tcpAuthFailure.Load(),
+		UDPDialSuccess: p.stats.udpDialSuccess.Load(),
+		UDPDialFailure: p.stats.udpDialFailure.Load(),
+	}
+}
+
 func (p *DefaultProxy) HandleTCP(conn gvisorcore.TCPConn) {
-	dialer, err := proxy.SOCKS5("tcp", p.TCPUrl, nil, nil)
+	ob, name, err := p.tcp.get(p.TCPOutbound, p.TCPUrl, outbound.SOCKS5, p.Func)
+	logger := p.flowLogger(conn, "tcp", name)
 	if err != nil {
+		p.stats.tcpDialFailure.Add(1)
+		logger.Debug("invalid outbound", "err", err)
 		conn.Close()
 		return
 	}
 	id := conn.ID()
-	srcIP := id.RemoteAddress
-	srcPort := id.RemotePort
-	dstIP := id.LocalAddress
+	dstIP := net.IP(id.LocalAddress.AsSlice())
 	dstPort := id.LocalPort
 
-	log.Printf("TCP stream--->srcIP: %v, srcPort: %v, dstIP: %v, dstPort: %v", srcIP, srcPort, dstIP, dstPort)
-
-	remoteAddress := net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort)))
+	// A domain learned by a sniffer or fake DNS is handed to the proxy
+	// as it is, the local resolver may not know it.
+	srcIP, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+	ctx := outbound.WithSource(context.Background(), netip.AddrPortFrom(srcIP, id.RemotePort))
+	remoteAddress := dns.Target(p.FakeDNS, dstIP, int(dstPort))
+	if d, ok := conn.(interface{ Domain() string }); ok && d.Domain() != "" {
+		remoteAddress = net.JoinHostPort(d.Domain(), strconv.Itoa(int(dstPort)))
+		ctx = outbound.WithRemoteResolve(ctx)
+	} else if p.isFake(dstIP) {
+		ctx = outbound.WithRemoteResolve(ctx)
+	}
 
-	proxyConn, err := dialer.Dial("tcp", remoteAddress)
+	proxyConn, err := ob.DialTCP(ctx, remoteAddress)
+	if errors.Is(err, outbound.ErrAuthFailed) {
+		// A configuration problem rather than a flow one, so it is
+		// reported above debug level.
+		p.stats.tcpAuthFailure.Add(1)
+		p.logger().Warn("outbound rejected credentials", "outbound", name, "err", err)
+		conn.Close()
+		return
+	}
 	if err != nil {
+		p.stats.tcpDialFailure.Add(1)
+		logger.Debug("dial outbound failed", "err", err)
 		conn.Close()
 		return
 	}
+	p.stats.tcpDialSuccess.Add(1)
+	tracker.SetOutbound(conn, name)
+	logger.Debug("relay tcp stream")
 	go func() {
 		defer conn.Close()
 		defer proxyConn.Close()
-		//gvisorcore.Relay(conn, proxyConn)
-		log.Println("relay of conn")
-		var wg sync.WaitGroup
+		var (
+			wg   sync.WaitGroup
+			last atomic.Int64
+		)
+		last.Store(time.Now().UnixNano())
 		wg.Add(2)
-		go copySource2Destination(conn, proxyConn, &wg)
-		go copySource2Destination(proxyConn, conn, &wg)
+		go copySource2Destination(conn, proxyConn, &last, &wg, p.timeout())
+		go copySource2Destination(proxyConn, conn, &last, &wg, p.timeout())
 		wg.Wait()
 	}()
 
 }
 
-func copySource2Destination(s, d net.Conn, w *sync.WaitGroup) {
-	s.SetReadDeadline(time.Now().Add(timeout))
-	d.SetWriteDeadline(time.Now().Add(timeout))
-	io.Copy(s, d)
-	w.Done()
+func (p *DefaultProxy) isFake(ip net.IP) bool {
+	return p.FakeDNS != nil && p.FakeDNS.IsFakeIP(ip)
+}
+
+func (p *DefaultProxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultTimeout
 }
 
-// HandleUDP handles UDP packets by forwarding them to the specified UDP proxy server.
-// It reads packets from the gVisor UDP connection, encapsulates them, and sends them to the proxy server.
-// It also listens for responses from the proxy server and forwards them back to the original sender.
+func (p *DefaultProxy) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
 
+// flowLogger returns the logger of p annotated with the flow of conn.
+func (p *DefaultProxy) flowLogger(conn interface {
+	ID() *stack.TransportEndpointID
+}, network, outbound string) *slog.Logger {
+	logger := p.logger()
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return logger
+	}
+	id := conn.ID()
+	src, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+	dst, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	attrs := []any{
+		"network", network,
+		"src", netip.AddrPortFrom(src, id.RemotePort),
+		"dst", netip.AddrPortFrom(dst, id.LocalPort),
+		"outbound", outbound,
+	}
+	if flow, ok := tracker.FlowID(conn); ok {
+		attrs = append(attrs, "flow", flow)
+	}
+	return logger.With(attrs...)
+}
+
+// copySource2Destination copies s to d until either fails or the stream
+// has been idle both ways for timeout. last is the time of the latest
+// traffic, shared by the two directions.
+func copySource2Destination(s, d net.Conn, last *atomic.Int64, w *sync.WaitGroup, timeout time.Duration) {
+	defer w.Done()
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+
+	for {
+		s.SetReadDeadline(time.Now().Add(timeout))
+		n, err := s.Read(buf)
+		if n > 0 {
+			last.Store(time.Now().UnixNano())
+			d.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := d.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, last.Load())) < timeout {
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// HandleUDP relays the datagrams of a UDP flow through the UDP outbound
+// and writes the replies back to the original sender, in a session of
+// its own or of its source as NAT says.
 func (p *DefaultProxy) HandleUDP(conn gvisorcore.UDPConn) {
+	ob, name, err := p.udp.get(p.UDPOutbound, p.UDPUrl, outbound.Relay, p.Func)
+	logger := p.flowLogger(conn, "udp", name)
+	if err != nil {
+		p.stats.udpDialFailure.Add(1)
+		logger.Debug("invalid outbound", "err", err)
+		conn.Close()
+		return
+	}
 	id := conn.ID()
 	srcIP := id.RemoteAddress
 	srcPort := id.RemotePort
 	dstIP := id.LocalAddress
 	dstPort := id.LocalPort
 
-	log.Printf("UDP packet: srcIP: %v, srcPort: %v, dstIP: %v, dstPort: %v", srcIP, srcPort, dstIP, dstPort)
-
 	dest := net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort)))
 	src := net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort)))
 	destAddr, err := parseAddress(dest)
@@ -100,45 +285,62 @@ func (p *DefaultProxy) HandleUDP(conn gvisorcore.UDPConn) {
 		return
 	}
 
-	rawConn, err := socketbase.UdpDailNetString(p.UDPUrl, p.Func)
+	// The domain behind a fake IP is left to the proxy, as for TCP.
+	ctx := context.Background()
+	var dst net.Addr = &destAddr
+	if p.isFake(destAddr.IP) {
+		dst = outbound.HostAddr(dns.Target(p.FakeDNS, destAddr.IP, destAddr.Port))
+		ctx = outbound.WithRemoteResolve(ctx)
+	}
+	var fake dns.FakeDns
+	if destAddr.Port == dns.COMMON_DNS_PORT {
+		fake = p.FakeDNS
+	}
+	if p.NAT != "" && p.NAT != NATSymmetric && !p.isFake(destAddr.IP) {
+		p.handleNAT(conn, ob, name, logger, unmapped(&srcAddr), unmapped(&destAddr), fake)
+		return
+	}
+
+	pc, err := ob.ListenUDP(ctx, &srcAddr)
 	if err != nil {
+		p.stats.udpDialFailure.Add(1)
+		logger.Debug("dial outbound failed", "err", err)
 		conn.Close()
 		return
 	}
+	p.stats.udpDialSuccess.Add(1)
+	tracker.SetOutbound(conn, name)
+	logger.Debug("relay udp flow")
 
 	go func() {
 		defer conn.Close()
-		defer rawConn.Close()
+		defer pc.Close()
 		var wg sync.WaitGroup
 		wg.Add(2)
 
-		go sendUdpPacket2RemoteDestination(conn, destAddr, srcAddr, rawConn, &wg)
-		go copyFromRemote2LocalDestination(rawConn, conn, &wg, &srcAddr)
+		go sendUdpPacket2RemoteDestination(conn, dst, pc, &wg, p.timeout(), fake, logger)
+		go copyFromRemote2LocalDestination(pc, conn, &wg, &srcAddr, p.timeout())
 
 		wg.Wait()
 	}()
 
 }
 
-func copyFromRemote2LocalDestination(rawConn net.Conn, conn gvisorcore.UDPConn, wg *sync.WaitGroup, to net.Addr) {
+func copyFromRemote2LocalDestination(pc net.PacketConn, conn gvisorcore.UDPConn, wg *sync.WaitGroup, to net.Addr, timeout time.Duration) {
 	buf := buffer.Get()
 	defer buffer.Put(buf)
 
 	for {
-		rawConn.SetReadDeadline(time.Now().Add(timeout))
-		n, err := rawConn.Read(buf[:buffer.TriplePage])
+		pc.SetReadDeadline(time.Now().Add(timeout))
+		n, _, err := pc.ReadFrom(buf[:buffer.TriplePage])
 		if err != nil {
 			break
 		}
 		if n == 0 {
 			continue
 		}
-		_, _, payload, err := udppackage.UnpackUDPData(buf[:n])
-		if err != nil {
-			break
-		}
 		conn.SetWriteDeadline(time.Now().Add(timeout))
-		_, err = conn.WriteTo(payload, to)
+		_, err = conn.WriteTo(buf[:n], to)
 		if err != nil {
 			break
 		}
@@ -147,23 +349,37 @@ func copyFromRemote2LocalDestination(rawConn net.Conn, conn gvisorcore.UDPConn,
 	wg.Done()
 }
 
-func sendUdpPacket2RemoteDestination(conn gvisorcore.UDPConn, destAddr net.UDPAddr, srcAddr net.UDPAddr, rawConn net.Conn, wg *sync.WaitGroup) {
+// sendUdpPacket2RemoteDestination relays the datagrams of conn to
+// destAddr. Queries fake can answer are answered locally instead.
+func sendUdpPacket2RemoteDestination(conn gvisorcore.UDPConn, destAddr net.Addr, pc net.PacketConn, wg *sync.WaitGroup, timeout time.Duration, fake dns.FakeDns, logger *slog.Logger) {
 	buf := buffer.Get()
 	defer buffer.Put(buf)
 
 	for {
 		conn.SetReadDeadline(time.Now().Add(timeout))
-		n, _, err := conn.ReadFrom(buf[:buffer.TriplePage])
+		n, from, err := conn.ReadFrom(buf[:buffer.TriplePage])
 		if err != nil {
 			break
 		}
-		packedData, err := udppackage.PackUDPData(&destAddr, &srcAddr, buf[:n])
-		if err != nil {
-			continue
+		if fake != nil {
+			if resp, err := fake.GenerateFakeResponse(buf[:n]); err == nil {
+				conn.SetWriteDeadline(time.Now().Add(timeout))
+				if _, err := conn.WriteTo(resp, from); err != nil {
+					break
+				}
+				continue
+			}
+		}
+		pc.SetWriteDeadline(time.Now().Add(timeout))
+		_, err = pc.WriteTo(buf[:n], destAddr)
+		if errors.Is(err, outbound.ErrRemoteResolve) {
+			// A configuration problem, the outbound cannot reach
+			// fake IP domains.
+			logger.Warn("outbound cannot carry the domain", "dst", destAddr, "err", err)
+			break
 		}
-		rawConn.SetWriteDeadline(time.Now().Add(timeout))
-		_, err = rawConn.Write(packedData)
 		if err != nil {
+			logger.Debug("write to outbound failed", "err", err)
 			break
 		}
 	}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type pipeConn struct {
+	net.Conn
+	id stack.TransportEndpointID
+}
+
+func (c *pipeConn) ID() *stack.TransportEndpointID { return &c.id }
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	timeout := 200 * time.Millisecond
+	p := &DefaultProxy{TCPUrl: "direct://", Timeout: timeout}
+	server := l.Addr().(*net.TCPAddr).AddrPort()
+	local, client := net.Pipe()
+	defer client.Close()
+	p.HandleTCP(&pipeConn{Conn: local, id: stack.TransportEndpointID{
+		LocalAddress:  tcpip.AddrFromSlice(server.Addr().AsSlice()),
+		LocalPort:     server.Port(),
+		RemoteAddress: tcpip.AddrFrom4(netip.MustParseAddr("10.0.0.2").As4()),
+		RemotePort:    5000,
+	}})
+
+	// A stream with traffic outlives the timeout.
+	start := time.Now()
+	last := start
+	buf := make([]byte, 4)
+	for time.Since(start) < 3*timeout {
+		client.SetDeadline(time.Now().Add(time.Second))
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal("active stream closed after", time.Since(start), err)
+		}
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+			t.Fatal("active stream closed after", time.Since(start), err)
+		}
+		last = time.Now()
+		time.Sleep(timeout / 4)
+	}
+
+	// Once idle it is closed.
+	client.SetDeadline(time.Now().Add(5 * timeout))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Fatal("idle stream not closed:", err)
+	}
+	t.Log("idle stream closed after", time.Since(last))
+	if d := time.Since(last); d < timeout {
+		t.Fatal("closed before the timeout", d)
+	}
+}
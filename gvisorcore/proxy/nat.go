@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/outbound"
+	"tun2proxylib/tracker"
+)
+
+// NATMode selects how the UDP flows of a source share outbound
+// sessions, and whose replies reach it, after RFC 4787.
+type NATMode string
+
+const (
+	// NATSymmetric gives every flow a session of its own, the replies
+	// of the session all reach the flow. It is the default.
+	NATSymmetric NATMode = "symmetric"
+
+	// NATRestricted relays the flows of a source through a single
+	// session, endpoint-independent mapping, and delivers the replies
+	// of the remotes the source sent to, each from its own address.
+	NATRestricted NATMode = "restricted"
+
+	// NATFullCone maps as NATRestricted does and delivers the replies
+	// of any remote, opening a flow back to the source for those it did
+	// not send to. The stack must support gvisorcore.ReverseUDPConn,
+	// other replies are dropped.
+	NATFullCone NATMode = "full_cone"
+)
+
+// ParseNATMode returns the mode named s, "" is NATSymmetric.
+func ParseNATMode(s string) (NATMode, error) {
+	switch m := NATMode(s); m {
+	case "":
+		return NATSymmetric, nil
+	case NATSymmetric, NATRestricted, NATFullCone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown nat mode %q, want symmetric, restricted or full_cone", s)
+	}
+}
+
+// natTable holds the sessions of the sources, it also guards the flows
+// of each session.
+type natTable struct {
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*natSession
+}
+
+// natSession is the outbound session of a source, shared by its flows.
+type natSession struct {
+	p    *DefaultProxy
+	src  netip.AddrPort
+	pc   net.PacketConn
+	name string
+
+	// flows are keyed by remote address.
+	flows map[netip.AddrPort]*natFlow
+}
+
+type natFlow struct {
+	conn   gvisorcore.UDPConn
+	remote netip.AddrPort
+	// last is the time of the last datagram, either way.
+	last atomic.Int64
+}
+
+func (f *natFlow) touch() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+func (f *natFlow) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, f.last.Load())) >= timeout
+}
+
+// handleNAT relays conn through the session of its source, see
+// NATRestricted.
+func (p *DefaultProxy) handleNAT(conn gvisorcore.UDPConn, ob outbound.Outbound, name string, logger *slog.Logger, src, dst netip.AddrPort, fake dns.FakeDns) {
+	f := &natFlow{conn: conn, remote: dst}
+	f.touch()
+	s, err := p.natAdd(ob, name, src, f)
+	if err != nil {
+		p.stats.udpDialFailure.Add(1)
+		logger.Debug("dial outbound failed", "err", err)
+		conn.Close()
+		return
+	}
+	tracker.SetOutbound(conn, name)
+	logger.Debug("relay udp flow", "nat", p.NAT)
+	go s.serve(f, fake)
+}
+
+// natAdd adds f to the session of src, which is created if need be.
+func (p *DefaultProxy) natAdd(ob outbound.Outbound, name string, src netip.AddrPort, f *natFlow) (*natSession, error) {
+	t := &p.nat
+	t.mu.Lock()
+	s := t.sessions[src]
+	if s == nil {
+		t.mu.Unlock()
+		pc, err := ob.ListenUDP(context.Background(), net.UDPAddrFromAddrPort(src))
+		if err != nil {
+			return nil, err
+		}
+		p.stats.udpDialSuccess.Add(1)
+		t.mu.Lock()
+		if s = t.sessions[src]; s != nil {
+			// Another flow of src got there first.
+			pc.Close()
+		} else {
+			s = &natSession{p: p, src: src, pc: pc, name: name, flows: make(map[netip.AddrPort]*natFlow)}
+			if t.sessions == nil {
+				t.sessions = make(map[netip.AddrPort]*natSession)
+			}
+			t.sessions[src] = s
+			go s.relay()
+		}
+	}
+	s.flows[f.remote] = f
+	t.mu.Unlock()
+	return s, nil
+}
+
+// remove closes f, and the session with its last flow.
+func (s *natSession) remove(f *natFlow) {
+	t := &s.p.nat
+	t.mu.Lock()
+	if s.flows[f.remote] == f {
+		delete(s.flows, f.remote)
+	}
+	last := len(s.flows) == 0 && t.sessions[s.src] == s
+	if last {
+		delete(t.sessions, s.src)
+	}
+	t.mu.Unlock()
+	f.conn.Close()
+	if last {
+		s.pc.Close()
+	}
+}
+
+// serve relays the datagrams the source sends to the remote of f, until
+// f is idle both ways for the timeout of the proxy. Queries fake can
+// answer are answered locally instead.
+func (s *natSession) serve(f *natFlow, fake dns.FakeDns) {
+	defer s.remove(f)
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+
+	timeout := s.p.timeout()
+	to := net.UDPAddrFromAddrPort(f.remote)
+	for {
+		f.conn.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := f.conn.ReadFrom(buf[:buffer.TriplePage])
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && !f.idle(timeout) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		f.touch()
+		if fake != nil {
+			if resp, err := fake.GenerateFakeResponse(buf[:n]); err == nil {
+				f.conn.SetWriteDeadline(time.Now().Add(timeout))
+				if _, err := f.conn.WriteTo(resp, from); err != nil {
+					return
+				}
+				continue
+			}
+		}
+		s.pc.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := s.pc.WriteTo(buf[:n], to); err != nil {
+			return
+		}
+	}
+}
+
+// relay delivers the replies of the session to the flows of their
+// remote, until the session is closed.
+func (s *natSession) relay() {
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+
+	timeout := s.p.timeout()
+	for {
+		s.pc.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := s.pc.ReadFrom(buf[:buffer.TriplePage])
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			// The flows time out on their own.
+			continue
+		}
+		if err != nil {
+			s.pc.Close()
+			s.closeFlows()
+			return
+		}
+		ua, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		remote := unmapped(ua)
+		f := s.flow(remote)
+		if f == nil {
+			continue
+		}
+		f.touch()
+		f.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := f.conn.Write(buf[:n]); err != nil {
+			s.p.logger().Debug("write udp reply failed", "src", s.src, "remote", remote, "err", err)
+		}
+	}
+}
+
+// flow returns the flow of remote, opened back to the source in
+// NATFullCone mode, nil if the reply is not to be delivered.
+func (s *natSession) flow(remote netip.AddrPort) *natFlow {
+	t := &s.p.nat
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f := s.flows[remote]; f != nil {
+		return f
+	}
+	if s.p.NAT != NATFullCone {
+		return nil
+	}
+	var origin gvisorcore.ReverseUDPConn
+	for _, f := range s.flows {
+		if r, ok := f.conn.(gvisorcore.ReverseUDPConn); ok {
+			origin = r
+			break
+		}
+	}
+	if origin == nil {
+		return nil
+	}
+	conn, err := origin.Reverse(remote)
+	if err != nil {
+		s.p.logger().Debug("open reverse udp flow failed", "src", s.src, "remote", remote, "err", err)
+		return nil
+	}
+	f := &natFlow{conn: conn, remote: remote}
+	f.touch()
+	s.flows[remote] = f
+	tracker.SetOutbound(conn, s.name)
+	s.p.flowLogger(conn, "udp", s.name).Debug("relay reverse udp flow")
+	go s.serve(f, nil)
+	return f
+}
+
+// closeFlows closes the flows of a failed session, their serve loops
+// remove them. The next flow of the source gets a new session.
+func (s *natSession) closeFlows() {
+	t := &s.p.nat
+	t.mu.Lock()
+	if t.sessions[s.src] == s {
+		delete(t.sessions, s.src)
+	}
+	flows := make([]*natFlow, 0, len(s.flows))
+	for _, f := range s.flows {
+		flows = append(flows, f)
+	}
+	t.mu.Unlock()
+	for _, f := range flows {
+		f.conn.Close()
+	}
+}
+
+func unmapped(a *net.UDPAddr) netip.AddrPort {
+	ap := a.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/lwipcore/common/dns/fakedns"
+	"tun2proxylib/udprelay"
+
+	mdns "github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// fakeConn is a UDP flow of a client, fed by in, its replies go to out.
+type fakeConn struct {
+	id       stack.TransportEndpointID
+	in       chan []byte
+	out      chan []byte
+	reversed chan *fakeConn
+
+	mu       sync.Mutex
+	deadline time.Time
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func newFakeConn(client, remote netip.AddrPort, reversed chan *fakeConn) *fakeConn {
+	return &fakeConn{
+		id: stack.TransportEndpointID{
+			LocalAddress:  tcpip.AddrFromSlice(remote.Addr().AsSlice()),
+			LocalPort:     remote.Port(),
+			RemoteAddress: tcpip.AddrFromSlice(client.Addr().AsSlice()),
+			RemotePort:    client.Port(),
+		},
+		in:       make(chan []byte, 4),
+		out:      make(chan []byte, 4),
+		reversed: reversed,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) ID() *stack.TransportEndpointID { return &c.id }
+
+func (c *fakeConn) Reverse(remote netip.AddrPort) (gvisorcore.UDPConn, error) {
+	client := netip.AddrPortFrom(netip.AddrFrom4(c.id.RemoteAddress.As4()), c.id.RemotePort)
+	rc := newFakeConn(client, remote, c.reversed)
+	c.reversed <- rc
+	return rc, nil
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	d := time.Until(c.deadline)
+	c.mu.Unlock()
+	select {
+	case p := <-c.in:
+		return copy(b, p), c.RemoteAddr(), nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-time.After(d):
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *fakeConn) WriteTo(b []byte, _ net.Addr) (int, error) { return c.Write(b) }
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: c.id.LocalAddress.AsSlice(), Port: int(c.id.LocalPort)}
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: c.id.RemoteAddress.AsSlice(), Port: int(c.id.RemotePort)}
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func listen(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return pc
+}
+
+func receive(t *testing.T, ch chan []byte) string {
+	select {
+	case b := <-ch:
+		return string(b)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply")
+		return ""
+	}
+}
+
+func TestFullCone(t *testing.T) {
+	p := &DefaultProxy{UDPUrl: "direct://", NAT: NATFullCone, Timeout: 5 * time.Second}
+	client := netip.MustParseAddrPort("10.0.0.2:5000")
+	reversed := make(chan *fakeConn, 1)
+
+	// Two flows of the client leave from the same mapped address.
+	a, b := listen(t), listen(t)
+	var mapped [2]net.Addr
+	for i, remote := range []net.PacketConn{a, b} {
+		conn := newFakeConn(client, remote.LocalAddr().(*net.UDPAddr).AddrPort(), reversed)
+		defer conn.Close()
+		p.HandleUDP(conn)
+		conn.in <- []byte("ping")
+		buf := make([]byte, 64)
+		n, from, err := remote.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatal("unexpected datagram", string(buf[:n]), err)
+		}
+		mapped[i] = from
+		remote.WriteTo([]byte("pong"), from)
+		if got := receive(t, conn.out); got != "pong" {
+			t.Fatal("unexpected reply", got)
+		}
+	}
+	t.Log("mapped to", mapped[0], mapped[1])
+	if mapped[0].String() != mapped[1].String() || p.Stats().UDPDialSuccess != 1 {
+		t.Fatal("flows of a source got different sessions", mapped, p.Stats())
+	}
+
+	// A remote the client never sent to gets through on a reverse flow.
+	c := listen(t)
+	c.WriteTo([]byte("hello"), mapped[0])
+	var rc *fakeConn
+	select {
+	case rc = <-reversed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reverse flow")
+	}
+	defer rc.Close()
+	if got := receive(t, rc.out); got != "hello" || rc.LocalAddr().String() != c.LocalAddr().String() {
+		t.Fatal("unexpected reverse flow", got, rc.LocalAddr())
+	}
+	rc.in <- []byte("answer")
+	buf := make([]byte, 64)
+	if n, _, err := c.ReadFrom(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatal("unexpected answer", string(buf[:n]), err)
+	}
+}
+
+// fakeIP returns the fake IP f hands out for name.
+func fakeIP(t *testing.T, f *fakedns.FakeDNS, name string) net.IP {
+	req := new(mdns.Msg)
+	req.SetQuestion(mdns.Fqdn(name), mdns.TypeA)
+	b, _ := req.Pack()
+	out, err := f.GenerateFakeResponse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(mdns.Msg)
+	if err := resp.Unpack(out); err != nil || len(resp.Answer) != 1 {
+		t.Fatal("unexpected answer", resp, err)
+	}
+	return resp.Answer[0].(*mdns.A).A
+}
+
+func TestFakeIPUDP(t *testing.T) {
+	echo := listen(t)
+	echo.SetReadDeadline(time.Time{})
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	relay := listen(t)
+	relay.SetReadDeadline(time.Time{})
+	go (&udprelay.Server{}).ServeUDP(relay)
+
+	f, _ := fakedns.New()
+	ip := fakeIP(t, f, "localhost")
+	remote := netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip.To4())), uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+
+	// The relay resolves the domain of the fake IP.
+	p := &DefaultProxy{UDPUrl: "relay://" + relay.LocalAddr().String() + "?version=2", FakeDNS: f, Timeout: 5 * time.Second}
+	conn := newFakeConn(netip.MustParseAddrPort("10.0.0.2:5000"), remote, nil)
+	defer conn.Close()
+	p.HandleUDP(conn)
+	conn.in <- []byte("ping")
+	if got := receive(t, conn.out); got != "ping" {
+		t.Fatal("unexpected reply", got)
+	}
+}
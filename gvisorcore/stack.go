@@ -4,6 +4,8 @@
 package gvisorcore
 
 import (
+	"log/slog"
+
 	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
@@ -19,11 +21,25 @@ type StackOptions struct {
 
 	// LinkEndpoint is the link endpoint to be attached to the stack NIC.
 	LinkEndpoint stack.LinkEndpoint
+
+	// Logger receives the diagnostics of the stack. Defaults to slog.Default.
+	Logger *slog.Logger
+
+	// Options tune the stack, they are applied after WithDefault.
+	Options []Option
+
+	// ICMP says how echo requests are answered.
+	ICMP ICMPOptions
 }
 
 func CreateStack(cfg StackOptions) (*stack.Stack, error) {
 
-	opts := []Option{WithDefault()}
+	opts := append([]Option{WithDefault()}, cfg.Options...)
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
 
 	s := stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
@@ -46,11 +62,12 @@ func CreateStack(cfg StackOptions) (*stack.Stack, error) {
 		// before creating NIC, otherwise NIC would dispatch packets
 		// to stack and cause race condition.
 		// Initiate transport protocol (TCP/UDP) with given handler.
-		withTCPHandler(cfg.TransportHandler.HandleTCP),
-		withUDPHandler(cfg.TransportHandler.HandleUDP),
+		withTCPHandler(cfg.TransportHandler.HandleTCP, logger),
+		withUDPHandler(cfg.TransportHandler.HandleUDP, logger),
 
-		// Create stack NIC and then bind link endpoint to it.
-		withCreatingNIC(nicID, cfg.LinkEndpoint),
+		// Create stack NIC and then bind link endpoint to it. Echo
+		// requests are answered before they reach the stack.
+		withCreatingNIC(nicID, newICMPEndpoint(cfg.LinkEndpoint, cfg.ICMP, logger)),
 
 		// In the past we did s.AddAddressRange to assign 0.0.0.0/0
 		// onto the interface. We need that to be able to terminate
@@ -75,8 +92,8 @@ func CreateStack(cfg StackOptions) (*stack.Stack, error) {
 		// Ref: https://github.com/google/gvisor/commit/8c0701462a84ff77e602f1626aec49479c308127
 		withSpoofing(nicID, nicSpoofingEnabled),
 
-		// Add default route table for IPv4 and IPv6. This will handle
-		// all incoming ICMP packets.
+		// Add default route table for IPv4 and IPv6, the stack needs
+		// it to answer the ICMP packets other than echo requests.
 		withRouteTable(nicID),
 
 		// Add default NIC to the given multicast groups.
@@ -85,6 +102,7 @@ func CreateStack(cfg StackOptions) (*stack.Stack, error) {
 
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
+			s.Destroy()
 			return nil, err
 		}
 	}
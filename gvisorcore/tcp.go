@@ -1,7 +1,7 @@
 package gvisorcore
 
 import (
-	"log"
+	"log/slog"
 	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -38,7 +38,7 @@ const (
 	tcpKeepaliveInterval = 30 * time.Second
 )
 
-func withTCPHandler(handle func(TCPConn)) Option {
+func withTCPHandler(handle func(TCPConn), logger *slog.Logger) Option {
 	return func(s *stack.Stack) error {
 		tcpForwarder := tcp.NewForwarder(s, defaultWndSize, maxConnAttempts, func(r *tcp.ForwarderRequest) {
 			var (
@@ -50,8 +50,10 @@ func withTCPHandler(handle func(TCPConn)) Option {
 
 			defer func() {
 				if err != nil {
-					log.Printf("forward tcp request: %s:%d->%s:%d: %s",
-						id.RemoteAddress, id.RemotePort, id.LocalAddress, id.LocalPort, err)
+					logger.Debug("forward tcp request failed",
+						"src", endpointAddr(id.RemoteAddress, id.RemotePort),
+						"dst", endpointAddr(id.LocalAddress, id.LocalPort),
+						"err", err)
 				}
 			}()
 
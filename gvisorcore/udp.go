@@ -1,14 +1,20 @@
 package gvisorcore
 
 import (
-	glog "gvisor.dev/gvisor/pkg/log"
+	"errors"
+	"log/slog"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
-func withUDPHandler(handle func(UDPConn)) Option {
+func withUDPHandler(handle func(UDPConn), logger *slog.Logger) Option {
 	return func(s *stack.Stack) error {
 		udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) bool {
 			var (
@@ -17,14 +23,17 @@ func withUDPHandler(handle func(UDPConn)) Option {
 			)
 			ep, err := r.CreateEndpoint(&wq)
 			if err != nil {
-				glog.Debugf("forward udp request: %s:%d->%s:%d: %s",
-					id.RemoteAddress, id.RemotePort, id.LocalAddress, id.LocalPort, err)
+				logger.Debug("forward udp request failed",
+					"src", endpointAddr(id.RemoteAddress, id.RemotePort),
+					"dst", endpointAddr(id.LocalAddress, id.LocalPort),
+					"err", err)
 				return false
 			}
 
 			conn := &udpConn{
 				UDPConn: gonet.NewUDPConn(&wq, ep),
 				id:      id,
+				s:       s,
 			}
 			handle(conn)
 			return true
@@ -37,8 +46,49 @@ func withUDPHandler(handle func(UDPConn)) Option {
 type udpConn struct {
 	*gonet.UDPConn
 	id stack.TransportEndpointID
+	s  *stack.Stack
 }
 
 func (c *udpConn) ID() *stack.TransportEndpointID {
 	return &c.id
 }
+
+// Reverse binds an endpoint to remote, which spoofing allows, and
+// connects it to the client. The datagrams the client sends to remote
+// then reach it rather than the forwarder.
+func (c *udpConn) Reverse(remote netip.AddrPort) (UDPConn, error) {
+	proto := ipv4.ProtocolNumber
+	if c.id.RemoteAddress.Len() == 16 {
+		proto = ipv6.ProtocolNumber
+	}
+	if remote.Addr().Unmap().Is4() != (proto == ipv4.ProtocolNumber) {
+		return nil, errors.New("remote and client address families differ")
+	}
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, proto, &wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+	// Several clients may get datagrams from the same remote.
+	ep.SocketOptions().SetReuseAddress(true)
+	ep.SocketOptions().SetReusePort(true)
+	local := tcpip.FullAddress{Addr: tcpip.AddrFromSlice(remote.Addr().Unmap().AsSlice()), Port: remote.Port()}
+	if err := ep.Bind(local); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: c.id.RemoteAddress, Port: c.id.RemotePort}); err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+	return &udpConn{
+		UDPConn: gonet.NewUDPConn(&wq, ep),
+		id: stack.TransportEndpointID{
+			LocalAddress:  local.Addr,
+			LocalPort:     local.Port,
+			RemoteAddress: c.id.RemoteAddress,
+			RemotePort:    c.id.RemotePort,
+		},
+		s: c.s,
+	}, nil
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package gvisorcore
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+func TestReverse(t *testing.T) {
+	ch := channel.New(4, 1500, "")
+	h := make(udpHandler, 4)
+	s, err := CreateStack(StackOptions{TransportHandler: h, LinkEndpoint: ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+
+	client := netip.MustParseAddrPort("10.0.0.2:5000")
+	server := netip.MustParseAddrPort("1.1.1.1:3478")
+	peer := netip.MustParseAddrPort("8.8.8.8:40000")
+	inject(ch, datagram(client, server, []byte("binding")))
+	var conn UDPConn
+	select {
+	case conn = <-h:
+	case <-time.After(time.Second):
+		t.Fatal("no flow")
+	}
+	defer conn.Close()
+
+	rc, err := conn.(ReverseUDPConn).Reverse(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := rc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := ch.Read()
+	if pkt == nil {
+		t.Fatal("no datagram from", peer)
+	}
+	ip := header.IPv4(pkt.ToView().AsSlice())
+	u := header.UDP(ip.Payload())
+	t.Log(ip.SourceAddress(), u.SourcePort(), "->", ip.DestinationAddress(), u.DestinationPort())
+	if ip.SourceAddress().String() != "8.8.8.8" || u.SourcePort() != peer.Port() ||
+		ip.DestinationAddress().String() != "10.0.0.2" || u.DestinationPort() != client.Port() ||
+		string(u.Payload()) != "hello" {
+		pkt.DecRef()
+		t.Fatal("unexpected datagram")
+	}
+	pkt.DecRef()
+
+	// The answer of the client reaches the reverse flow.
+	inject(ch, datagram(client, peer, []byte("answer")))
+	rc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := rc.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+	select {
+	case c := <-h:
+		c.Close()
+		t.Fatal("answer forwarded as a new flow")
+	default:
+	}
+}
@@ -0,0 +1,371 @@
+// Package health checks the outbounds of the tunnel in the background
+// and records their status, latency and packet loss.
+package health
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"tun2proxylib/mobile"
+	"tun2proxylib/outbound"
+)
+
+const (
+	// DefaultInterval is the time between two checks of a target.
+	DefaultInterval = 30 * time.Second
+
+	// DefaultTimeout bounds each step of a check.
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultEchoCount is the number of datagrams of a UDP echo check.
+	DefaultEchoCount = 3
+)
+
+// Target is an outbound to check. TCP and UDP tell which flows it
+// carries: the connection and URL checks are run for TCP, the UDP echo
+// for UDP.
+type Target struct {
+	Name     string
+	Spec     *outbound.Spec
+	Outbound outbound.Outbound
+	TCP, UDP bool
+
+	// Members get the result of every check, see
+	// outbound.Member.Report.
+	Members []*outbound.Member
+}
+
+// Status is the result of the last check of a target. Each step the
+// target supports is run: a connection and handshake with its server,
+// a request of Prober.URL through it and a UDP echo through it to
+// Prober.UDPEcho. The target is up if they all succeed.
+type Status struct {
+	Name    string
+	Up      bool
+	Error   string
+	Checked time.Time
+
+	// Latency is the time taken by the connection and handshake, or by
+	// the UDP echo for the targets with no TCP side.
+	Latency time.Duration
+
+	// HTTPLatency is the time to the response headers of Prober.URL.
+	HTTPLatency time.Duration
+
+	// UDPLatency is the mean round trip of the UDP echoes and Loss the
+	// fraction of them left unanswered.
+	UDPLatency time.Duration
+	Loss       float64
+}
+
+// Prober checks its targets every Interval. Start it once the targets
+// are set.
+type Prober struct {
+	Targets []Target
+
+	// Interval defaults to DefaultInterval and Timeout to
+	// DefaultTimeout.
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// URL, if set, is fetched through the targets that carry TCP.
+	URL string
+
+	// UDPEcho, if set, is the host:port of a UDP echo server reached
+	// through the targets that carry UDP, EchoCount datagrams each time.
+	UDPEcho   string
+	EchoCount int
+
+	// Protect keeps the check connections out of the tunnel.
+	Protect mobile.ProtectSocket
+
+	// Logger receives the status changes. Defaults to slog.Default.
+	Logger *slog.Logger
+
+	mu     sync.Mutex
+	status map[string]Status
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start checks the targets at once and then every Interval, until Stop.
+func (p *Prober) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go p.run(ctx, p.done)
+}
+
+// Stop stops the checks and waits for the running ones.
+func (p *Prober) Stop() {
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.cancel = nil
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (p *Prober) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every target at once and returns their status.
+func (p *Prober) CheckAll(ctx context.Context) []Status {
+	var wg sync.WaitGroup
+	for _, t := range p.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := p.Check(ctx, t)
+			if ctx.Err() == nil {
+				p.record(t, st)
+			}
+		}()
+	}
+	wg.Wait()
+	return p.Status()
+}
+
+// Status returns the last status of every checked target, in order.
+func (p *Prober) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var sts []Status
+	for _, t := range p.Targets {
+		if st, ok := p.status[t.Name]; ok {
+			sts = append(sts, st)
+		}
+	}
+	return sts
+}
+
+// Lookup returns the last status of the target called name.
+func (p *Prober) Lookup(name string) (Status, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.status[name]
+	return st, ok
+}
+
+func (p *Prober) record(t Target, st Status) {
+	p.mu.Lock()
+	prev, seen := p.status[t.Name]
+	if p.status == nil {
+		p.status = make(map[string]Status)
+	}
+	p.status[t.Name] = st
+	p.mu.Unlock()
+
+	var err error
+	if !st.Up {
+		err = errors.New(st.Error)
+	}
+	for _, m := range t.Members {
+		m.Report(st.Latency, err)
+	}
+	if !seen || prev.Up != st.Up {
+		if st.Up {
+			p.logger().Info("outbound healthy", "outbound", t.Name, "latency", st.Latency)
+		} else {
+			p.logger().Warn("outbound unhealthy", "outbound", t.Name, "err", st.Error)
+		}
+	}
+}
+
+// Check runs the checks of t once.
+func (p *Prober) Check(ctx context.Context, t Target) Status {
+	st := Status{Name: t.Name, Checked: time.Now()}
+	var errs []error
+	ran := false
+
+	if t.TCP && t.Spec != nil {
+		start := time.Now()
+		err := p.step(ctx, func(ctx context.Context) error {
+			return outbound.Check(ctx, t.Spec, p.Protect)
+		})
+		if !errors.Is(err, outbound.ErrUnsupported) {
+			ran = true
+			st.Latency = time.Since(start)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("connect: %w", err))
+			}
+		}
+	}
+
+	if t.TCP && p.URL != "" && len(errs) == 0 {
+		start := time.Now()
+		err := p.step(ctx, func(ctx context.Context) error {
+			return p.fetch(ctx, t.Outbound)
+		})
+		if !errors.Is(err, outbound.ErrUnsupported) {
+			ran = true
+			st.HTTPLatency = time.Since(start)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("http: %w", err))
+			}
+		}
+	}
+
+	if t.UDP && p.UDPEcho != "" {
+		rtt, loss, err := p.echo(ctx, t.Outbound)
+		if !errors.Is(err, outbound.ErrUnsupported) {
+			ran = true
+			st.UDPLatency, st.Loss = rtt, loss
+			if err != nil {
+				errs = append(errs, fmt.Errorf("udp: %w", err))
+			}
+			if st.Latency == 0 {
+				st.Latency = rtt
+			}
+		}
+	}
+
+	if !ran {
+		errs = append(errs, errors.New("nothing to check"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		st.Error = err.Error()
+		st.Latency = 0
+	} else {
+		st.Up = true
+	}
+	return st
+}
+
+// step runs fn with the timeout of a check step.
+func (p *Prober) step(ctx context.Context, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+	return fn(ctx)
+}
+
+// fetch gets URL through ob, any answer of the server will do.
+func (p *Prober) fetch(ctx context.Context, ob outbound.Outbound) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ob.DialTCP(outbound.WithRemoteResolve(ctx), addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	return nil
+}
+
+// echo sends EchoCount datagrams to UDPEcho through ob and waits for
+// them to come back, it returns their mean round trip and the fraction
+// lost. An error is returned when none came back.
+func (p *Prober) echo(ctx context.Context, ob outbound.Outbound) (time.Duration, float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+	pc, err := ob.ListenUDP(ctx, &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	count := p.EchoCount
+	if count <= 0 {
+		count = DefaultEchoCount
+	}
+	// Each datagram is a random nonce and its index, so late answers
+	// to an earlier check are told apart.
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	sent := make([]time.Time, count)
+	msg := make([]byte, 12)
+	copy(msg, nonce[:])
+	for i := range count {
+		binary.BigEndian.PutUint32(msg[8:], uint32(i))
+		sent[i] = time.Now()
+		if _, err := pc.WriteTo(msg, outbound.HostAddr(p.UDPEcho)); err != nil {
+			return 0, 1, err
+		}
+	}
+
+	var total time.Duration
+	got := make([]bool, count)
+	received := 0
+	buf := make([]byte, 64)
+	for received < count {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n != 12 || string(buf[:8]) != string(nonce[:]) {
+			continue
+		}
+		i := binary.BigEndian.Uint32(buf[8:])
+		if int(i) >= count || got[i] {
+			continue
+		}
+		got[i] = true
+		received++
+		total += time.Since(sent[i])
+	}
+	loss := float64(count-received) / float64(count)
+	if received == 0 {
+		return 0, loss, errors.New("no echo came back")
+	}
+	return total / time.Duration(received), loss, nil
+}
+
+func (p *Prober) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (p *Prober) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,132 @@
+package health
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tun2proxylib/outbound"
+)
+
+// socks5Server accepts the no authentication method and then hangs up.
+func socks5Server(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 3)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				conn.Write([]byte{5, 0})
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func target(t *testing.T, raw string, tcp bool) Target {
+	spec, err := outbound.Parse(raw, outbound.SOCKS5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob, err := outbound.New(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Target{Name: spec.String(), Spec: spec, Outbound: ob, TCP: tcp, UDP: !tcp,
+		Members: []*outbound.Member{outbound.NewMember(spec.String(), ob)}}
+}
+
+func TestProber(t *testing.T) {
+	// A port nobody listens on.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := ln.Addr().String()
+	ln.Close()
+
+	p := &Prober{
+		Targets: []Target{
+			target(t, socks5Server(t), true),
+			target(t, dead, true),
+			target(t, "direct://", false),
+		},
+		UDPEcho: echoServer(t),
+	}
+	sts := p.CheckAll(context.Background())
+	if len(sts) != 3 {
+		t.Fatal("unexpected status", sts)
+	}
+	if st := sts[0]; !st.Up || st.Error != "" || st.Latency <= 0 || st.Checked.IsZero() {
+		t.Fatal("unexpected socks status", st)
+	}
+	if st := sts[1]; st.Up || st.Error == "" || st.Latency != 0 {
+		t.Fatal("unexpected dead status", st)
+	}
+	if st := sts[2]; !st.Up || st.Latency <= 0 || st.UDPLatency <= 0 || st.Loss != 0 {
+		t.Fatal("unexpected udp status", st)
+	}
+	if st, ok := p.Lookup(p.Targets[1].Name); !ok || st.Error == "" {
+		t.Fatal("unexpected lookup", st)
+	}
+
+	// The members got the results.
+	f := &outbound.Failover{Name: "main", Members: []*outbound.Member{p.Targets[1].Members[0], p.Targets[0].Members[0]}}
+	st := f.Status()
+	if st[0].Up || st[0].Latency != 0 || !st[1].Up || st[1].Latency == 0 {
+		t.Fatal("unexpected members", st)
+	}
+}
+
+func TestProberStartStop(t *testing.T) {
+	p := &Prober{Targets: []Target{target(t, socks5Server(t), true)}, Interval: 10 * time.Millisecond}
+	p.Start()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if st, ok := p.Lookup(p.Targets[0].Name); ok && st.Up {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no check after Start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	p.Stop()
+
+	sts := p.Status()
+	if len(sts) != 1 || !sts[0].Up || sts[0].Latency <= 0 || sts[0].Loss != 0 || sts[0].Error != "" {
+		t.Fatal("unexpected status after Stop", sts)
+	}
+	// No check runs once stopped.
+	time.Sleep(5 * p.Interval)
+	if st, _ := p.Lookup(p.Targets[0].Name); !st.Checked.Equal(sts[0].Checked) {
+		t.Fatal("checked after Stop")
+	}
+}
@@ -0,0 +1,178 @@
+// Package hijack answers the DNS flows of the tunnel locally instead of
+// relaying them.
+package hijack
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/gvisorcore/help"
+	"tun2proxylib/resolver"
+	"tun2proxylib/tracker"
+
+	mdns "github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Outbound is the name hijacked flows are tracked with.
+const Outbound = "dns"
+
+// DefaultTimeout closes a hijacked flow after this long without a
+// query.
+const DefaultTimeout = 30 * time.Second
+
+// Handler is a TransportHandler answering the port 53 flows to Addrs
+// with Resolver, other flows are handed to Next.
+type Handler struct {
+	Next     gvisorcore.TransportHandler
+	Resolver resolver.Resolver
+
+	// Addrs are the hijacked DNS servers. When empty every flow to
+	// port 53 is hijacked.
+	Addrs []netip.AddrPort
+
+	// Timeout defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Logger defaults to slog.Default.
+	Logger *slog.Logger
+}
+
+func New(next gvisorcore.TransportHandler, r resolver.Resolver, addrs ...netip.AddrPort) *Handler {
+	return &Handler{Next: next, Resolver: r, Addrs: addrs}
+}
+
+func (h *Handler) match(id *stack.TransportEndpointID) bool {
+	if id.LocalPort != 53 {
+		return false
+	}
+	if len(h.Addrs) == 0 {
+		return true
+	}
+	dst := netip.AddrPortFrom(help.ParseTCPIPAddress(id.LocalAddress), id.LocalPort)
+	for _, addr := range h.Addrs {
+		if addr == dst {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) HandleTCP(conn gvisorcore.TCPConn) {
+	if !h.match(conn.ID()) {
+		h.Next.HandleTCP(conn)
+		return
+	}
+	tracker.SetOutbound(conn, Outbound)
+	go h.serveTCP(conn)
+}
+
+func (h *Handler) HandleUDP(conn gvisorcore.UDPConn) {
+	if !h.match(conn.ID()) {
+		h.Next.HandleUDP(conn)
+		return
+	}
+	tracker.SetOutbound(conn, Outbound)
+	go h.serveUDP(conn)
+}
+
+// serveTCP answers the length prefixed queries of conn in order.
+func (h *Handler) serveTCP(conn gvisorcore.TCPConn) {
+	defer conn.Close()
+	var size [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(h.timeout()))
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := h.answer(query, false)
+		if resp == nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(h.timeout()))
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// serveUDP answers every datagram of conn, queries are resolved
+// concurrently so a slow one does not hold the others back.
+func (h *Handler) serveUDP(conn gvisorcore.UDPConn) {
+	defer conn.Close()
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+	for {
+		conn.SetReadDeadline(time.Now().Add(h.timeout()))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := h.answer(query, true); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+// answer resolves a packed query, it returns nil for the messages that
+// are not worth a reply. Replies over UDP are truncated to the size the
+// query advertises with EDNS0, 512 bytes without it.
+func (h *Handler) answer(query []byte, udp bool) []byte {
+	m := new(mdns.Msg)
+	if err := m.Unpack(query); err != nil || m.Response {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultTimeout)
+	defer cancel()
+	resp, err := h.Resolver.Exchange(ctx, m)
+	if err != nil {
+		h.logger().Debug("resolve failed", "question", m.Question, "err", err)
+		resp = resolver.ServerFailure(m)
+	}
+	if udp {
+		resp.Truncate(udpSize(m))
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// udpSize returns the largest UDP reply the sender of m accepts.
+func udpSize(m *mdns.Msg) int {
+	if opt := m.IsEdns0(); opt != nil && int(opt.UDPSize()) > mdns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return mdns.MinMsgSize
+}
+
+func (h *Handler) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (h *Handler) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,181 @@
+package hijack
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+
+	mdns "github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func endpointID(dst netip.AddrPort) stack.TransportEndpointID {
+	return stack.TransportEndpointID{
+		LocalAddress:  tcpip.AddrFromSlice(dst.Addr().AsSlice()),
+		LocalPort:     dst.Port(),
+		RemoteAddress: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}),
+		RemotePort:    5000,
+	}
+}
+
+type tcpConn struct {
+	net.Conn
+	id stack.TransportEndpointID
+}
+
+func (c *tcpConn) ID() *stack.TransportEndpointID { return &c.id }
+
+// udpConn is a UDP flow fed by in, its replies go to out.
+type udpConn struct {
+	net.Conn
+	id  stack.TransportEndpointID
+	in  chan []byte
+	out chan []byte
+}
+
+func newUDPConn(dst netip.AddrPort) *udpConn {
+	local, _ := net.Pipe()
+	return &udpConn{Conn: local, id: endpointID(dst), in: make(chan []byte, 1), out: make(chan []byte, 1)}
+}
+
+func (c *udpConn) ID() *stack.TransportEndpointID { return &c.id }
+
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p), nil, nil
+	case <-time.After(time.Second):
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// next records the flows handed over by the hijack handler.
+type next struct {
+	tcp chan gvisorcore.TCPConn
+	udp chan gvisorcore.UDPConn
+}
+
+func (n *next) HandleTCP(conn gvisorcore.TCPConn) { n.tcp <- conn }
+func (n *next) HandleUDP(conn gvisorcore.UDPConn) { n.udp <- conn }
+
+// records answers every query with count A records.
+type records int
+
+func (r records) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	resp := new(mdns.Msg)
+	resp.SetReply(m)
+	for i := range int(r) {
+		resp.Answer = append(resp.Answer, &mdns.A{
+			Hdr: mdns.RR_Header{Name: m.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 1, byte(i>>8), byte(i)),
+		})
+	}
+	return resp, nil
+}
+
+func query(edns uint16) []byte {
+	m := new(mdns.Msg)
+	m.SetQuestion("example.com.", mdns.TypeA)
+	if edns > 0 {
+		m.SetEdns0(edns, false)
+	}
+	b, _ := m.Pack()
+	return b
+}
+
+func TestHijackUDP(t *testing.T) {
+	h := New(&next{}, records(100))
+	for _, c := range []struct {
+		edns      uint16
+		size      int
+		truncated bool
+	}{
+		{0, mdns.MinMsgSize, true},
+		{1232, 1232, true},
+		{4096, 4096, false},
+	} {
+		conn := newUDPConn(netip.MustParseAddrPort("8.8.8.8:53"))
+		h.HandleUDP(conn)
+		conn.in <- query(c.edns)
+		var b []byte
+		select {
+		case b = <-conn.out:
+		case <-time.After(2 * time.Second):
+			t.Fatal("no answer")
+		}
+		resp := new(mdns.Msg)
+		if err := resp.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		t.Log("edns", c.edns, "answer of", len(b), "bytes,", len(resp.Answer), "records, truncated", resp.Truncated)
+		if len(b) > c.size || resp.Truncated != c.truncated || (!c.truncated && len(resp.Answer) != 100) {
+			t.Fatal("unexpected answer")
+		}
+	}
+}
+
+func TestHijackTCP(t *testing.T) {
+	h := New(&next{}, records(100))
+	local, client := net.Pipe()
+	defer client.Close()
+	h.HandleTCP(&tcpConn{Conn: local, id: endpointID(netip.MustParseAddrPort("8.8.8.8:53"))})
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	q := query(0)
+	if _, err := client.Write(binary.BigEndian.AppendUint16(nil, uint16(len(q)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(client, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	resp := new(mdns.Msg)
+	if err := resp.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("answer of", len(b), "bytes,", len(resp.Answer), "records")
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Fatal("TCP answer truncated")
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	n := &next{tcp: make(chan gvisorcore.TCPConn, 1), udp: make(chan gvisorcore.UDPConn, 1)}
+	h := New(n, records(1), netip.MustParseAddrPort("8.8.8.8:53"))
+	for _, dst := range []string{"8.8.8.8:443", "1.1.1.1:53"} {
+		addr := netip.MustParseAddrPort(dst)
+		local, _ := net.Pipe()
+		h.HandleTCP(&tcpConn{Conn: local, id: endpointID(addr)})
+		select {
+		case <-n.tcp:
+		default:
+			t.Fatal("tcp flow to", dst, "hijacked")
+		}
+		h.HandleUDP(newUDPConn(addr))
+		select {
+		case <-n.udp:
+		default:
+			t.Fatal("udp flow to", dst, "hijacked")
+		}
+	}
+}
@@ -1,86 +1,244 @@
+// Package cache keeps DNS responses for as long as their TTLs allow.
 package cache
 
 import (
-	"log"
+	"container/list"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// DNSCacheEntry ..
-type DNSCacheEntry struct {
-	msg *dns.Msg
-	exp time.Time
+const (
+	// DefaultSize is the default number of responses a cache holds.
+	DefaultSize = 4096
+
+	// maxNegativeTTL caps the TTL of negative responses, RFC 2308
+	// section 5.
+	maxNegativeTTL = 3 * 60 * 60
+)
+
+// Option configures a DNSCache.
+type Option func(*DNSCache)
+
+// WithSize sets the number of responses kept, the least recently used
+// one is evicted past that.
+func WithSize(n int) Option {
+	return func(c *DNSCache) {
+		if n > 0 {
+			c.size = n
+		}
+	}
+}
+
+type key struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func keyOf(q dns.Question) key {
+	return key{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
 }
 
-// DNSCache ..
+type entry struct {
+	key    key
+	msg    *dns.Msg
+	stored time.Time
+	exp    time.Time
+}
+
+// Stats counts the lookups of a DNSCache.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// DNSCache is an LRU bounded cache of DNS responses keyed by question
+// name, type and class. Positive responses live for their smallest
+// answer TTL and negative ones, NXDOMAIN and NODATA, for the TTL of
+// their SOA record. It implements dns.DnsCache.
 type DNSCache struct {
-	servers []string
 	mutex   sync.Mutex
-	storage map[string]*DNSCacheEntry
-}
+	size    int
+	lru     *list.List // of *entry, most recently used first
+	storage map[key]*list.Element
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
 
-func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
+	now func() time.Time
+}
 
-func cacheKey(q dns.Question) string {
-	return string(append([]byte(q.Name), packUint16(q.Qtype)...))
+// NewDNSCache returns a cache of DefaultSize responses unless the
+// options say otherwise.
+func NewDNSCache(opts ...Option) *DNSCache {
+	c := &DNSCache{
+		size:    DefaultSize,
+		lru:     list.New(),
+		storage: make(map[key]*list.Element),
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-// Query ..
-func (c *DNSCache) Query(payload []byte) *dns.Msg {
+// Query returns the packed cached response to the packed request p, or
+// nil.
+func (c *DNSCache) Query(p []byte) []byte {
 	request := new(dns.Msg)
-	e := request.Unpack(payload)
-	if e != nil {
+	if err := request.Unpack(p); err != nil {
 		return nil
 	}
-	if len(request.Question) == 0 {
+	resp := c.Get(request)
+	if resp == nil {
 		return nil
 	}
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	key := cacheKey(request.Question[0])
-	entry := c.storage[key]
-	if entry == nil {
+// Store caches the packed response p.
+func (c *DNSCache) Store(p []byte) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(p); err != nil {
+		return
+	}
+	c.Put(resp)
+}
+
+// Get returns a copy of the cached response to request, with the ID of
+// request and the TTLs lowered by the time spent in the cache.
+func (c *DNSCache) Get(request *dns.Msg) *dns.Msg {
+	if len(request.Question) != 1 {
 		return nil
 	}
-	if time.Now().After(entry.exp) {
-		delete(c.storage, key)
+	k := keyOf(request.Question[0])
+	now := c.now()
+
+	c.mutex.Lock()
+	e, ok := c.storage[k]
+	if ok && now.After(e.Value.(*entry).exp) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.mutex.Unlock()
+		c.misses.Add(1)
 		return nil
 	}
-	entry.msg.Id = request.Id
-	return entry.msg
+	c.lru.MoveToFront(e)
+	ent := e.Value.(*entry)
+	resp := ent.msg.Copy()
+	stored := ent.stored
+	c.mutex.Unlock()
+	c.hits.Add(1)
+
+	resp.Id = request.Id
+	resp.Question = []dns.Question{request.Question[0]}
+	elapsed := uint32(now.Sub(stored) / time.Second)
+	forEachRR(resp, func(rr dns.RR) {
+		h := rr.Header()
+		if h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+	})
+	return resp
 }
 
-// Store ...
-func (c *DNSCache) Store(payload []byte) {
-	resp := new(dns.Msg)
-	e := resp.Unpack(payload)
-	if e != nil {
+// Put caches resp if it is cacheable.
+func (c *DNSCache) Put(resp *dns.Msg) {
+	if !resp.Response || resp.Truncated || len(resp.Question) != 1 {
 		return
 	}
-	if resp.Rcode != dns.RcodeSuccess {
+	ttl, ok := cacheTTL(resp)
+	if !ok || ttl == 0 {
 		return
 	}
-	if len(resp.Question) == 0 || len(resp.Answer) == 0 {
-		return
+	now := c.now()
+	ent := &entry{
+		key:    keyOf(resp.Question[0]),
+		msg:    resp.Copy(),
+		stored: now,
+		exp:    now.Add(time.Duration(ttl) * time.Second),
 	}
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	key := cacheKey(resp.Question[0])
-	log.Printf("cache DNS response for %s", key)
-	c.storage[key] = &DNSCacheEntry{
-		msg: resp,
-		exp: time.Now().Add(time.Duration(resp.Answer[0].Header().Ttl) * time.Second),
+	if e, ok := c.storage[ent.key]; ok {
+		e.Value = ent
+		c.lru.MoveToFront(e)
+		return
 	}
+	c.storage[ent.key] = c.lru.PushFront(ent)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *DNSCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.storage, e.Value.(*entry).key)
 }
 
-// NewDNSCache ...
-func NewDNSCache() *DNSCache {
+// Stats returns the lookup counters and the number of cached responses.
+func (c *DNSCache) Stats() Stats {
+	c.mutex.Lock()
+	n := c.lru.Len()
+	c.mutex.Unlock()
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   n,
+	}
+}
 
-	return &DNSCache{
-		storage: make(map[string]*DNSCacheEntry),
+// cacheTTL returns how long resp may be cached, ok is false for the
+// responses that must not be.
+func cacheTTL(resp *dns.Msg) (uint32, bool) {
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return ttl, true
+	case resp.Rcode == dns.RcodeSuccess, resp.Rcode == dns.RcodeNameError:
+		// RFC 2308 section 5: negative answers without a SOA are not
+		// cached, the others for the smaller of the SOA TTL and MINIMUM.
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(soa.Hdr.Ttl, soa.Minttl, maxNegativeTTL), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func forEachRR(m *dns.Msg, fn func(dns.RR)) {
+	for _, rr := range m.Answer {
+		fn(rr)
+	}
+	for _, rr := range m.Ns {
+		fn(rr)
+	}
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			fn(rr)
+		}
 	}
 }
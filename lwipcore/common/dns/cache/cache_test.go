@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func reply(name string, rcode int, ttls ...uint32) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	for _, ttl := range ttls {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+	}
+	return resp
+}
+
+func query(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return req
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	c := NewDNSCache()
+	c.now = func() time.Time { return now }
+
+	c.Put(reply("example.com.", dns.RcodeSuccess, 300, 60))
+	now = now.Add(20 * time.Second)
+	req := query("EXAMPLE.com.")
+	resp := c.Get(req)
+	if resp == nil || resp.Id != req.Id {
+		t.Fatal("cached response not served", resp)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 280 {
+		t.Fatal("TTL not rewritten", ttl)
+	}
+
+	now = now.Add(41 * time.Second)
+	if c.Get(query("example.com.")) != nil {
+		t.Fatal("served past the smallest answer TTL")
+	}
+	st := c.Stats()
+	if st.Hits != 1 || st.Misses != 1 || st.Entries != 0 {
+		t.Fatal("unexpected stats", st)
+	}
+	t.Log(st)
+}
+
+func TestNegative(t *testing.T) {
+	c := NewDNSCache()
+	c.Put(reply("nosoa.example.", dns.RcodeNameError))
+	if c.Get(query("nosoa.example.")) != nil {
+		t.Fatal("negative answer without SOA cached")
+	}
+
+	resp := reply("missing.example.", dns.RcodeNameError)
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.",
+		Mbox:   "admin.example.",
+		Minttl: 30,
+	}}
+	c.Put(resp)
+	got := c.Get(query("missing.example."))
+	if got == nil || got.Rcode != dns.RcodeNameError {
+		t.Fatal("NXDOMAIN not cached", got)
+	}
+	if c.Put(reply("fail.example.", dns.RcodeServerFailure, 60)); c.Get(query("fail.example.")) != nil {
+		t.Fatal("SERVFAIL cached")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := NewDNSCache(WithSize(2))
+	c.Put(reply("a.", dns.RcodeSuccess, 60))
+	c.Put(reply("b.", dns.RcodeSuccess, 60))
+	c.Get(query("a."))
+	c.Put(reply("c.", dns.RcodeSuccess, 60))
+	if c.Get(query("b.")) != nil || c.Get(query("a.")) == nil || c.Get(query("c.")) == nil {
+		t.Fatal("least recently used response not evicted")
+	}
+	if st := c.Stats(); st.Evictions != 1 || st.Entries != 2 {
+		t.Fatal("unexpected stats", st)
+	}
+
+	b, _ := query("a.").Pack()
+	if c.Query(b) == nil {
+		t.Fatal("packed query not served")
+	}
+}
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"net"
+	"strconv"
 )
 
 const COMMON_DNS_PORT = 53
@@ -25,3 +26,14 @@ type FakeDns interface {
 	// IsFakeIP checks if the given ip is a fake IP.
 	IsFakeIP(ip net.IP) bool
 }
+
+// Target returns the host:port of a destination, with the domain of ip
+// as host when ip is a fake IP of f. f may be nil.
+func Target(f FakeDns, ip net.IP, port int) string {
+	if f != nil && f.IsFakeIP(ip) {
+		if domain := f.QueryDomain(ip); domain != "" {
+			return net.JoinHostPort(domain, strconv.Itoa(port))
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
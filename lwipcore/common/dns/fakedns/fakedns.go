@@ -0,0 +1,260 @@
+// Package fakedns answers A and AAAA queries with addresses taken from
+// a private pool and maps them back to the queried domains, so flows to
+// those addresses can be proxied by domain.
+package fakedns
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNotHandled is returned by GenerateFakeResponse for the queries
+// that should be resolved for real, e.g. MX or TXT ones.
+var ErrNotHandled = errors.New("fakedns: query not handled")
+
+const (
+	// DefaultSize is the default number of domains a pool remembers.
+	DefaultSize = 65535
+
+	// ttl keeps clients from caching fake addresses that may be
+	// recycled.
+	ttl = 1
+)
+
+// DefaultIPv4Range is the benchmarking range of RFC 2544, which is not
+// routed on the internet.
+var DefaultIPv4Range = netip.MustParsePrefix("198.18.0.0/15")
+
+// Option configures a FakeDNS.
+type Option func(*options)
+
+type options struct {
+	v4, v6 netip.Prefix
+	size   int
+}
+
+// WithIPv4Range sets the range of the fake A records.
+func WithIPv4Range(p netip.Prefix) Option {
+	return func(o *options) {
+		o.v4 = p
+	}
+}
+
+// WithIPv6Range sets the range of the fake AAAA records. Without it
+// AAAA queries get an empty answer, so clients fall back to IPv4.
+func WithIPv6Range(p netip.Prefix) Option {
+	return func(o *options) {
+		o.v6 = p
+	}
+}
+
+// WithSize sets the number of domains remembered per range, the least
+// recently used one gives its address up past that.
+func WithSize(n int) Option {
+	return func(o *options) {
+		o.size = n
+	}
+}
+
+// FakeDNS implements dns.FakeDns.
+type FakeDNS struct {
+	mu sync.Mutex
+	v4 *pool
+	v6 *pool
+}
+
+// New returns a FakeDNS over DefaultIPv4Range unless the options say
+// otherwise.
+func New(opts ...Option) (*FakeDNS, error) {
+	o := options{v4: DefaultIPv4Range, size: DefaultSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.size <= 0 {
+		return nil, fmt.Errorf("invalid pool size %d", o.size)
+	}
+
+	f := &FakeDNS{}
+	var err error
+	if o.v4.IsValid() {
+		if !o.v4.Addr().Is4() {
+			return nil, fmt.Errorf("%s is not an IPv4 range", o.v4)
+		}
+		if f.v4, err = newPool(o.v4, o.size); err != nil {
+			return nil, err
+		}
+	}
+	if o.v6.IsValid() {
+		if !o.v6.Addr().Is6() || o.v6.Addr().Is4In6() {
+			return nil, fmt.Errorf("%s is not an IPv6 range", o.v6)
+		}
+		if f.v6, err = newPool(o.v6, o.size); err != nil {
+			return nil, err
+		}
+	}
+	if f.v4 == nil && f.v6 == nil {
+		return nil, errors.New("no fake IP range")
+	}
+	return f, nil
+}
+
+// GenerateFakeResponse answers an A or AAAA query with a fake address.
+// Other queries return ErrNotHandled.
+func (f *FakeDNS) GenerateFakeResponse(request []byte) ([]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(request); err != nil {
+		return nil, err
+	}
+	if req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return nil, ErrNotHandled
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil, ErrNotHandled
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	domain := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	f.mu.Lock()
+	switch {
+	case q.Qtype == dns.TypeA && f.v4 != nil:
+		resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: f.v4.lookup(domain).AsSlice()}}
+	case q.Qtype == dns.TypeAAAA && f.v6 != nil:
+		resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: f.v6.lookup(domain).AsSlice()}}
+	}
+	f.mu.Unlock()
+	return resp.Pack()
+}
+
+// QueryDomain returns the domain ip was handed out for, or "" if ip is
+// not a live fake address.
+func (f *FakeDNS) QueryDomain(ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	addr = addr.Unmap()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p := f.pool(addr); p != nil {
+		return p.domain(addr)
+	}
+	return ""
+}
+
+// IsFakeIP reports whether ip belongs to one of the fake ranges.
+func (f *FakeDNS) IsFakeIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return f.pool(addr.Unmap()) != nil
+}
+
+func (f *FakeDNS) pool(addr netip.Addr) *pool {
+	if f.v4 != nil && f.v4.prefix.Contains(addr) {
+		return f.v4
+	}
+	if f.v6 != nil && f.v6.prefix.Contains(addr) {
+		return f.v6
+	}
+	return nil
+}
+
+// pool hands out the addresses of a prefix, the network address and the
+// first host are skipped as the tun device usually holds the latter.
+type pool struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	size   uint64
+	next   uint64
+
+	lru      *list.List // of *entry, most recently used first
+	byDomain map[string]*list.Element
+	byAddr   map[netip.Addr]*list.Element
+}
+
+type entry struct {
+	domain string
+	addr   netip.Addr
+}
+
+func newPool(prefix netip.Prefix, size int) (*pool, error) {
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	usable := uint64(size)
+	if hostBits < 63 {
+		// The broadcast address is skipped too.
+		if n := uint64(1)<<hostBits - 3; n < usable {
+			usable = n
+		}
+	}
+	if hostBits < 2 || usable == 0 {
+		return nil, fmt.Errorf("fake IP range %s is too small", prefix)
+	}
+	return &pool{
+		prefix:   prefix,
+		first:    addOffset(prefix.Addr(), 2),
+		size:     usable,
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byAddr:   make(map[netip.Addr]*list.Element),
+	}, nil
+}
+
+// lookup returns the address of domain, recycling the least recently
+// used one once the pool is exhausted.
+func (p *pool) lookup(domain string) netip.Addr {
+	if e, ok := p.byDomain[domain]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*entry).addr
+	}
+
+	var addr netip.Addr
+	if p.next < p.size {
+		addr = addOffset(p.first, p.next)
+		p.next++
+	} else {
+		old := p.lru.Remove(p.lru.Back()).(*entry)
+		delete(p.byDomain, old.domain)
+		delete(p.byAddr, old.addr)
+		addr = old.addr
+	}
+	e := p.lru.PushFront(&entry{domain: domain, addr: addr})
+	p.byDomain[domain] = e
+	p.byAddr[addr] = e
+	return addr
+}
+
+func (p *pool) domain(addr netip.Addr) string {
+	e, ok := p.byAddr[addr]
+	if !ok {
+		return ""
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*entry).domain
+}
+
+func addOffset(addr netip.Addr, n uint64) netip.Addr {
+	b := addr.As16()
+	for i := 15; i >= 0 && n > 0; i-- {
+		sum := uint64(b[i]) + n&0xff
+		b[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	if addr.Is4() {
+		return netip.AddrFrom16(b).Unmap()
+	}
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,87 @@
+package fakedns
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func query(t *testing.T, f *FakeDNS, name string, qtype uint16) net.IP {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	b, _ := req.Pack()
+	out, err := f.GenerateFakeResponse(b)
+	if err != nil {
+		t.Fatal(name, err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) > 1 {
+		t.Fatal("unexpected response", resp)
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	switch rr := resp.Answer[0].(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	t.Fatal("unexpected answer", resp.Answer[0])
+	return nil
+}
+
+func TestFakeDNS(t *testing.T) {
+	f, err := New(WithIPv6Range(netip.MustParsePrefix("fc00::/64")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := query(t, f, "Example.com", dns.TypeA)
+	if ip.String() != "198.18.0.2" || !f.IsFakeIP(ip) || f.QueryDomain(ip) != "example.com" {
+		t.Fatal("unexpected fake IP", ip, f.QueryDomain(ip))
+	}
+	if again := query(t, f, "example.com", dns.TypeA); !again.Equal(ip) {
+		t.Fatal("domain got a new address", again)
+	}
+	ip6 := query(t, f, "example.com", dns.TypeAAAA)
+	if ip6.String() != "fc00::2" || f.QueryDomain(ip6) != "example.com" {
+		t.Fatal("unexpected fake IPv6", ip6)
+	}
+	if f.IsFakeIP(net.IPv4(8, 8, 8, 8)) {
+		t.Fatal("real IP reported as fake")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	b, _ := req.Pack()
+	if _, err := f.GenerateFakeResponse(b); err != ErrNotHandled {
+		t.Fatal("MX query handled", err)
+	}
+	t.Log(ip, ip6)
+}
+
+func TestRecycle(t *testing.T) {
+	f, err := New(WithSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := query(t, f, "a.com", dns.TypeA)
+	b := query(t, f, "b.com", dns.TypeA)
+	f.QueryDomain(a) // a is now the most recently used
+	c := query(t, f, "c.com", dns.TypeA)
+	if !c.Equal(b) || f.QueryDomain(b) != "c.com" || f.QueryDomain(a) != "a.com" {
+		t.Fatal("least recently used address not recycled", a, b, c)
+	}
+	if query(t, f, "no-ipv6.com", dns.TypeAAAA) != nil {
+		t.Fatal("AAAA answered without an IPv6 range")
+	}
+
+	if _, err := New(WithIPv4Range(netip.MustParsePrefix("10.0.0.0/31"))); err == nil {
+		t.Fatal("tiny range accepted")
+	}
+}
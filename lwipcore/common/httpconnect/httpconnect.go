@@ -0,0 +1,73 @@
+// Package httpconnect tunnels TCP connections through an HTTP proxy
+// with HTTP/1.1 CONNECT.
+package httpconnect
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrAuthFailed is returned, wrapped, when the proxy answers 407.
+var ErrAuthFailed = errors.New("http proxy authentication failed")
+
+// StatusError is a non-2xx answer of the proxy to CONNECT.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "http proxy refused CONNECT: " + e.Status
+}
+
+// Auth holds the credentials sent with Basic auth.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Handshake asks the proxy on conn to connect to target, a host:port.
+// The returned conn replaces conn: it also serves the bytes the proxy
+// sent after its answer.
+func Handshake(conn net.Conn, target string, auth *Auth) (net.Conn, error) {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response: %s", err)
+	}
+	// The body is not read: a 2xx answer has none and the conn is
+	// dropped after any other.
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("%w: %s", ErrAuthFailed, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
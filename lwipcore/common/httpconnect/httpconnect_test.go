@@ -0,0 +1,55 @@
+package httpconnect
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// proxy answers one CONNECT with reply, after checking the request.
+func proxy(t *testing.T, reply string) net.Conn {
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		req, err := http.ReadRequest(bufio.NewReader(s))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+			t.Error("unexpected request", req.Method, req.Host)
+		}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != "" && auth != "Basic dTpw" {
+			t.Error("unexpected credentials", auth)
+		}
+		s.Write([]byte(reply))
+	}()
+	return c
+}
+
+func TestHandshake(t *testing.T) {
+	c, err := Handshake(proxy(t, "HTTP/1.1 200 Connection established\r\n\r\nhello"), "example.com:443", &Auth{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(c)
+	t.Log(string(b))
+	if string(b) != "hello" {
+		t.Fatal("lost bytes sent after the answer:", string(b))
+	}
+
+	_, err = Handshake(proxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"), "example.com:443", nil)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("expected ErrAuthFailed, got", err)
+	}
+
+	_, err = Handshake(proxy(t, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"), "example.com:443", nil)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != 403 {
+		t.Fatal("expected a 403 StatusError, got", err)
+	}
+	t.Log(err)
+}
@@ -0,0 +1,126 @@
+// Package shadowsocks implements the client side of the Shadowsocks AEAD
+// (SIP004) and 2022 edition (SIP022) protocols.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+var (
+	ErrUnknownMethod = errors.New("unknown shadowsocks method")
+	ErrBadHeader     = errors.New("bad shadowsocks header")
+	ErrBadTimestamp  = errors.New("shadowsocks timestamp out of range")
+)
+
+// Cipher holds the method and key shared with a server.
+type Cipher struct {
+	method  string
+	key     []byte
+	is2022  bool
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipher returns the cipher for method. Classic AEAD methods derive
+// their key from password, 2022 methods take the base64 encoded key.
+// Only single user 2022 keys are supported.
+func NewCipher(method, password string) (*Cipher, error) {
+	method = strings.ToLower(method)
+	c := &Cipher{method: method}
+
+	var keySize int
+	switch method {
+	case "aes-128-gcm", "2022-blake3-aes-128-gcm":
+		keySize, c.newAEAD = 16, newGCM
+	case "aes-256-gcm", "2022-blake3-aes-256-gcm":
+		keySize, c.newAEAD = 32, newGCM
+	case "chacha20-ietf-poly1305", "2022-blake3-chacha20-poly1305":
+		keySize, c.newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownMethod, method)
+	}
+
+	if c.is2022 = strings.HasPrefix(method, "2022-"); c.is2022 {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return nil, fmt.Errorf("decode 2022 key: %s", err)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s needs a %d bytes key, got %d", method, keySize, len(key))
+		}
+		c.key = key
+	} else {
+		c.key = kdf(password, keySize)
+	}
+	return c, nil
+}
+
+func (c *Cipher) Method() string {
+	return c.method
+}
+
+func (c *Cipher) saltSize() int {
+	return len(c.key)
+}
+
+// sessionAEAD returns the AEAD keyed with the subkey of salt, or of the
+// session ID for 2022 UDP.
+func (c *Cipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	var subkey []byte
+	if c.is2022 {
+		material := make([]byte, 0, len(c.key)+len(salt))
+		material = append(material, c.key...)
+		material = append(material, salt...)
+		subkey = make([]byte, len(c.key))
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+	} else {
+		var err error
+		subkey, err = hkdf.Key(sha1.New, c.key, salt, "ss-subkey", len(c.key))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.newAEAD(subkey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kdf is EVP_BytesToKey with MD5, as used by the original Shadowsocks.
+func kdf(password string, keyLen int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keyLen {
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+		h.Reset()
+	}
+	return b[:keyLen]
+}
+
+// increment increments a little endian nonce.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
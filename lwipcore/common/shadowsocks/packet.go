@@ -0,0 +1,236 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PacketConn relays datagrams through conn, a UDP connection to the
+// server. Every datagram carries its destination, or its origin for the
+// replies.
+func (c *Cipher) PacketConn(conn net.Conn) (net.PacketConn, error) {
+	p := &packetConn{Conn: conn, c: c}
+	if !c.is2022 {
+		return p, nil
+	}
+	if _, err := rand.Read(p.sessionID[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if c.method == "2022-blake3-chacha20-poly1305" {
+		p.xchacha, err = chacha20poly1305.NewX(c.key)
+		return p, err
+	}
+	if p.block, err = aes.NewCipher(c.key); err != nil {
+		return nil, err
+	}
+	p.enc, err = c.sessionAEAD(p.sessionID[:])
+	return p, err
+}
+
+type packetConn struct {
+	net.Conn
+	c *Cipher
+
+	// 2022 edition state.
+	mu        sync.Mutex
+	sessionID [8]byte
+	packetID  uint64
+	block     cipher.Block // separate header cipher of the AES methods
+	enc       cipher.AEAD
+	xchacha   cipher.AEAD
+
+	decMu       sync.Mutex
+	serverID    [8]byte
+	dec         cipher.AEAD
+	hasServerID bool
+
+	rbuf []byte
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socks5.ParseAddr(addr.String())
+	if target == nil {
+		return 0, &net.AddrError{Err: "invalid shadowsocks target", Addr: addr.String()}
+	}
+
+	var pkt []byte
+	var err error
+	if p.c.is2022 {
+		pkt, err = p.seal2022(target, b)
+	} else {
+		pkt, err = p.seal(target, b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := p.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// seal builds a SIP004 packet: salt, then target and payload sealed with
+// a zero nonce.
+func (p *packetConn) seal(target socks5.Addr, b []byte) ([]byte, error) {
+	salt := make([]byte, p.c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := p.c.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 0, len(target)+len(b))
+	plain = append(append(plain, target...), b...)
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil), nil
+}
+
+func (p *packetConn) seal2022(target socks5.Addr, b []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.packetID++
+
+	var header [16]byte
+	copy(header[:8], p.sessionID[:])
+	binary.BigEndian.PutUint64(header[8:], p.packetID)
+
+	body := make([]byte, 0, 16+1+8+2+len(target)+len(b))
+	if p.xchacha != nil {
+		body = append(body, header[:]...)
+	}
+	body = append(body, typeRequest)
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	body = binary.BigEndian.AppendUint16(body, 0) // no padding
+	body = append(body, target...)
+	body = append(body, b...)
+
+	if p.xchacha != nil {
+		nonce := make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return p.xchacha.Seal(nonce, nonce, body, nil), nil
+	}
+
+	pkt := make([]byte, 16, 16+len(body)+p.enc.Overhead())
+	p.block.Encrypt(pkt, header[:])
+	return p.enc.Seal(pkt, header[4:16], body, nil), nil
+}
+
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if p.rbuf == nil {
+		p.rbuf = make([]byte, 64*1024)
+	}
+	buf := p.rbuf
+	for {
+		n, err := p.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		var plain []byte
+		if p.c.is2022 {
+			plain, err = p.open2022(buf[:n])
+		} else {
+			plain, err = p.open(buf[:n])
+		}
+		if err != nil {
+			continue
+		}
+		addr := socks5.SplitAddr(plain)
+		if addr == nil {
+			continue
+		}
+		from := addr.UDPAddr()
+		if from == nil {
+			if from, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+				continue
+			}
+		}
+		return copy(b, plain[len(addr):]), from, nil
+	}
+}
+
+func (p *packetConn) open(pkt []byte) ([]byte, error) {
+	saltSize := p.c.saltSize()
+	if len(pkt) < saltSize {
+		return nil, ErrBadHeader
+	}
+	aead, err := p.c.sessionAEAD(pkt[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(pkt[saltSize:saltSize], make([]byte, aead.NonceSize()), pkt[saltSize:], nil)
+}
+
+// open2022 decrypts a server packet and returns its address and payload.
+func (p *packetConn) open2022(pkt []byte) ([]byte, error) {
+	var header [16]byte
+	var body []byte
+	if p.xchacha != nil {
+		ns := chacha20poly1305.NonceSizeX
+		if len(pkt) < ns {
+			return nil, ErrBadHeader
+		}
+		plain, err := p.xchacha.Open(nil, pkt[:ns], pkt[ns:], nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(plain) < 16 {
+			return nil, ErrBadHeader
+		}
+		copy(header[:], plain)
+		body = plain[16:]
+	} else {
+		if len(pkt) < 16 {
+			return nil, ErrBadHeader
+		}
+		p.block.Decrypt(header[:], pkt[:16])
+		aead, err := p.serverAEAD(header[:8])
+		if err != nil {
+			return nil, err
+		}
+		if body, err = aead.Open(nil, header[4:16], pkt[16:], nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// type, timestamp, client session ID and padding length.
+	if len(body) < 1+8+8+2 || body[0] != typeResponse || string(body[9:17]) != string(p.sessionID[:]) {
+		return nil, ErrBadHeader
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(body[1:9])); err != nil {
+		return nil, err
+	}
+	padLen := int(binary.BigEndian.Uint16(body[17:19]))
+	if len(body) < 19+padLen {
+		return nil, ErrBadHeader
+	}
+	return body[19+padLen:], nil
+}
+
+// serverAEAD returns the AEAD of the server session id, servers keep
+// one session per client session so the last one is cached.
+func (p *packetConn) serverAEAD(id []byte) (cipher.AEAD, error) {
+	p.decMu.Lock()
+	defer p.decMu.Unlock()
+	if p.hasServerID && string(p.serverID[:]) == string(id) {
+		return p.dec, nil
+	}
+	aead, err := p.c.sessionAEAD(id)
+	if err != nil {
+		return nil, err
+	}
+	copy(p.serverID[:], id)
+	p.dec, p.hasServerID = aead, true
+	return aead, nil
+}
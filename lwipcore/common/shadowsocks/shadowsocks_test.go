@@ -0,0 +1,188 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var methods = map[string]string{
+	"aes-128-gcm":                   "secret",
+	"aes-256-gcm":                   "secret",
+	"chacha20-ietf-poly1305":        "secret",
+	"2022-blake3-aes-128-gcm":       "AAECAwQFBgcICQoLDA0ODw==",
+	"2022-blake3-aes-256-gcm":       "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+	"2022-blake3-chacha20-poly1305": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+}
+
+// echoStream plays the server of one TCP session: it checks the target
+// and echoes the first chunk of data.
+func echoStream(t *testing.T, c *Cipher, conn net.Conn) {
+	defer conn.Close()
+	s := &streamConn{Conn: conn, c: c}
+
+	reqSalt := make([]byte, c.saltSize())
+	io.ReadFull(conn, reqSalt)
+	s.dec, _ = c.sessionAEAD(reqSalt)
+	s.decNonce = make([]byte, s.dec.NonceSize())
+
+	var header, fixed []byte
+	var err error
+	if c.is2022 {
+		if fixed, err = s.open(11); err == nil {
+			header, err = s.open(int(binary.BigEndian.Uint16(fixed[9:])))
+		}
+	} else {
+		err = s.readChunk()
+		header = s.pending
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if target := socks5.SplitAddr(header); target.String() != "example.com:443" {
+		t.Error("unexpected target", target)
+	}
+
+	if err := s.readChunk(); err != nil {
+		t.Error(err)
+		return
+	}
+	data := append([]byte(nil), s.pending...)
+
+	salt := make([]byte, c.saltSize())
+	rand.Read(salt)
+	s.enc, _ = c.sessionAEAD(salt)
+	s.encNonce = make([]byte, s.enc.NonceSize())
+	out := salt
+	if c.is2022 {
+		fixed := []byte{typeResponse}
+		fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+		fixed = append(fixed, reqSalt...)
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(data)))
+		out = s.sealRaw(out, fixed)
+		out = s.sealRaw(out, data)
+	} else {
+		out = s.seal(out, data)
+	}
+	conn.Write(out)
+}
+
+func TestStream(t *testing.T) {
+	for method, password := range methods {
+		c, err := NewCipher(method, password)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		client, server := net.Pipe()
+		go echoStream(t, c, server)
+
+		// net.Pipe is synchronous, write the request from a goroutine.
+		done := make(chan net.Conn)
+		go func() {
+			conn, err := c.StreamConn(client, socks5.ParseAddr("example.com:443"))
+			if err != nil {
+				t.Error(method, err)
+			}
+			done <- conn
+		}()
+		conn := <-done
+		if conn == nil {
+			continue
+		}
+		go conn.Write([]byte("hello " + method))
+		b := make([]byte, 64)
+		n, err := io.ReadAtLeast(conn, b, len("hello "+method))
+		if err != nil || string(b[:n]) != "hello "+method {
+			t.Fatal(method, "unexpected echo", string(b[:n]), err)
+		}
+		t.Log(method, "ok")
+	}
+}
+
+// reply seals payload as the server answer to a packet sent by p.
+func reply(p *packetConn, from socks5.Addr, payload []byte) []byte {
+	c := p.c
+	if !c.is2022 {
+		salt := make([]byte, c.saltSize())
+		rand.Read(salt)
+		aead, _ := c.sessionAEAD(salt)
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), append(append([]byte(nil), from...), payload...), nil)
+	}
+
+	header := make([]byte, 16)
+	rand.Read(header[:8])
+	binary.BigEndian.PutUint64(header[8:], 1)
+	body := []byte{typeResponse}
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	body = append(body, p.sessionID[:]...)
+	body = binary.BigEndian.AppendUint16(body, 3)
+	body = append(body, 0, 0, 0)
+	body = append(body, from...)
+	body = append(body, payload...)
+
+	if p.xchacha != nil {
+		nonce := make([]byte, chacha20poly1305.NonceSizeX)
+		rand.Read(nonce)
+		return p.xchacha.Seal(nonce, nonce, append(header, body...), nil)
+	}
+	block, _ := aes.NewCipher(c.key)
+	aead, _ := c.sessionAEAD(header[:8])
+	pkt := make([]byte, 16)
+	block.Encrypt(pkt, header)
+	return aead.Seal(pkt, header[4:], body, nil)
+}
+
+func TestPacket(t *testing.T) {
+	for method, password := range methods {
+		c, err := NewCipher(method, password)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		client, server := net.Pipe()
+		pc, err := c.PacketConn(client)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		p := pc.(*packetConn)
+
+		dst := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+		go pc.WriteTo([]byte("query"), dst)
+		b := make([]byte, 2048)
+		n, _ := server.Read(b)
+		if n == 0 || bytes.Contains(b[:n], []byte("query")) {
+			t.Fatal(method, "datagram not encrypted")
+		}
+
+		go server.Write(reply(p, socks5.ParseAddr(dst.String()), []byte("answer")))
+		n, from, err := pc.ReadFrom(b)
+		if err != nil || string(b[:n]) != "answer" || from.String() != dst.String() {
+			t.Fatal(method, "unexpected reply", string(b[:n]), from, err)
+		}
+		t.Log(method, "ok")
+	}
+}
+
+func TestNewCipher(t *testing.T) {
+	// EVP_BytesToKey, as printed by openssl enc -aes-256-cbc -k secret -nosalt -md md5 -P
+	c, _ := NewCipher("aes-256-gcm", "secret")
+	if hex.EncodeToString(c.key) != "5ebe2294ecd0e0f08eab7690d2a6ee6926ae5cc854e36b6bdfca366848dea6bb" {
+		t.Fatal("unexpected key", hex.EncodeToString(c.key))
+	}
+	if _, err := NewCipher("rc4-md5", "secret"); err == nil {
+		t.Fatal("stream cipher accepted")
+	}
+	if _, err := NewCipher("2022-blake3-aes-256-gcm", "AAECAwQFBgcICQoLDA0ODw=="); err == nil {
+		t.Fatal("short 2022 key accepted")
+	}
+}
@@ -0,0 +1,210 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+const (
+	maxPayload     = 0x3fff
+	maxPayload2022 = 0xffff
+
+	typeRequest  = 0
+	typeResponse = 1
+
+	// maxTimeDiff is the clock skew allowed by the 2022 edition.
+	maxTimeDiff = 30 * time.Second
+)
+
+// StreamConn starts a TCP session to target on conn, a connection to the
+// server. The request is sent before StreamConn returns, so protocols
+// where the server speaks first work.
+func (c *Cipher) StreamConn(conn net.Conn, target socks5.Addr) (net.Conn, error) {
+	s := &streamConn{Conn: conn, c: c}
+	if err := s.writeRequest(target); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type streamConn struct {
+	net.Conn
+	c *Cipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+	reqSalt  []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	pending  []byte // decrypted bytes not read yet
+	rbuf     []byte
+}
+
+func (s *streamConn) writeRequest(target socks5.Addr) error {
+	salt := make([]byte, s.c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := s.c.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	s.enc, s.encNonce, s.reqSalt = aead, make([]byte, aead.NonceSize()), salt
+
+	buf := append([]byte(nil), salt...)
+	if !s.c.is2022 {
+		buf = s.seal(buf, []byte(target))
+		_, err = s.Conn.Write(buf)
+		return err
+	}
+
+	// The variable length header carries the target and, without an
+	// initial payload, a non-empty random padding.
+	pad, err := rand.Int(rand.Reader, big.NewInt(900))
+	if err != nil {
+		return err
+	}
+	padLen := int(pad.Int64()) + 1
+	header := make([]byte, 0, len(target)+2+padLen)
+	header = append(header, target...)
+	header = binary.BigEndian.AppendUint16(header, uint16(padLen))
+	header = append(header, make([]byte, padLen)...)
+
+	fixed := make([]byte, 0, 11)
+	fixed = append(fixed, typeRequest)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+
+	buf = s.sealRaw(buf, fixed)
+	buf = s.sealRaw(buf, header)
+	_, err = s.Conn.Write(buf)
+	return err
+}
+
+// sealRaw appends p encrypted as one AEAD message to dst.
+func (s *streamConn) sealRaw(dst, p []byte) []byte {
+	dst = s.enc.Seal(dst, s.encNonce, p, nil)
+	increment(s.encNonce)
+	return dst
+}
+
+// seal appends p to dst as length prefixed chunks.
+func (s *streamConn) seal(dst, p []byte) []byte {
+	max := maxPayload
+	if s.c.is2022 {
+		max = maxPayload2022
+	}
+	for len(p) > 0 {
+		n := min(len(p), max)
+		dst = s.sealRaw(dst, binary.BigEndian.AppendUint16(nil, uint16(n)))
+		dst = s.sealRaw(dst, p[:n])
+		p = p[n:]
+	}
+	return dst
+}
+
+func (s *streamConn) Write(b []byte) (int, error) {
+	if _, err := s.Conn.Write(s.seal(nil, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *streamConn) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.dec == nil {
+			if err := s.readResponse(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := s.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// open reads and decrypts an AEAD message of n plaintext bytes.
+func (s *streamConn) open(n int) ([]byte, error) {
+	size := n + s.dec.Overhead()
+	if cap(s.rbuf) < size {
+		s.rbuf = make([]byte, size)
+	}
+	buf := s.rbuf[:size]
+	if _, err := io.ReadFull(s.Conn, buf); err != nil {
+		return nil, err
+	}
+	p, err := s.dec.Open(buf[:0], s.decNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(s.decNonce)
+	return p, nil
+}
+
+func (s *streamConn) readChunk() error {
+	p, err := s.open(2)
+	if err != nil {
+		return err
+	}
+	p, err = s.open(int(binary.BigEndian.Uint16(p)))
+	if err != nil {
+		return err
+	}
+	s.pending = p
+	return nil
+}
+
+func (s *streamConn) readResponse() error {
+	salt := make([]byte, s.c.saltSize())
+	if _, err := io.ReadFull(s.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := s.c.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	s.dec, s.decNonce = aead, make([]byte, aead.NonceSize())
+	if !s.c.is2022 {
+		return nil
+	}
+
+	// type, timestamp, request salt and the length of the first chunk.
+	fixed, err := s.open(1 + 8 + len(s.reqSalt) + 2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != typeResponse || !bytes.Equal(fixed[9:9+len(s.reqSalt)], s.reqSalt) {
+		return ErrBadHeader
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(fixed[1:9])); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(fixed[len(fixed)-2:]))
+	p, err := s.open(n)
+	if err != nil {
+		return err
+	}
+	s.pending = p
+	return nil
+}
+
+func checkTimestamp(ts uint64) error {
+	d := time.Since(time.Unix(int64(ts), 0))
+	if d > maxTimeDiff || d < -maxTimeDiff {
+		return ErrBadTimestamp
+	}
+	return nil
+}
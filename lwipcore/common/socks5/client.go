@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	version = 5
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 1
+)
+
+// ErrAuthFailed is returned when the server rejects the credentials or
+// accepts none of the offered methods.
+var ErrAuthFailed = errors.New("socks5 authentication failed")
+
+// ReplyError is a failure reply of the server, RFC 1928 section 6.
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	if int(e) < len(socks5Errors) && e != 0 {
+		return "socks5 " + socks5Errors[e].Error()
+	}
+	return fmt.Sprintf("socks5 unknown reply %d", byte(e))
+}
+
+// Auth holds the RFC 1929 username/password credentials.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Handshake authenticates on conn and sends the request cmd for addr.
+// It returns the address of the server reply, the bound address of the
+// request. Authentication failures wrap ErrAuthFailed, refused requests
+// are a ReplyError.
+func Handshake(conn io.ReadWriter, cmd byte, addr Addr, auth *Auth) (Addr, error) {
+	if err := Negotiate(conn, auth); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, MaxAddrLen+3)
+	buf = append(buf, version, cmd, 0)
+	buf = append(buf, addr...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return nil, err
+	}
+	if buf[0] != version {
+		return nil, fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+	if buf[1] != 0 {
+		return nil, ReplyError(buf[1])
+	}
+	return ReadAddr(conn, buf[:cap(buf)])
+}
+
+// Negotiate agrees on an authentication method with the server on conn
+// and authenticates, the first half of Handshake. Failures wrap
+// ErrAuthFailed.
+func Negotiate(conn io.ReadWriter, auth *Auth) error {
+	// Offer username/password only when there are credentials to send.
+	buf := []byte{version, 1, methodNoAuth}
+	if auth != nil {
+		buf = []byte{version, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != version {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case methodNoAuth:
+		return nil
+	case methodUserPass:
+		if auth == nil {
+			return fmt.Errorf("%w: server chose username/password without credentials", ErrAuthFailed)
+		}
+		return authenticate(conn, auth)
+	case methodNoAcceptable:
+		return fmt.Errorf("%w: no acceptable authentication method", ErrAuthFailed)
+	default:
+		return fmt.Errorf("unexpected socks method %d", buf[1])
+	}
+}
+
+// authenticate runs the RFC 1929 subnegotiation.
+func authenticate(conn io.ReadWriter, auth *Auth) error {
+	if len(auth.Username) == 0 || len(auth.Username) > 255 || len(auth.Password) > 255 {
+		return fmt.Errorf("%w: invalid username or password length", ErrAuthFailed)
+	}
+	b := make([]byte, 0, 3+len(auth.Username)+len(auth.Password))
+	b = append(b, userPassVersion, byte(len(auth.Username)))
+	b = append(b, auth.Username...)
+	b = append(b, byte(len(auth.Password)))
+	b = append(b, auth.Password...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return fmt.Errorf("%w: status %d", ErrAuthFailed, b[1])
+	}
+	return nil
+}
+
+// Dial connects to the server with dial and asks it to connect to
+// target, a host:port.
+func Dial(dial func(network, address string) (net.Conn, error), server, target string, auth *Auth) (net.Conn, error) {
+	addr := ParseAddr(target)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid socks target %q", target)
+	}
+	conn, err := dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Handshake(conn, CmdConnect, addr, auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// serve runs the server side of a handshake that requires the
+// credentials user/pass.
+func serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	b := make([]byte, 512)
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return
+	}
+	io.ReadFull(conn, b[:b[1]])
+	conn.Write([]byte{version, methodUserPass})
+
+	io.ReadFull(conn, b[:2])
+	user := make([]byte, b[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, b[:1])
+	pass := make([]byte, b[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{userPassVersion, 1})
+		return
+	}
+	conn.Write([]byte{userPassVersion, 0})
+
+	io.ReadFull(conn, b[:3])
+	addr, err := ReadAddr(conn, b[3:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Log("request", b[1], addr)
+	conn.Write(append([]byte{version, 0, 0}, ParseAddr("127.0.0.1:1080")...))
+}
+
+func TestHandshakeAuth(t *testing.T) {
+	c, s := net.Pipe()
+	go serve(t, s)
+	bound, err := Handshake(c, CmdConnect, ParseAddr("example.com:443"), &Auth{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.String() != "127.0.0.1:1080" {
+		t.Fatal("unexpected bound address", bound)
+	}
+
+	c, s = net.Pipe()
+	go serve(t, s)
+	_, err = Handshake(c, CmdConnect, ParseAddr("example.com:443"), &Auth{Username: "user", Password: "wrong"})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("expected ErrAuthFailed, got", err)
+	}
+
+	c, s = net.Pipe()
+	go serve(t, s)
+	_, err = Handshake(c, CmdConnect, ParseAddr("example.com:443"), nil)
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("expected ErrAuthFailed, got", err)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	var err error = ReplyError(5)
+	t.Log(err)
+	if err.Error() != "socks5 connection refused" {
+		t.Fatal("unexpected message", err)
+	}
+}
@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrShortDatagram = errors.New("socks5 udp datagram too short")
+	ErrFragmented    = errors.New("socks5 udp fragments are not supported")
+)
+
+// AppendDatagram appends the UDP request header for addr followed by
+// payload to b, RFC 1928 section 7.
+func AppendDatagram(b []byte, addr Addr, payload []byte) []byte {
+	b = append(b, 0, 0, 0)
+	b = append(b, addr...)
+	return append(b, payload...)
+}
+
+// SplitDatagram splits a UDP datagram into its address and payload.
+// Fragmented datagrams are rejected, as most servers do.
+func SplitDatagram(b []byte) (Addr, []byte, error) {
+	if len(b) < 3 {
+		return nil, nil, ErrShortDatagram
+	}
+	if b[2] != 0 {
+		return nil, nil, ErrFragmented
+	}
+	addr := SplitAddr(b[3:])
+	if addr == nil {
+		return nil, nil, ErrShortDatagram
+	}
+	return addr, b[3+len(addr):], nil
+}
+
+// UDPAddr returns a copy of a as a UDP address, nil for a domain name.
+func (a Addr) UDPAddr() *net.UDPAddr {
+	var n int
+	switch ATYP(a[0]) {
+	case socks5IP4:
+		n = net.IPv4len
+	case socks5IP6:
+		n = net.IPv6len
+	default:
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), a[1:1+n]...),
+		Port: int(a[1+n])<<8 | int(a[2+n]),
+	}
+}
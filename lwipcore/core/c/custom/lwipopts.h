@@ -110,8 +110,26 @@
 #define TCPIP_DEBUG LWIP_DBG_ON
 #define IP6_DEBUG LWIP_DBG_ON
 
-#define LWIP_STATS 0
+// Only the memory pool statistics are kept, they are exported by
+// MemoryPoolStats.
+#define LWIP_STATS 1
 #define LWIP_STATS_DISPLAY 0
+#define MEMP_STATS 1
+#define MEM_STATS 0
+#define SYS_STATS 0
+#define LINK_STATS 0
+#define ETHARP_STATS 0
+#define IP_STATS 0
+#define IPFRAG_STATS 0
+#define ICMP_STATS 0
+#define IGMP_STATS 0
+#define UDP_STATS 0
+#define TCP_STATS 0
+#define IP6_STATS 0
+#define ICMP6_STATS 0
+#define IP6_FRAG_STATS 0
+#define MLD6_STATS 0
+#define ND6_STATS 0
 #define LWIP_PERF 0
 
 #endif
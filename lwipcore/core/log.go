@@ -0,0 +1,21 @@
+package core
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var coreLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger of the core. lwIP keeps its state in globals,
+// so there is one logger for all stacks. A nil l restores slog.Default.
+func SetLogger(l *slog.Logger) {
+	coreLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := coreLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
@@ -10,7 +10,6 @@ import "C"
 import (
 	"context"
 	"errors"
-	"log"
 	"sync"
 	"time"
 	"unsafe"
@@ -41,7 +40,7 @@ type lwipStack struct {
 func NewLWIPStack() LWIPStack {
 	tcpPCB := C.tcp_new()
 	if tcpPCB == nil {
-		log.Print("tcp_new return nil")
+		logger().Error("tcp_new return nil")
 		return nil
 	}
 
@@ -50,21 +49,21 @@ func NewLWIPStack() LWIPStack {
 	case C.ERR_OK:
 		break
 	case C.ERR_VAL:
-		log.Print("invalid PCB state")
+		logger().Error("invalid PCB state")
 		return nil
 
 	case C.ERR_USE:
-		log.Print("port in use")
+		logger().Error("port in use")
 		return nil
 	default:
 		C.memp_free(C.MEMP_TCP_PCB, unsafe.Pointer(tcpPCB))
-		log.Print("unknown tcp_bind return value")
+		logger().Error("unknown tcp_bind return value")
 		return nil
 	}
 
 	tcpPCB = C.tcp_listen_with_backlog(tcpPCB, C.TCP_DEFAULT_LISTEN_BACKLOG)
 	if tcpPCB == nil {
-		log.Print("can not allocate tcp pcb")
+		logger().Error("can not allocate tcp pcb")
 		return nil
 	}
 
@@ -72,13 +71,13 @@ func NewLWIPStack() LWIPStack {
 
 	udpPCB := C.udp_new()
 	if udpPCB == nil {
-		log.Print("could not allocate udp pcb")
+		logger().Error("could not allocate udp pcb")
 		return nil
 	}
 
 	err = C.udp_bind(udpPCB, C.IP_ADDR_ANY, 0)
 	if err != C.ERR_OK {
-		log.Print("address already in use")
+		logger().Error("address already in use")
 		return nil
 	}
 
@@ -135,7 +134,7 @@ func (s *lwipStack) RestartTimeouts() {
 // stage, e.g. the loop interface.
 func (s *lwipStack) Close() error {
 
-	log.Print("Close lwipStack..............")
+	logger().Debug("closing lwip stack")
 	// Stop firing timer events.
 	s.cancel()
 
@@ -160,7 +159,7 @@ func (s *lwipStack) Close() error {
 	C.tcp_close(s.tpcb) // FIXME handle error
 	C.udp_remove(s.upcb)
 	lwipMutex.Unlock()
-	log.Print("lwipStack Closed!..............")
+	logger().Debug("lwip stack closed")
 	return nil
 }
 
@@ -0,0 +1,58 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/memp.h"
+#include "lwip/stats.h"
+
+static struct stats_mem*
+memp_stats(int i)
+{
+	return lwip_stats.memp[i];
+}
+*/
+import "C"
+
+// PoolStats is the usage of an lwIP memory pool.
+type PoolStats struct {
+	Name string
+	// Used is the number of elements currently allocated from the pool.
+	Used uint64
+	// Max is the highest Used seen so far.
+	Max uint64
+	// Err is the number of failed allocations.
+	Err uint64
+}
+
+var statsPools = []struct {
+	name string
+	id   C.int
+}{
+	{"tcp_pcb", C.MEMP_TCP_PCB},
+	{"tcp_pcb_listen", C.MEMP_TCP_PCB_LISTEN},
+	{"tcp_seg", C.MEMP_TCP_SEG},
+	{"udp_pcb", C.MEMP_UDP_PCB},
+	{"pbuf", C.MEMP_PBUF},
+	{"pbuf_pool", C.MEMP_PBUF_POOL},
+}
+
+// MemoryPoolStats returns the usage of the pcb and pbuf pools.
+func MemoryPoolStats() []PoolStats {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+
+	stats := make([]PoolStats, 0, len(statsPools))
+	for _, p := range statsPools {
+		s := C.memp_stats(p.id)
+		if s == nil {
+			continue
+		}
+		stats = append(stats, PoolStats{
+			Name: p.name,
+			Used: uint64(s.used),
+			Max:  uint64(s.max),
+			Err:  uint64(s.err),
+		})
+	}
+	return stats
+}
@@ -8,7 +8,6 @@ import "C"
 import (
 	"errors"
 	"fmt"
-	"log"
 	"unsafe"
 )
 
@@ -25,7 +24,7 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 	}
 
 	if tcpConnHandler == nil {
-		log.Print("must register a TCP connection handler")
+		logger().Warn("must register a TCP connection handler")
 		return C.ERR_CLSD
 	}
 
@@ -74,7 +73,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 		case LWIP_ERR_OK:
 			return C.ERR_OK
 		default:
-			log.Print("unexpected error")
+			logger().Error("unexpected error")
 			return C.ERR_ABRT
 		}
 	}
@@ -108,7 +107,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 			C.tcp_shutdown(tpcb, 1, 0)
 			return C.ERR_OK
 		default:
-			log.Print("unexpected error")
+			logger().Error("unexpected error")
 			return C.ERR_ABRT
 		}
 	}
@@ -126,7 +125,7 @@ func tcpSentFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, len C.u16_t) C.err_t
 		case LWIP_ERR_OK:
 			return C.ERR_OK
 		default:
-			log.Print("unexpected error")
+			logger().Error("unexpected error")
 			return C.ERR_ABRT
 		}
 	} else {
@@ -161,7 +160,7 @@ func tcpPollFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb) C.err_t {
 		case LWIP_ERR_OK:
 			return C.ERR_OK
 		default:
-			log.Print("unexpected error")
+			logger().Error("unexpected error")
 			return C.ERR_ABRT
 		}
 	} else {
@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"sync"
@@ -176,7 +175,7 @@ func (conn *tcpConn) receiveCheck() error {
 		conn.abortInternal()
 		return NewLWIPError(LWIP_ERR_ABRT)
 	default:
-		log.Print("unexpected error")
+		logger().Error("unexpected error")
 		return NewLWIPError(C.ERR_ABRT)
 	}
 }
@@ -250,7 +249,7 @@ func (conn *tcpConn) writeCheck() error {
 	case tcpAborting:
 		return io.ErrClosedPipe
 	default:
-		log.Print("unexpected error")
+		logger().Error("unexpected error")
 		return io.ErrShortWrite
 	}
 }
@@ -6,7 +6,6 @@ package core
 */
 import "C"
 import (
-	"log"
 	"time"
 	"unsafe"
 )
@@ -28,7 +27,7 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 	srcAddr := ParseUDPAddr(ipAddrNTOA(*addr), uint16(port))
 	dstAddr := ParseUDPAddr(ipAddrNTOA(*destAddr), uint16(destPort))
 	if srcAddr == nil || dstAddr == nil {
-		log.Print("invalid UDP address")
+		logger().Debug("invalid UDP address")
 		return
 	}
 
@@ -38,7 +37,7 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 	conn, found := udpConns.Load(connId)
 	if !found {
 		if udpConnHandler == nil {
-			log.Print("must register a UDP connection handler")
+			logger().Warn("must register a UDP connection handler")
 			return
 		}
 		var err error
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/httpconnect"
+	"tun2proxylib/mobile"
+)
+
+// Option configures the handler returned by NewTCPHandler.
+type Option func(*options)
+
+type options struct {
+	logger  *slog.Logger
+	auth    *httpconnect.Auth
+	tls     *tls.Config
+	protect mobile.ProtectSocket
+	fakeDNS dns.FakeDns
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger of the handler.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithAuth sets the Basic auth credentials sent to the proxy.
+func WithAuth(username, password string) Option {
+	return func(o *options) {
+		o.auth = &httpconnect.Auth{Username: username, Password: password}
+	}
+}
+
+// WithTLS connects to the proxy over TLS. A config without ServerName
+// verifies the proxy host.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		o.tls = cfg
+	}
+}
+
+// WithProtect protects the sockets connected to the proxy with p.
+func WithProtect(p mobile.ProtectSocket) Option {
+	return func(o *options) {
+		o.protect = p
+	}
+}
+
+// WithFakeDNS makes the handlers send flows to fake IPs of f by domain.
+func WithFakeDNS(f dns.FakeDns) Option {
+	return func(o *options) {
+		o.fakeDNS = f
+	}
+}
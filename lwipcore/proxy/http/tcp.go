@@ -0,0 +1,91 @@
+// Package http relays the TCP connections of the lwip core through an
+// HTTP proxy with CONNECT.
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/httpconnect"
+	"tun2proxylib/lwipcore/core"
+	"tun2proxylib/lwipcore/proxy"
+	"tun2proxylib/mobile"
+	"tun2proxylib/socketbase"
+)
+
+type tcpHandler struct {
+	proxyHost string
+	proxyPort uint16
+	auth      *httpconnect.Auth
+	tls       *tls.Config
+	protect   mobile.ProtectSocket
+	fakeDNS   dns.FakeDns
+	logger    *slog.Logger
+}
+
+// NewTCPHandler returns a handler tunneling every connection through
+// the HTTP proxy at proxyHost:proxyPort.
+func NewTCPHandler(proxyHost string, proxyPort uint16, opts ...Option) core.TCPConnHandler {
+	o := newOptions(opts)
+	h := &tcpHandler{
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+		auth:      o.auth,
+		tls:       o.tls,
+		protect:   o.protect,
+		fakeDNS:   o.fakeDNS,
+		logger:    o.logger,
+	}
+	if h.tls != nil && h.tls.ServerName == "" {
+		h.tls = h.tls.Clone()
+		h.tls.ServerName = proxyHost
+	}
+	return h
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	dest := dns.Target(h.fakeDNS, target.IP, target.Port)
+
+	c, err := h.dial(dest)
+	if errors.Is(err, httpconnect.ErrAuthFailed) {
+		h.logger.Warn("http proxy rejected credentials", "proxy", h.proxyHost, "err", err)
+		conn.Close()
+		return err
+	}
+	if err != nil {
+		h.logger.Debug("dial http proxy failed", "src", conn.LocalAddr(), "dst", dest, "err", err)
+		conn.Close()
+		return err
+	}
+
+	go proxy.Pipe(c, conn)
+
+	return nil
+}
+
+func (h *tcpHandler) dial(dest string) (net.Conn, error) {
+	server := core.ParseTCPAddr(h.proxyHost, h.proxyPort)
+	if server == nil {
+		return nil, errors.New("resolve http proxy failed")
+	}
+	c, err := socketbase.TcpDail(server.IP, server.Port, h.protect)
+	if err != nil {
+		return nil, err
+	}
+	if h.tls != nil {
+		tc := tls.Client(c, h.tls)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	tunnel, err := httpconnect.Handshake(c, dest, h.auth)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
@@ -0,0 +1,28 @@
+// Package proxy holds what the lwip handlers of the proxy protocols
+// share.
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Pipe copies between a and b both ways until both directions are
+// done, then closes them.
+func Pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(a, b)
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(b, a)
+		wg.Done()
+	}()
+	wg.Wait()
+}
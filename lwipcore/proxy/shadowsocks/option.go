@@ -0,0 +1,51 @@
+package shadowsocks
+
+import (
+	"log/slog"
+
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/mobile"
+)
+
+// Option configures the handlers returned by NewTCPHandler and
+// NewUDPHandler.
+type Option func(*options)
+
+type options struct {
+	logger  *slog.Logger
+	protect mobile.ProtectSocket
+	fakeDNS dns.FakeDns
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger of a handler.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithProtect protects the sockets connected to the server with p.
+func WithProtect(p mobile.ProtectSocket) Option {
+	return func(o *options) {
+		o.protect = p
+	}
+}
+
+// WithFakeDNS makes the UDP handler answer A and AAAA queries with
+// fake IPs of f, and both handlers put the domain of a fake IP in the
+// Shadowsocks target address, for the server to resolve.
+func WithFakeDNS(f dns.FakeDns) Option {
+	return func(o *options) {
+		o.fakeDNS = f
+	}
+}
@@ -0,0 +1,71 @@
+// Package shadowsocks relays the flows of the lwip core through a
+// Shadowsocks server.
+package shadowsocks
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"tun2proxylib/lwipcore/common/dns"
+	ss "tun2proxylib/lwipcore/common/shadowsocks"
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/lwipcore/core"
+	"tun2proxylib/lwipcore/proxy"
+	"tun2proxylib/mobile"
+	"tun2proxylib/socketbase"
+)
+
+type tcpHandler struct {
+	proxyHost string
+	proxyPort uint16
+	cipher    *ss.Cipher
+	protect   mobile.ProtectSocket
+	fakeDNS   dns.FakeDns
+	logger    *slog.Logger
+}
+
+// NewTCPHandler returns a handler relaying every connection through the
+// Shadowsocks server at proxyHost:proxyPort.
+func NewTCPHandler(proxyHost string, proxyPort uint16, cipher *ss.Cipher, opts ...Option) core.TCPConnHandler {
+	o := newOptions(opts)
+	return &tcpHandler{
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+		cipher:    cipher,
+		protect:   o.protect,
+		fakeDNS:   o.fakeDNS,
+		logger:    o.logger,
+	}
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	dest := dns.Target(h.fakeDNS, target.IP, target.Port)
+
+	c, err := h.dial(dest)
+	if err != nil {
+		h.logger.Debug("dial shadowsocks server failed", "src", conn.LocalAddr(), "dst", dest, "err", err)
+		conn.Close()
+		return err
+	}
+
+	go proxy.Pipe(c, conn)
+
+	return nil
+}
+
+func (h *tcpHandler) dial(dest string) (net.Conn, error) {
+	server := core.ParseTCPAddr(h.proxyHost, h.proxyPort)
+	if server == nil {
+		return nil, errors.New("resolve shadowsocks server failed")
+	}
+	c, err := socketbase.TcpDail(server.IP, server.Port, h.protect)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := h.cipher.StreamConn(c, socks5.ParseAddr(dest))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
+}
@@ -0,0 +1,186 @@
+package shadowsocks
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+	"tun2proxylib/lwipcore/common/dns"
+	ss "tun2proxylib/lwipcore/common/shadowsocks"
+	"tun2proxylib/lwipcore/core"
+	"tun2proxylib/mobile"
+	"tun2proxylib/socketbase"
+)
+
+const defaultUDPTimeout = 60 * time.Second
+
+type udpHandler struct {
+	sync.Mutex
+
+	proxyHost string
+	proxyPort uint16
+	cipher    *ss.Cipher
+	timeout   time.Duration
+	protect   mobile.ProtectSocket
+	fakeDNS   dns.FakeDns
+	logger    *slog.Logger
+
+	conns map[core.UDPConn]*relay
+}
+
+// relay is the server session of a local UDP socket.
+type relay struct {
+	net.PacketConn
+
+	// fakes maps a port to the fake IP destination last sent to on it.
+	// Servers answer from the address the domain resolved to, replies
+	// on those ports are written back from the fake one.
+	mu    sync.Mutex
+	fakes map[int]*net.UDPAddr
+}
+
+func (r *relay) addFake(addr *net.UDPAddr) {
+	r.mu.Lock()
+	if r.fakes == nil {
+		r.fakes = make(map[int]*net.UDPAddr)
+	}
+	r.fakes[addr.Port] = addr
+	r.mu.Unlock()
+}
+
+func (r *relay) source(from *net.UDPAddr) *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fake, ok := r.fakes[from.Port]; ok {
+		return fake
+	}
+	return from
+}
+
+// hostAddr is a domain destination, the server resolves it.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "udp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// NewUDPHandler returns a handler relaying datagrams through the
+// Shadowsocks server at proxyHost:proxyPort. A relay idle for timeout,
+// 60s by default, is closed.
+func NewUDPHandler(proxyHost string, proxyPort uint16, cipher *ss.Cipher, timeout time.Duration, opts ...Option) core.UDPConnHandler {
+	o := newOptions(opts)
+	if timeout <= 0 {
+		timeout = defaultUDPTimeout
+	}
+	return &udpHandler{
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+		cipher:    cipher,
+		timeout:   timeout,
+		protect:   o.protect,
+		fakeDNS:   o.fakeDNS,
+		logger:    o.logger,
+		conns:     make(map[core.UDPConn]*relay, 8),
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	server := core.ParseUDPAddr(h.proxyHost, h.proxyPort)
+	if server == nil {
+		return errors.New("resolve shadowsocks server failed")
+	}
+	c, err := socketbase.UdpDail(server.IP, server.Port, h.protect)
+	if err != nil {
+		h.logger.Debug("dial shadowsocks server failed", "src", conn.LocalAddr(), "err", err)
+		return err
+	}
+	pc, err := h.cipher.PacketConn(c)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	r := &relay{PacketConn: pc}
+
+	h.Lock()
+	if old, ok := h.conns[conn]; ok {
+		old.Close()
+	}
+	h.conns[conn] = r
+	h.Unlock()
+
+	go h.fetch(conn, r)
+	return nil
+}
+
+// fetch writes the replies of the server back to the tun.
+func (h *udpHandler) fetch(conn core.UDPConn, r *relay) {
+	defer func() {
+		r.Close()
+		// A new Connect may have replaced r already.
+		h.Lock()
+		current := h.conns[conn] == r
+		h.Unlock()
+		if current {
+			h.Close(conn)
+		}
+	}()
+
+	buf := core.NewBytes(core.BufSize)
+	defer core.FreeBytes(buf)
+	for {
+		r.SetReadDeadline(time.Now().Add(h.timeout))
+		n, from, err := r.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.WriteFrom(buf[:n], r.source(from.(*net.UDPAddr))); err != nil {
+			h.logger.Debug("write tun failed", "src", conn.LocalAddr(), "err", err)
+			return
+		}
+	}
+}
+
+// ReceiveTo will be called when data arrives from TUN.
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	r, ok := h.conns[conn]
+	h.Unlock()
+	if !ok {
+		h.Close(conn)
+		return errors.New("can not find remote address")
+	}
+
+	if addr.Port == dns.COMMON_DNS_PORT && h.fakeDNS != nil {
+		if resp, err := h.fakeDNS.GenerateFakeResponse(data); err == nil {
+			if _, err := conn.WriteFrom(resp, addr); err != nil {
+				h.Close(conn)
+				h.logger.Debug("write fake dns answer failed", "src", conn.LocalAddr(), "err", err)
+				return err
+			}
+			return nil
+		}
+	}
+	var dest net.Addr = addr
+	if h.fakeDNS != nil && h.fakeDNS.IsFakeIP(addr.IP) {
+		dest = hostAddr(dns.Target(h.fakeDNS, addr.IP, addr.Port))
+		r.addFake(addr)
+	}
+
+	if _, err := r.WriteTo(data, dest); err != nil {
+		h.Close(conn)
+		h.logger.Debug("write to shadowsocks server failed", "src", conn.LocalAddr(), "err", err)
+		return err
+	}
+	return nil
+}
+
+func (h *udpHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+	if r, ok := h.conns[conn]; ok {
+		r.Close()
+		delete(h.conns, conn)
+	}
+}
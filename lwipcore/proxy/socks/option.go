@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/udppackage"
+)
+
+// Option configures the handlers returned by NewTCPHandler and
+// NewUDPHandler.
+type Option func(*options)
+
+type options struct {
+	logger    *slog.Logger
+	auth      *socks5.Auth
+	fakeDNS   dns.FakeDns
+	relayDial func(ctx context.Context, address string) (net.Conn, error)
+	version   uint8
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: slog.Default(), version: udppackage.V1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger of a handler. Per packet events are logged
+// at debug level only.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithAuth sets the RFC 1929 credentials the TCP handler sends to the
+// SOCKS5 server.
+func WithAuth(username, password string) Option {
+	return func(o *options) {
+		o.auth = &socks5.Auth{Username: username, Password: password}
+	}
+}
+
+// WithFakeDNS makes the handlers send flows to fake IPs of f by domain
+// and answer A and AAAA queries with fake IPs. The UDP handler needs
+// WithRelayVersion(udppackage.V2) to send a domain to the relay.
+func WithFakeDNS(f dns.FakeDns) Option {
+	return func(o *options) {
+		o.fakeDNS = f
+	}
+}
+
+// WithRelayDial sets how the UDP handler connects to the relay, e.g.
+// with the Dialer of udprelay to fall back to TCP. Each Read and Write
+// of the conns returned is one udppackage frame. Plain UDP by default.
+func WithRelayDial(dial func(ctx context.Context, address string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.relayDial = dial
+	}
+}
+
+// WithRelayVersion sets the udppackage version of the frames the UDP
+// handler sends, udppackage.V1 by default. Only V2 carries a domain.
+func WithRelayVersion(v uint8) Option {
+	return func(o *options) {
+		if v != 0 {
+			o.version = v
+		}
+	}
+}
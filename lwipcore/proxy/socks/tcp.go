@@ -1,13 +1,14 @@
 package socks
 
 import (
-	"io"
+	"errors"
+	"log/slog"
 	"net"
-	"strconv"
 	"sync"
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/socks5"
 	"tun2proxylib/lwipcore/core"
-
-	"golang.org/x/net/proxy"
+	"tun2proxylib/lwipcore/proxy"
 )
 
 type tcpHandler struct {
@@ -15,52 +16,42 @@ type tcpHandler struct {
 
 	proxyHost string
 	proxyPort uint16
+	auth      *socks5.Auth
+	fakeDNS   dns.FakeDns
+	logger    *slog.Logger
 }
 
 // NewTCPHandler ...
-func NewTCPHandler(proxyHost string, proxyPort uint16) core.TCPConnHandler {
+func NewTCPHandler(proxyHost string, proxyPort uint16, opts ...Option) core.TCPConnHandler {
+	o := newOptions(opts)
 	return &tcpHandler{
 		proxyHost: proxyHost,
 		proxyPort: proxyPort,
+		auth:      o.auth,
+		fakeDNS:   o.fakeDNS,
+		logger:    o.logger,
 	}
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
-	if err != nil {
+	server := core.ParseTCPAddr(h.proxyHost, h.proxyPort).String()
+
+	// Fake IPs are sent to the proxy as the domain they stand for.
+	dest := dns.Target(h.fakeDNS, target.IP, target.Port)
+
+	c, err := socks5.Dial(net.Dial, server, dest, h.auth)
+	if errors.Is(err, socks5.ErrAuthFailed) {
+		h.logger.Warn("socks proxy rejected credentials", "proxy", server, "err", err)
 		conn.Close()
 		return err
 	}
-
-	// Replace with a domain name if target address IP is a fake IP.
-	targetHost := target.IP.String()
-
-	dest := net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
-
-	c, err := dialer.Dial(target.Network(), dest)
 	if err != nil {
+		h.logger.Debug("dial socks proxy failed", "src", conn.LocalAddr(), "dst", dest, "err", err)
 		conn.Close()
 		return err
 	}
 
-	go h.pipe(c, conn)
+	go proxy.Pipe(c, conn)
 
 	return nil
 }
-
-func (h *tcpHandler) pipe(dst net.Conn, src net.Conn) {
-	defer dst.Close()
-	defer src.Close()
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		io.Copy(dst, src)
-		wg.Done()
-	}()
-	go func() {
-		io.Copy(src, dst)
-		wg.Done()
-	}()
-	wg.Wait()
-}
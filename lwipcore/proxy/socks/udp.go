@@ -1,8 +1,9 @@
 package socks
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 	"strconv"
 	"sync"
@@ -21,7 +22,11 @@ type udpHandler struct {
 	udpSocks  map[core.UDPConn]net.Conn
 	timeout   time.Duration
 
-	dnsCache *cache.DNSCache
+	dnsCache  *cache.DNSCache
+	fakeDNS   dns.FakeDns
+	relayDial func(ctx context.Context, address string) (net.Conn, error)
+	version   uint8
+	logger    *slog.Logger
 }
 
 const timeoutSecond = 30 * 60 * 12 // 30 minutes
@@ -33,15 +38,20 @@ var (
 )
 
 // NewUDPHandler ...
-func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration, dnsCache *cache.DNSCache) core.UDPConnHandler {
+func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration, dnsCache *cache.DNSCache, opts ...Option) core.UDPConnHandler {
+	o := newOptions(opts)
 
 	once.Do(initTimer)
 	return &udpHandler{
 		proxyHost: proxyHost,
 		proxyPort: proxyPort,
 		dnsCache:  dnsCache,
+		fakeDNS:   o.fakeDNS,
 		timeout:   timeout,
 		udpSocks:  make(map[core.UDPConn]net.Conn, 8),
+		relayDial: o.relayDial,
+		version:   o.version,
+		logger:    o.logger,
 	}
 }
 
@@ -79,9 +89,15 @@ func settimeout(con net.Conn, second time.Duration) {
 // Connect ...
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 	dest := net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort)))
-	remoteCon, err := net.Dial("udp", dest)
+	var remoteCon net.Conn
+	var err error
+	if h.relayDial != nil {
+		remoteCon, err = h.relayDial(context.Background(), dest)
+	} else {
+		remoteCon, err = net.Dial("udp", dest)
+	}
 	if err != nil || target == nil {
-		log.Println("socks connect failed:", err, dest)
+		h.logger.Debug("dial udp relay failed", "relay", dest, "err", err)
 		return err
 	}
 
@@ -113,25 +129,25 @@ func (h *udpHandler) fetchSocksData(conn core.UDPConn, remoteConn net.Conn, targ
 
 	n, err := remoteConn.Read(buf)
 	if err != nil {
-		log.Println(err, "read from socks failed")
+		h.logger.Debug("read from udp relay failed", "src", conn.LocalAddr(), "err", err)
 		return
 	}
 
 	raw := buf[:n]
 	_, _, payload, err := udppackage.UnpackUDPData(raw)
 	if err != nil {
-		log.Println(err, "unpack udp data failed!!")
+		h.logger.Debug("unpack udp data failed", "src", conn.LocalAddr(), "err", err)
 		return
 	}
 
 	_, err = conn.WriteFrom(payload, target)
 	if err != nil {
-		log.Println(err, "write tun failed!!")
+		h.logger.Debug("write tun failed", "src", conn.LocalAddr(), "err", err)
 		return
 	}
 
-	if target.Port == dns.COMMON_DNS_PORT {
-		h.dnsCache.Store(raw)
+	if target.Port == dns.COMMON_DNS_PORT && h.dnsCache != nil {
+		h.dnsCache.Store(payload)
 	}
 }
 
@@ -142,38 +158,58 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	h.Unlock()
 	if !ok {
 		h.Close(conn)
-		log.Println("can not find remote address <-->", conn.LocalAddr().String())
+		h.logger.Debug("no udp relay for connection", "src", conn.LocalAddr())
 		return errors.New("can not find remote address")
 	}
 
-	if addr.Port == dns.COMMON_DNS_PORT {
-		if answer := h.dnsCache.Query(data); answer != nil {
-			var buf [1024]byte
-			resp, _ := answer.PackBuffer(buf[:])
+	if addr.Port == dns.COMMON_DNS_PORT && h.fakeDNS != nil {
+		if resp, err := h.fakeDNS.GenerateFakeResponse(data); err == nil {
+			if _, err := conn.WriteFrom(resp, addr); err != nil {
+				h.Close(conn)
+				h.logger.Debug("write fake dns answer failed", "src", conn.LocalAddr(), "err", err)
+				return err
+			}
+			return nil
+		}
+	}
+	p := udppackage.Packet{Version: h.version, Target: addr, Source: conn.LocalAddr(), Payload: data}
+	if h.fakeDNS != nil && h.fakeDNS.IsFakeIP(addr.IP) {
+		// The domain is left to the relay, only V2 has room for it.
+		if h.version != udppackage.V2 {
+			h.logger.Warn("drop datagram to fake IP, the relay needs version 2", "src", conn.LocalAddr(), "dst", addr)
+			return nil
+		}
+		if err := p.SetTarget(dns.Target(h.fakeDNS, addr.IP, addr.Port)); err != nil {
+			h.logger.Debug("invalid fake IP target", "src", conn.LocalAddr(), "dst", addr, "err", err)
+			return nil
+		}
+	}
+
+	if addr.Port == dns.COMMON_DNS_PORT && h.dnsCache != nil {
+		if resp := h.dnsCache.Query(data); resp != nil {
 			_, err := conn.WriteFrom(resp, addr)
 			if err != nil {
 				h.Close(conn)
-				log.Printf("write dns answer failed: %v", err)
+				h.logger.Debug("write dns answer failed", "src", conn.LocalAddr(), "err", err)
 				return errors.New("write remote failed")
 			}
 			return nil
 		}
 	}
 
-	full, err := udppackage.PackUDPData(addr, conn.LocalAddr(), data)
+	full, err := p.Marshal()
 	if err != nil {
 		h.Close(conn)
-		log.Println("pack udp data failed", err)
+		h.logger.Debug("pack udp data failed", "src", conn.LocalAddr(), "err", err)
 		return errors.New("pack udp data failed")
 	}
 
-	n, err := udpsocks.Write(full)
+	_, err = udpsocks.Write(full)
 	if err != nil {
 		h.Close(conn)
-		log.Println("write to proxy failed", err)
+		h.logger.Debug("write to udp relay failed", "src", conn.LocalAddr(), "err", err)
 		return errors.New("write to proxy failed")
 	}
-	log.Println("write bytes n", n)
 	return nil
 }
 
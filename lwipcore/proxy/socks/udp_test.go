@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"tun2proxylib/lwipcore/common/dns/fakedns"
+	"tun2proxylib/udppackage"
+	"tun2proxylib/udprelay"
+
+	mdns "github.com/miekg/dns"
+)
+
+// udpConn is a UDP flow of the lwip core, its replies go to out.
+type udpConn struct {
+	local *net.UDPAddr
+	out   chan string
+}
+
+func (c *udpConn) LocalAddr() *net.UDPAddr                        { return c.local }
+func (c *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+func (c *udpConn) Close() error                                   { return nil }
+
+func (c *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.out <- string(data)
+	return len(data), nil
+}
+
+// fakeIP returns the fake IP f hands out for name.
+func fakeIP(t *testing.T, f *fakedns.FakeDNS, name string) net.IP {
+	req := new(mdns.Msg)
+	req.SetQuestion(mdns.Fqdn(name), mdns.TypeA)
+	b, _ := req.Pack()
+	out, err := f.GenerateFakeResponse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(mdns.Msg)
+	if err := resp.Unpack(out); err != nil || len(resp.Answer) != 1 {
+		t.Fatal("unexpected answer", resp, err)
+	}
+	return resp.Answer[0].(*mdns.A).A
+}
+
+func TestFakeIPUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go (&udprelay.Server{}).ServeUDP(relay)
+
+	f, _ := fakedns.New()
+	target := &net.UDPAddr{IP: fakeIP(t, f, "localhost"), Port: echo.LocalAddr().(*net.UDPAddr).Port}
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	for _, c := range []struct {
+		version uint8
+		reply   bool
+	}{
+		// V1 has no room for the domain, the datagram is dropped.
+		{udppackage.V1, false},
+		{udppackage.V2, true},
+	} {
+		h := NewUDPHandler("127.0.0.1", uint16(relayAddr.Port), 5*time.Second, nil, WithFakeDNS(f), WithRelayVersion(c.version))
+		conn := &udpConn{local: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}, out: make(chan string, 1)}
+		if err := h.Connect(conn, target); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ReceiveTo(conn, []byte("ping"), target); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-conn.out:
+			if !c.reply || got != "ping" {
+				t.Fatal("version", c.version, "unexpected reply", got)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if c.reply {
+				t.Fatal("version", c.version, "no reply")
+			}
+		}
+		h.(*udpHandler).Close(conn)
+	}
+}
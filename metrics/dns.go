@@ -0,0 +1,20 @@
+package metrics
+
+import (
+	"tun2proxylib/lwipcore/common/dns/cache"
+)
+
+// DNSCacheCollector exports the lookup counters and size of c.
+func DNSCacheCollector(c *cache.DNSCache) Collector {
+	return CollectorFunc(func(w *Writer) {
+		st := c.Stats()
+		w.Counter("tun2proxy_dns_cache_lookups_total", "DNS cache lookups.",
+			st.Hits, "result", "hit")
+		w.Counter("tun2proxy_dns_cache_lookups_total", "DNS cache lookups.",
+			st.Misses, "result", "miss")
+		w.Counter("tun2proxy_dns_cache_evictions_total", "Responses evicted from the DNS cache to make room.",
+			st.Evictions)
+		w.Gauge("tun2proxy_dns_cache_entries", "Responses held by the DNS cache.",
+			float64(st.Entries))
+	})
+}
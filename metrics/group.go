@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"tun2proxylib/outbound"
+)
+
+// Group is an outbound group, an outbound.Failover or Balancer.
+type Group interface {
+	String() string
+	Status() []outbound.MemberStatus
+}
+
+// GroupCollector exports the health and flows of the members of g.
+func GroupCollector(g Group) Collector {
+	return CollectorFunc(func(w *Writer) {
+		for _, m := range g.Status() {
+			up := 0.0
+			if m.Up {
+				up = 1
+			}
+			w.Gauge("tun2proxy_outbound_up", "Whether a group member is considered up.",
+				up, "group", g.String(), "member", m.Name)
+			w.Gauge("tun2proxy_outbound_consecutive_failures", "Dial failures in a row through a group member.",
+				float64(m.Fails), "group", g.String(), "member", m.Name)
+			w.Gauge("tun2proxy_outbound_active_flows", "Open flows through a group member.",
+				float64(m.Active), "group", g.String(), "member", m.Name)
+			w.Counter("tun2proxy_outbound_flows_total", "Flows carried by a group member.",
+				m.Flows, "group", g.String(), "member", m.Name)
+		}
+	})
+}
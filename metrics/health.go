@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"tun2proxylib/health"
+)
+
+// HealthCollector exports the results of the last checks of p.
+func HealthCollector(p *health.Prober) Collector {
+	return CollectorFunc(func(w *Writer) {
+		for _, st := range p.Status() {
+			up := 0.0
+			if st.Up {
+				up = 1
+			}
+			w.Gauge("tun2proxy_health_up", "Whether the last health check of an outbound succeeded.",
+				up, "outbound", st.Name)
+			w.Gauge("tun2proxy_health_latency_seconds", "Connection and handshake time of the last health check.",
+				st.Latency.Seconds(), "outbound", st.Name)
+			w.Gauge("tun2proxy_health_http_latency_seconds", "Time to the response headers of the health check URL.",
+				st.HTTPLatency.Seconds(), "outbound", st.Name)
+			w.Gauge("tun2proxy_health_udp_latency_seconds", "Mean round trip of the health check UDP echoes.",
+				st.UDPLatency.Seconds(), "outbound", st.Name)
+			w.Gauge("tun2proxy_health_udp_loss_ratio", "Fraction of the health check UDP echoes lost.",
+				st.Loss, "outbound", st.Name)
+		}
+	})
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"tun2proxylib/lwipcore/core"
+)
+
+// LWIPCollector exports the pcb and pbuf pool usage of lwIP.
+func LWIPCollector() Collector {
+	return CollectorFunc(func(w *Writer) {
+		stats := core.MemoryPoolStats()
+		for _, s := range stats {
+			w.Gauge("tun2proxy_lwip_pool_used", "Elements allocated from an lwIP memory pool.",
+				float64(s.Used), "pool", s.Name)
+		}
+		for _, s := range stats {
+			w.Gauge("tun2proxy_lwip_pool_max", "Highest number of elements allocated from an lwIP memory pool.",
+				float64(s.Max), "pool", s.Name)
+		}
+		for _, s := range stats {
+			w.Counter("tun2proxy_lwip_pool_errors_total", "Failed allocations from an lwIP memory pool.",
+				s.Err, "pool", s.Name)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+// Package metrics exports the counters and gauges of the tunnel in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes a group of metrics on every scrape.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc adapts a function to a Collector.
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Registry holds the collectors to be scraped. It implements
+// http.Handler so it can be mounted on any mux.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// WriteTo writes all metrics to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	mw := &Writer{families: make(map[string]*family)}
+	for _, c := range collectors {
+		c.Collect(mw)
+	}
+	var buf bytes.Buffer
+	for _, f := range mw.order {
+		buf.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		buf.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		f.samples.WriteTo(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Writer formats samples. The samples of a metric are kept together
+// under its HELP and TYPE lines, taken from the first one, whichever
+// collectors write them.
+type Writer struct {
+	families map[string]*family
+	order    []*family
+}
+
+// family is a metric and its samples.
+type family struct {
+	name, help, typ string
+	samples         bytes.Buffer
+}
+
+// Counter writes a sample of a monotonically increasing value. labels
+// are given as name, value pairs.
+func (w *Writer) Counter(name, help string, value uint64, labels ...string) {
+	w.sample(name, help, "counter", strconv.FormatUint(value, 10), labels)
+}
+
+// Gauge writes a sample of a value that can go up and down.
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.sample(name, help, "gauge", strconv.FormatFloat(value, 'g', -1, 64), labels)
+}
+
+func (w *Writer) sample(name, help, typ, value string, labels []string) {
+	f := w.families[name]
+	if f == nil {
+		f = &family{name: name, help: help, typ: typ}
+		w.families[name] = f
+		w.order = append(w.order, f)
+	}
+	b := &f.samples
+	b.WriteString(name)
+	if len(labels) > 1 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteString(" " + value + "\n")
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tun2proxylib/gvisorcore/proxy"
+	"tun2proxylib/health"
+	"tun2proxylib/outbound"
+	"tun2proxylib/tracker"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+type group struct {
+	name    string
+	members []outbound.MemberStatus
+}
+
+func (g *group) String() string                  { return g.name }
+func (g *group) Status() []outbound.MemberStatus { return g.members }
+
+// golden compares the scrape of r with testdata/name.
+func golden(t *testing.T, name string, r *Registry) {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("scrape differs from %s:\n%s", path, buf.Bytes())
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	s := stack.New(stack.Options{})
+	defer s.Destroy()
+
+	p := &health.Prober{Targets: []health.Target{{Name: "socks"}, {Name: "relay"}}}
+	p.CheckAll(t.Context())
+
+	r := NewRegistry()
+	r.Register(StackCollector(func() *stack.Stack { return s }))
+	r.Register(StackCollector(func() *stack.Stack { return nil }))
+	r.Register(LWIPCollector())
+	r.Register(ProxyCollector(&proxy.DefaultProxy{}))
+	r.Register(TrackerCollector(tracker.New()))
+	r.Register(GroupCollector(&group{"auto", []outbound.MemberStatus{
+		{Name: `a "1"`, Up: true, Active: 2, Flows: 7},
+		{Name: "b", Fails: 3, Flows: 1},
+	}}))
+	r.Register(GroupCollector(&group{"udp", []outbound.MemberStatus{{Name: "relay", Up: true}}}))
+	r.Register(HealthCollector(p))
+	golden(t, "registry.txt", r)
+}
+
+func TestSharedFamily(t *testing.T) {
+	// The proxy and direct handlers both export the dial counters.
+	r := NewRegistry()
+	for _, name := range []string{"proxy", "direct"} {
+		r.Register(CollectorFunc(func(w *Writer) {
+			w.Counter("test_dials_total", "Dials.", 1, "handler", name)
+			w.Gauge("test_flows", "Flows.", 2, "handler", name)
+		}))
+	}
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	t.Log(buf.String())
+	want := `# HELP test_dials_total Dials.
+# TYPE test_dials_total counter
+test_dials_total{handler="proxy"} 1
+test_dials_total{handler="direct"} 1
+# HELP test_flows Flows.
+# TYPE test_flows gauge
+test_flows{handler="proxy"} 2
+test_flows{handler="direct"} 2
+`
+	if buf.String() != want {
+		t.Fatal("samples of a family not grouped")
+	}
+}
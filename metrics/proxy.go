@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"tun2proxylib/gvisorcore/proxy"
+	"tun2proxylib/tracker"
+)
+
+// ProxyCollector exports the dial counters of a DefaultProxy.
+func ProxyCollector(p *proxy.DefaultProxy) Collector {
+	return CollectorFunc(func(w *Writer) {
+		st := p.Stats()
+		w.Counter("tun2proxy_proxy_dials_total", "Outbound dials made by the proxy.",
+			st.TCPDialSuccess, "network", "tcp", "result", "success")
+		w.Counter("tun2proxy_proxy_dials_total", "Outbound dials made by the proxy.",
+			st.TCPDialFailure, "network", "tcp", "result", "failure")
+		w.Counter("tun2proxy_proxy_dials_total", "Outbound dials made by the proxy.",
+			st.TCPAuthFailure, "network", "tcp", "result", "auth_failure")
+		w.Counter("tun2proxy_proxy_dials_total", "Outbound dials made by the proxy.",
+			st.UDPDialSuccess, "network", "udp", "result", "success")
+		w.Counter("tun2proxy_proxy_dials_total", "Outbound dials made by the proxy.",
+			st.UDPDialFailure, "network", "udp", "result", "failure")
+	})
+}
+
+// TrackerCollector exports the live flows and relayed bytes seen by t.
+func TrackerCollector(t *tracker.Tracker) Collector {
+	return CollectorFunc(func(w *Writer) {
+		tcp, udp := t.Len()
+		w.Gauge("tun2proxy_active_flows", "Flows currently going through the tunnel.",
+			float64(tcp), "network", "tcp")
+		w.Gauge("tun2proxy_active_flows", "Flows currently going through the tunnel.",
+			float64(udp), "network", "udp")
+
+		upload, download := t.Traffic()
+		w.Counter("tun2proxy_relay_bytes_total", "Bytes relayed between local clients and outbounds.",
+			upload, "direction", "upload")
+		w.Counter("tun2proxy_relay_bytes_total", "Bytes relayed between local clients and outbounds.",
+			download, "direction", "download")
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// StackCollector exports the statistics of a gVisor stack. get is called
+// on every scrape and may return nil while no stack is running, e.g.
+// Engine.Stack.
+func StackCollector(get func() *stack.Stack) Collector {
+	return CollectorFunc(func(w *Writer) {
+		s := get()
+		if s == nil {
+			return
+		}
+		st := s.Stats()
+
+		w.Counter("tun2proxy_stack_dropped_packets_total",
+			"Packets dropped by the stack.", st.DroppedPackets.Value())
+
+		ip := st.IP
+		w.Counter("tun2proxy_stack_ip_packets_received_total",
+			"IP packets received from the link layer.", ip.PacketsReceived.Value())
+		w.Counter("tun2proxy_stack_ip_packets_delivered_total",
+			"IP packets delivered to the transport layer.", ip.PacketsDelivered.Value())
+		w.Counter("tun2proxy_stack_ip_packets_sent_total",
+			"IP packets sent to the link layer.", ip.PacketsSent.Value())
+		w.Counter("tun2proxy_stack_ip_malformed_packets_received_total",
+			"IP packets dropped because of an invalid header.", ip.MalformedPacketsReceived.Value())
+		w.Counter("tun2proxy_stack_ip_outgoing_packet_errors_total",
+			"IP packets that failed to be written.", ip.OutgoingPacketErrors.Value())
+
+		tcp := st.TCP
+		w.Gauge("tun2proxy_stack_tcp_established",
+			"TCP connections in ESTABLISHED or CLOSE-WAIT state.", float64(tcp.CurrentEstablished.Value()))
+		w.Counter("tun2proxy_stack_tcp_passive_openings_total",
+			"TCP connections accepted from the tun device.", tcp.PassiveConnectionOpenings.Value())
+		w.Counter("tun2proxy_stack_tcp_failed_connection_attempts_total",
+			"TCP connection attempts that failed.", tcp.FailedConnectionAttempts.Value())
+		w.Counter("tun2proxy_stack_tcp_segments_received_total",
+			"Valid TCP segments received.", tcp.ValidSegmentsReceived.Value())
+		w.Counter("tun2proxy_stack_tcp_segments_sent_total",
+			"TCP segments sent.", tcp.SegmentsSent.Value())
+		w.Counter("tun2proxy_stack_tcp_retransmits_total",
+			"TCP segments retransmitted.", tcp.Retransmits.Value())
+		w.Counter("tun2proxy_stack_tcp_timeouts_total",
+			"TCP retransmission timer expirations.", tcp.Timeouts.Value())
+		w.Counter("tun2proxy_stack_tcp_resets_sent_total",
+			"TCP segments sent with the RST flag.", tcp.ResetsSent.Value())
+		w.Counter("tun2proxy_stack_tcp_resets_received_total",
+			"TCP segments received with the RST flag.", tcp.ResetsReceived.Value())
+		w.Counter("tun2proxy_stack_tcp_listen_overflow_syn_drop_total",
+			"TCP SYNs dropped because the accept queue was full.", tcp.ListenOverflowSynDrop.Value())
+
+		udp := st.UDP
+		w.Counter("tun2proxy_stack_udp_packets_received_total",
+			"UDP datagrams received.", udp.PacketsReceived.Value())
+		w.Counter("tun2proxy_stack_udp_packets_sent_total",
+			"UDP datagrams sent.", udp.PacketsSent.Value())
+		w.Counter("tun2proxy_stack_udp_receive_buffer_errors_total",
+			"UDP datagrams dropped because the receive buffer was full.", udp.ReceiveBufferErrors.Value())
+		w.Counter("tun2proxy_stack_udp_malformed_packets_received_total",
+			"UDP datagrams dropped because of an invalid header.", udp.MalformedPacketsReceived.Value())
+
+		v4, v6 := st.ICMP.V4, st.ICMP.V6
+		w.Counter("tun2proxy_stack_icmp_echo_requests_received_total",
+			"ICMP echo requests received.", v4.PacketsReceived.EchoRequest.Value(), "version", "4")
+		w.Counter("tun2proxy_stack_icmp_echo_requests_received_total",
+			"ICMP echo requests received.", v6.PacketsReceived.EchoRequest.Value(), "version", "6")
+		w.Counter("tun2proxy_stack_icmp_echo_replies_sent_total",
+			"ICMP echo replies sent.", v4.PacketsSent.EchoReply.Value(), "version", "4")
+		w.Counter("tun2proxy_stack_icmp_echo_replies_sent_total",
+			"ICMP echo replies sent.", v6.PacketsSent.EchoReply.Value(), "version", "6")
+		w.Counter("tun2proxy_stack_icmp_dropped_total",
+			"ICMP packets that could not be sent.", v4.PacketsSent.Dropped.Value(), "version", "4")
+		w.Counter("tun2proxy_stack_icmp_dropped_total",
+			"ICMP packets that could not be sent.", v6.PacketsSent.Dropped.Value(), "version", "6")
+		w.Counter("tun2proxy_stack_icmp_rate_limited_total",
+			"ICMP packets not sent because of rate limiting.", v4.PacketsSent.RateLimited.Value(), "version", "4")
+		w.Counter("tun2proxy_stack_icmp_rate_limited_total",
+			"ICMP packets not sent because of rate limiting.", v6.PacketsSent.RateLimited.Value(), "version", "6")
+	})
+}
@@ -0,0 +1,81 @@
+// Package mux carries many streams over one connection, in the framing
+// of yamux: every frame has a 12 byte header with the stream it belongs
+// to, streams have a flow control window and the session is kept alive
+// with pings.
+//
+// On top of the streams it speaks a small proxy protocol, see Server,
+// Session.Connect and Session.Associate.
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	protoVersion = 0
+	headerSize   = 12
+
+	// initialWindow is the receive window every stream starts with,
+	// larger ones are announced by a window update.
+	initialWindow = 256 << 10
+
+	// maxFrame bounds the payload of the data frames sent.
+	maxFrame = 32 << 10
+)
+
+type frameType uint8
+
+const (
+	typeData frameType = iota
+	typeWindowUpdate
+	typePing
+	typeGoAway
+)
+
+// Frame flags, SYN opens a stream, ACK accepts it, FIN half closes it
+// and RST resets it. SYN and ACK tell ping requests from replies.
+const (
+	flagSYN uint16 = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+// header is the header of a frame:
+//
+//	version(1) | type(1) | flags(2) | stream id(4) | length(4)
+//
+// length is the payload size of a data frame, the window increment of
+// a window update, the opaque value of a ping and the code of a go
+// away.
+type header [headerSize]byte
+
+func newHeader(t frameType, flags uint16, id, length uint32) header {
+	var h header
+	h[0] = protoVersion
+	h[1] = byte(t)
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint32(h[4:], id)
+	binary.BigEndian.PutUint32(h[8:], length)
+	return h
+}
+
+func (h *header) typ() frameType { return frameType(h[1]) }
+func (h *header) flags() uint16  { return binary.BigEndian.Uint16(h[2:]) }
+func (h *header) stream() uint32 { return binary.BigEndian.Uint32(h[4:]) }
+func (h *header) length() uint32 { return binary.BigEndian.Uint32(h[8:]) }
+func (h *header) String() string {
+	return fmt.Sprintf("type %d flags %#x stream %d length %d", h.typ(), h.flags(), h.stream(), h.length())
+}
+
+// check validates the fixed fields of h.
+func (h *header) check() error {
+	if h[0] != protoVersion {
+		return fmt.Errorf("mux: unsupported version %d", h[0])
+	}
+	if h.typ() > typeGoAway {
+		return fmt.Errorf("mux: unknown frame type %d", h.typ())
+	}
+	return nil
+}
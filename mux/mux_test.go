@@ -0,0 +1,240 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+func pair(t *testing.T) (client, server *Session) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server = ClientSession(c, nil), ServerSession(s, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair(t)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	// More data than the window of a stream, on several streams at once.
+	data := make([]byte, 3*DefaultWindow)
+	rand.Read(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Error("stream", st.ID(), "echoed", len(got), "bytes", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rtt, err := client.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("rtt", rtt)
+	deadline := time.Now().Add(2 * time.Second)
+	for client.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal(client.NumStreams(), "streams left")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, _ := pair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var ne net.Error
+	if _, err := st.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("x"))
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a closed session")
+	}
+	if !client.IsClosed() {
+		t.Fatal("client session still open")
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{Username: "u", Password: "p"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+
+	dial := func(password string) (*Session, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Handshake(conn, "u", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ClientSession(conn, nil), nil
+	}
+	if _, err := dial("wrong"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("unexpected error", err)
+	}
+	s, err := dial("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A TCP echo server.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	conn, err := s.Connect(context.Background(), echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("unexpected echo", string(buf), err)
+	}
+	conn.Close()
+
+	// A refused connection comes back as a SOCKS5 reply.
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	if _, err := s.Connect(context.Background(), closed.Addr().String()); err != socks5.ReplyError(5) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// A UDP echo server.
+	upc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upc.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := upc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			upc.WriteTo(b[:n], addr)
+		}
+	}()
+	pc, err := s.Associate(context.Background(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.WriteTo([]byte("ping"), upc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatal("unexpected datagram", string(buf[:n]), err)
+	}
+	t.Log("reply from", from)
+	if from.(*net.UDPAddr).Port != upc.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("unexpected source", from)
+	}
+
+	// A domain target is resolved by the server.
+	port := strconv.Itoa(upc.LocalAddr().(*net.UDPAddr).Port)
+	if _, err := pc.WriteTo([]byte("pong"), hostAddr("localhost:"+port)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatal("unexpected datagram", string(buf[:n]), err)
+	}
+}
+
+type hostAddr string
+
+func (a hostAddr) Network() string { return "udp" }
+func (a hostAddr) String() string  { return string(a) }
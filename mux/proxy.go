@@ -0,0 +1,193 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/udppackage"
+)
+
+// The proxy protocol spoken over a session. The client authenticates
+// the connection once, before the session starts:
+//
+//	client: version(1) | ulen(1) | username | plen(1) | password
+//	server: status(1), 0 on success
+//
+// Each stream then starts with a request, a command and for
+// CmdConnect a SOCKS5 address, and the server replies with a SOCKS5
+// reply code:
+//
+//	client: cmd(1) [| address]
+//	server: reply(1)
+//
+// A CmdConnect stream then carries the TCP connection. A
+// CmdUDPAssociate one carries version 2 udppackage packets, each
+// prefixed with its length as by udppackage.WriteStream, replies have
+// the remote address in their target field.
+const (
+	helloVersion = 1
+
+	CmdConnect      = socks5.CmdConnect
+	CmdUDPAssociate = socks5.CmdUDPAssociate
+)
+
+// ErrAuthFailed is returned by Handshake when the server rejects the
+// credentials.
+var ErrAuthFailed = errors.New("mux authentication failed")
+
+// Handshake authenticates the client connection conn, the session is
+// then started with ClientSession.
+func Handshake(conn net.Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("mux: username or password too long")
+	}
+	buf := make([]byte, 0, 3+len(username)+len(password))
+	buf = append(buf, helloVersion, byte(len(username)))
+	buf = append(buf, username...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, password...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	if buf[0] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// readHello reads the credentials of a client connection.
+func readHello(conn net.Conn) (username, password string, err error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != helloVersion {
+		return "", "", fmt.Errorf("mux: unsupported hello version %d", buf[0])
+	}
+	read := func(n int) (string, error) {
+		_, err := io.ReadFull(conn, buf[:n])
+		return string(buf[:n]), err
+	}
+	if username, err = read(int(buf[1])); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", "", err
+	}
+	password, err = read(int(buf[0]))
+	return username, password, err
+}
+
+// request opens a stream and sends req, it returns once the server
+// replied. A refused request is a socks5.ReplyError.
+func (s *Session) request(ctx context.Context, req []byte) (*Stream, error) {
+	st, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		st.SetDeadline(deadline)
+		defer st.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { st.SetDeadline(time.Now()) })
+	defer stop()
+
+	var reply [1]byte
+	if _, err := st.Write(req); err == nil {
+		_, err = io.ReadFull(st, reply[:])
+	}
+	if err != nil {
+		st.Reset()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if reply[0] != 0 {
+		st.Close()
+		return nil, socks5.ReplyError(reply[0])
+	}
+	return st, nil
+}
+
+// Connect asks the server for a TCP connection to target, a host:port.
+func (s *Session) Connect(ctx context.Context, target string) (net.Conn, error) {
+	addr := socks5.ParseAddr(target)
+	if addr == nil {
+		return nil, &net.AddrError{Err: "invalid mux target", Addr: target}
+	}
+	return s.request(ctx, append([]byte{CmdConnect}, addr...))
+}
+
+// Associate asks the server to relay the datagrams of the local client
+// src. The destinations of WriteTo must be UDPAddrs.
+func (s *Session) Associate(ctx context.Context, src *net.UDPAddr) (*PacketConn, error) {
+	st, err := s.request(ctx, []byte{CmdUDPAssociate})
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		src = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	return &PacketConn{Stream: st, src: src}, nil
+}
+
+// PacketConn carries datagrams over a stream.
+type PacketConn struct {
+	*Stream
+	src *net.UDPAddr
+
+	// A datagram may take several frames, writeMu keeps them together.
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	dec     *udppackage.Decoder
+}
+
+// WriteTo sends b to addr, a UDP address or any host:port one. A domain
+// host is resolved by the server.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := udppackage.Packet{Version: udppackage.V2, Source: c.src, Payload: b}
+	if dst, ok := addr.(*net.UDPAddr); ok {
+		p.Target = dst
+	} else if err := p.SetTarget(addr.String()); err != nil {
+		return 0, &net.AddrError{Err: "invalid target", Addr: addr.String()}
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	err = udppackage.WriteStream(c.Stream, data)
+	c.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.dec == nil {
+		c.dec = udppackage.NewDecoder(c.Stream)
+	}
+	for {
+		p, err := c.dec.Decode()
+		if errors.Is(err, udppackage.ErrMalformed) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, p.Payload), p.Target, nil
+	}
+}
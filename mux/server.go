@@ -0,0 +1,252 @@
+package mux
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/udppackage"
+)
+
+// DefaultDialTimeout bounds the connections the server makes for
+// CmdConnect requests.
+const DefaultDialTimeout = 10 * time.Second
+
+// Server is the far end of the mux outbound: it accepts sessions and
+// connects their streams to their destinations.
+type Server struct {
+	// Username and Password, if set, are required from the clients.
+	Username string
+	Password string
+
+	Config *Config
+
+	// DialTimeout defaults to DefaultDialTimeout.
+	DialTimeout time.Duration
+
+	// Logger defaults to slog.Default.
+	Logger *slog.Logger
+}
+
+// ListenAndServe listens on the TCP address addr and serves it.
+func (srv *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve serves the connections of ln until it fails.
+func (srv *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// ServeConn authenticates conn and serves its session until it ends.
+func (srv *Server) ServeConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(srv.dialTimeout()))
+	username, password, err := readHello(conn)
+	if err != nil {
+		srv.logger().Debug("mux hello failed", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	if !srv.allowed(username, password) {
+		srv.logger().Warn("mux authentication failed", "remote", conn.RemoteAddr())
+		conn.Write([]byte{1})
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := ServerSession(conn, srv.Config)
+	defer s.Close()
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go srv.serveStream(st)
+	}
+}
+
+func (srv *Server) allowed(username, password string) bool {
+	if srv.Username == "" && srv.Password == "" {
+		return true
+	}
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(srv.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(srv.Password))
+	return u&p == 1
+}
+
+func (srv *Server) serveStream(st *Stream) {
+	defer st.Close()
+	st.SetReadDeadline(time.Now().Add(srv.dialTimeout()))
+	var cmd [1]byte
+	if _, err := io.ReadFull(st, cmd[:]); err != nil {
+		return
+	}
+	switch cmd[0] {
+	case CmdConnect:
+		buf := make([]byte, socks5.MaxAddrLen)
+		addr, err := socks5.ReadAddr(st, buf)
+		if err != nil {
+			return
+		}
+		st.SetReadDeadline(time.Time{})
+		srv.connect(st, addr.String())
+	case CmdUDPAssociate:
+		st.SetReadDeadline(time.Time{})
+		srv.associate(st)
+	default:
+		st.Write([]byte{7}) // command not supported
+	}
+}
+
+func (srv *Server) connect(st *Stream, target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.dialTimeout())
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		srv.logger().Debug("mux connect failed", "target", target, "err", err)
+		st.Write([]byte{replyCode(err)})
+		return
+	}
+	defer conn.Close()
+	if _, err := st.Write([]byte{0}); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, st)
+		if c, ok := conn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(st, conn)
+	st.CloseWrite()
+	wg.Wait()
+}
+
+// associate relays the datagrams of st through a UDP socket of its own.
+// Domain targets are resolved here, once each.
+func (srv *Server) associate(st *Stream) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		st.Write([]byte{1})
+		return
+	}
+	defer pc.Close()
+	if _, err := st.Write([]byte{0}); err != nil {
+		return
+	}
+
+	go func() {
+		buf := make([]byte, udppackage.MaxStreamPacket)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// The client address is unknown here, the client fills
+			// it in.
+			p := udppackage.Packet{
+				Version: udppackage.V2,
+				Target:  from.(*net.UDPAddr),
+				Source:  &net.UDPAddr{IP: net.IPv4zero},
+				Payload: buf[:n],
+			}
+			data, err := p.Marshal()
+			if err != nil {
+				continue
+			}
+			if err := udppackage.WriteStream(st, data); err != nil {
+				pc.Close()
+				return
+			}
+		}
+	}()
+
+	dec := udppackage.NewDecoder(st)
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		p, err := dec.Decode()
+		if errors.Is(err, udppackage.ErrMalformed) {
+			srv.logger().Debug("drop invalid packet", "err", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		target := p.Target
+		if p.Domain != "" {
+			addr := p.TargetAddr()
+			if target = resolved[addr]; target == nil {
+				if target, err = net.ResolveUDPAddr("udp", addr); err != nil {
+					srv.logger().Debug("resolve target failed", "target", addr, "err", err)
+					continue
+				}
+				if len(resolved) >= maxResolved {
+					clear(resolved)
+				}
+				resolved[addr] = target
+			}
+		}
+		pc.WriteTo(p.Payload, target)
+	}
+}
+
+// maxResolved bounds the domain targets an association keeps resolved.
+const maxResolved = 256
+
+// replyCode maps a dial error to a SOCKS5 reply code.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 5
+	case errors.Is(err, syscall.ENETUNREACH):
+		return 3
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return 4
+	default:
+		return 1
+	}
+}
+
+func (srv *Server) dialTimeout() time.Duration {
+	if srv.DialTimeout > 0 {
+		return srv.DialTimeout
+	}
+	return DefaultDialTimeout
+}
+
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,367 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWindow is the receive window of a stream.
+	DefaultWindow = 1 << 20
+
+	// DefaultKeepAlive is the interval of the keepalive pings.
+	DefaultKeepAlive = 30 * time.Second
+
+	// acceptBacklog is the number of opened streams waiting for Accept,
+	// the streams opened beyond are reset.
+	acceptBacklog = 256
+)
+
+var (
+	// ErrSessionClosed is returned by the streams of a closed session.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	// ErrStreamReset is returned once the peer reset a stream.
+	ErrStreamReset = errors.New("mux: stream reset")
+
+	// ErrGoAway is returned by Open once the peer stopped accepting
+	// streams.
+	ErrGoAway = errors.New("mux: peer going away")
+
+	errTimeout = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "mux: i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
+
+// Config tunes a session, the zero value is usable.
+type Config struct {
+	// Window is the receive window of each stream, DefaultWindow if 0.
+	// It is never less than 256 KiB, the window streams start with.
+	Window uint32
+
+	// KeepAlive is the interval of the pings that keep the session
+	// alive, DefaultKeepAlive if 0. A ping left unanswered for as long
+	// closes the session. Negative disables them.
+	KeepAlive time.Duration
+}
+
+func (c *Config) window() uint32 {
+	if c == nil || c.Window == 0 {
+		return DefaultWindow
+	}
+	return max(c.Window, initialWindow)
+}
+
+func (c *Config) keepAlive() time.Duration {
+	if c == nil || c.KeepAlive == 0 {
+		return DefaultKeepAlive
+	}
+	return c.KeepAlive
+}
+
+// Session is a multiplexed connection. The client opens streams with
+// odd ids, the server with even ones, either may open them.
+type Session struct {
+	conn   net.Conn
+	window uint32
+	nextID atomic.Uint32
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	goneAway bool
+	pings    map[uint32]chan struct{}
+	pingID   uint32
+
+	accept chan *Stream
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// ClientSession returns the client session over conn.
+func ClientSession(conn net.Conn, c *Config) *Session {
+	return newSession(conn, c, 1)
+}
+
+// ServerSession returns the server session over conn.
+func ServerSession(conn net.Conn, c *Config) *Session {
+	return newSession(conn, c, 2)
+}
+
+func newSession(conn net.Conn, c *Config, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		window:  c.window(),
+		streams: make(map[uint32]*Stream),
+		pings:   make(map[uint32]chan struct{}),
+		accept:  make(chan *Stream, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	s.nextID.Store(firstID)
+	go s.recvLoop()
+	if d := c.keepAlive(); d > 0 {
+		go s.keepAlive(d)
+	}
+	return s
+}
+
+// Open opens a new stream, the peer learns of it with its first frame.
+func (s *Session) Open() (*Stream, error) {
+	select {
+	case <-s.closed:
+		return nil, s.closeErr()
+	default:
+	}
+	id := s.nextID.Add(2) - 2
+	st := newStream(s, id)
+	s.mu.Lock()
+	if s.goneAway {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+	// Announce the stream and its window at once.
+	if err := st.sendWindowUpdate(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session is closed, its streams are then
+// all gone.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed with the session.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// GoAway tells the peer no more streams will be accepted, the open
+// ones carry on.
+func (s *Session) GoAway() error {
+	h := newHeader(typeGoAway, 0, 0, 0)
+	return s.writeFrame(h, nil)
+}
+
+// Close closes the connection and every stream.
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closed)
+		s.conn.Close()
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.notify()
+		}
+	})
+}
+
+func (s *Session) closeErr() error {
+	<-s.closed
+	return s.err
+}
+
+// Ping sends a ping and waits for its reply.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mu.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(newHeader(typePing, flagSYN, 0, id), nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-s.closed:
+		return 0, s.closeErr()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *Session) keepAlive(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		_, err := s.Ping(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.close(errors.New("mux: keepalive timeout"))
+			return
+		}
+	}
+}
+
+// writeFrame writes the frame h followed by payload.
+func (s *Session) writeFrame(h header, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.closed:
+		return s.closeErr()
+	default:
+	}
+	bufs := net.Buffers{h[:]}
+	if len(payload) > 0 {
+		bufs = append(bufs, payload)
+	}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// reply writes a control frame without holding up the receive loop,
+// which must not block on a peer that is itself busy writing.
+func (s *Session) reply(h header) {
+	go s.writeFrame(h, nil)
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			}
+			s.close(err)
+			return
+		}
+		if err := h.check(); err != nil {
+			s.close(err)
+			return
+		}
+		var err error
+		switch h.typ() {
+		case typeData, typeWindowUpdate:
+			err = s.handleStream(&h)
+		case typePing:
+			s.handlePing(&h)
+		case typeGoAway:
+			s.mu.Lock()
+			s.goneAway = true
+			s.mu.Unlock()
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handlePing(h *header) {
+	if h.flags()&flagSYN != 0 {
+		s.reply(newHeader(typePing, flagACK, 0, h.length()))
+		return
+	}
+	s.mu.Lock()
+	ch := s.pings[h.length()]
+	delete(s.pings, h.length())
+	s.mu.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+}
+
+func (s *Session) handleStream(h *header) error {
+	id, flags := h.stream(), h.flags()
+	s.mu.Lock()
+	st := s.streams[id]
+	if st == nil && flags&flagSYN != 0 {
+		st = newStream(s, id)
+		s.streams[id] = st
+		select {
+		case s.accept <- st:
+		default:
+			delete(s.streams, id)
+			st = nil
+			s.reply(newHeader(typeWindowUpdate, flagRST, id, 0))
+		}
+		if st != nil {
+			// Accept the stream and announce its window.
+			go st.sendWindowUpdate()
+		}
+	}
+	s.mu.Unlock()
+
+	if h.typ() == typeWindowUpdate {
+		if st != nil {
+			st.update(flags, h.length())
+		}
+		return nil
+	}
+	if st == nil {
+		// Data of a stream already gone.
+		_, err := io.CopyN(io.Discard, s.conn, int64(h.length()))
+		return err
+	}
+	return st.receive(flags, h.length())
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
@@ -0,0 +1,328 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a net.Conn carried by a Session.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu sync.Mutex
+	// flags still to send: SYN on the first frame of the opener, ACK
+	// on the first one of the acceptor.
+	pending uint16
+	recvBuf bytes.Buffer
+	// recvWindow is what the peer may still send, sendWindow what may
+	// still be sent to it.
+	recvWindow uint32
+	sendWindow uint32
+
+	localFIN  bool // no more writes
+	closed    bool // no more reads either
+	remoteFIN bool
+	reset     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readCh and writeCh wake the blocked Read and Write.
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		s:          s,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+	// Odd ids are opened by clients, the opener is the side with the
+	// parity of id.
+	if id%2 == s.nextID.Load()%2 {
+		st.pending = flagSYN
+	} else {
+		st.pending = flagACK
+	}
+	return st
+}
+
+// ID returns the id of the stream in its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.readCh, st.writeCh} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait waits for ch, the session closing or deadline. It is called
+// without st.mu held.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-st.s.closed:
+		return nil
+	case <-timeout:
+		return errTimeout
+	}
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.recvBuf.Len() > 0:
+			n, _ := st.recvBuf.Read(b)
+			st.mu.Unlock()
+			// Reopen the window once half of it was read.
+			st.sendWindowUpdate()
+			return n, nil
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteFIN:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.s.IsClosed():
+			st.mu.Unlock()
+			return 0, st.s.closeErr()
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	total := 0
+	for total < len(b) {
+		st.mu.Lock()
+		switch {
+		case st.localFIN:
+			st.mu.Unlock()
+			return total, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return total, ErrStreamReset
+		case st.s.IsClosed():
+			st.mu.Unlock()
+			return total, st.s.closeErr()
+		case st.sendWindow == 0:
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeCh, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := min(uint32(len(b)-total), st.sendWindow, maxFrame)
+		st.sendWindow -= n
+		flags := st.takeFlags()
+		st.mu.Unlock()
+
+		h := newHeader(typeData, flags, st.id, n)
+		if err := st.s.writeFrame(h, b[total:total+int(n)]); err != nil {
+			return total, err
+		}
+		total += int(n)
+	}
+	return total, nil
+}
+
+// takeFlags returns the flags the next frame carries, st.mu held.
+func (st *Stream) takeFlags() uint16 {
+	f := st.pending
+	st.pending = 0
+	return f
+}
+
+// sendWindowUpdate grows the window of the peer back to the size of
+// the session once less than half of it is left, or at once along
+// with the SYN or ACK of the stream.
+func (st *Stream) sendWindowUpdate() error {
+	st.mu.Lock()
+	max := st.s.window
+	delta := max - uint32(st.recvBuf.Len()) - st.recvWindow
+	if st.closed {
+		// What arrives now is thrown away, it needs no room.
+		delta = max - st.recvWindow
+	}
+	flags := st.takeFlags()
+	if flags == 0 && (delta < max/2 || st.remoteFIN || st.reset) {
+		st.mu.Unlock()
+		return nil
+	}
+	st.recvWindow += delta
+	st.mu.Unlock()
+	return st.s.writeFrame(newHeader(typeWindowUpdate, flags, st.id, delta), nil)
+}
+
+// update handles a window update frame.
+func (st *Stream) update(flags uint16, delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.handleFlags(flags)
+	st.notify()
+}
+
+// receive reads the payload of a data frame off the session.
+func (st *Stream) receive(flags uint16, length uint32) error {
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: stream %d overflowed its window by %d bytes", st.id, length-st.recvWindow)
+	}
+	st.recvWindow -= length
+	closed := st.closed
+	st.mu.Unlock()
+
+	// The window is reserved, the payload is read without st.mu so a
+	// slow peer does not hold up Read, Close or the window updates.
+	if closed {
+		// Read no more, but keep the session in step.
+		if _, err := io.CopyN(io.Discard, st.s.conn, int64(length)); err != nil {
+			return err
+		}
+		go st.sendWindowUpdate()
+	} else {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(st.s.conn, buf); err != nil {
+			return err
+		}
+		st.mu.Lock()
+		closed = st.closed
+		if !closed {
+			st.recvBuf.Write(buf)
+		}
+		st.mu.Unlock()
+		if closed {
+			go st.sendWindowUpdate()
+		}
+	}
+	st.handleFlags(flags)
+	st.notify()
+	return nil
+}
+
+func (st *Stream) handleFlags(flags uint16) {
+	if flags&(flagFIN|flagRST) == 0 {
+		return
+	}
+	st.mu.Lock()
+	if flags&flagFIN != 0 {
+		st.remoteFIN = true
+	}
+	if flags&flagRST != 0 {
+		st.reset = true
+	}
+	done := st.reset || st.localFIN && st.remoteFIN
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+	st.notify()
+}
+
+// CloseWrite half closes the stream, the peer reads io.EOF once it got
+// the data written so far.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFIN || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFIN = true
+	flags := st.takeFlags() | flagFIN
+	done := st.remoteFIN
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+	st.notify()
+	return st.s.writeFrame(newHeader(typeWindowUpdate, flags, st.id, 0), nil)
+}
+
+// Close closes both directions, what the peer sends afterwards is
+// discarded until it closes too.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.closed = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+	err := st.CloseWrite()
+	if errors.Is(err, ErrSessionClosed) {
+		err = nil
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset, st.closed = true, true
+	st.mu.Unlock()
+	st.s.remove(st.id)
+	st.notify()
+	return st.s.writeFrame(newHeader(typeWindowUpdate, flagRST, st.id, 0), nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
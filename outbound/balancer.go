@@ -0,0 +1,153 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy is how a Balancer spreads flows over its members.
+type Strategy string
+
+const (
+	// RoundRobin takes the members in turn.
+	RoundRobin Strategy = "round_robin"
+
+	// LeastConn takes the member carrying the fewest open flows.
+	LeastConn Strategy = "least_conn"
+
+	// SourceHash hashes the client address onto a ring of the members,
+	// so a client sticks to one member while it is up.
+	SourceHash Strategy = "source_hash"
+
+	// LowestLatency takes the member with the lowest latency measured
+	// by health checks, see Member.Report. Members without one come
+	// last, in order.
+	LowestLatency Strategy = "lowest_latency"
+)
+
+// ParseStrategy returns the strategy named s.
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case RoundRobin, LeastConn, SourceHash, LowestLatency:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown strategy %q, want round_robin, least_conn, source_hash or lowest_latency", s)
+	}
+}
+
+type sourceKey struct{}
+
+// WithSource tells the outbounds dialing with ctx the address of the
+// client the flow comes from.
+func WithSource(ctx context.Context, src netip.AddrPort) context.Context {
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+func source(ctx context.Context) (netip.AddrPort, bool) {
+	src, ok := ctx.Value(sourceKey{}).(netip.AddrPort)
+	return src, ok
+}
+
+// ringReplicas is the number of points of each member on the hash ring.
+const ringReplicas = 64
+
+// Balancer spreads flows over its members by Strategy, skipping the
+// down ones. A failed dial fails over to the next member as Failover
+// does, whose settings apply.
+type Balancer struct {
+	Failover
+	Strategy Strategy
+
+	next atomic.Uint64
+
+	ringOnce sync.Once
+	ring     []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint32
+	member *Member
+}
+
+func (b *Balancer) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	src, _ := source(ctx)
+	return b.dialTCP(ctx, target, b.order(src.Addr()))
+}
+
+func (b *Balancer) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	var addr netip.Addr
+	if src != nil {
+		addr, _ = netip.AddrFromSlice(src.IP)
+	}
+	return b.listenUDP(ctx, src, b.order(addr.Unmap()))
+}
+
+// order returns the order members are tried in for a flow from src,
+// which may be invalid when unknown.
+func (b *Balancer) order(src netip.Addr) func([]*Member) []*Member {
+	switch {
+	case b.Strategy == LeastConn:
+		return func(ms []*Member) []*Member {
+			ms = slices.Clone(ms)
+			sort.SliceStable(ms, func(i, j int) bool {
+				return ms[i].active.Load() < ms[j].active.Load()
+			})
+			return ms
+		}
+	case b.Strategy == LowestLatency:
+		return func(ms []*Member) []*Member {
+			ms = slices.Clone(ms)
+			sort.SliceStable(ms, func(i, j int) bool {
+				li, lj := ms[i].latency.Load(), ms[j].latency.Load()
+				return li != 0 && (lj == 0 || li < lj)
+			})
+			return ms
+		}
+	case b.Strategy == SourceHash && src.IsValid():
+		return func(ms []*Member) []*Member {
+			return b.walk(hash(src.String()), ms)
+		}
+	default:
+		// Round robin, also for the flows of unknown source.
+		return func(ms []*Member) []*Member {
+			i := int(b.next.Add(1)-1) % len(ms)
+			return append(slices.Clone(ms[i:]), ms[:i]...)
+		}
+	}
+}
+
+// walk returns the members of ms met along the ring from h on.
+func (b *Balancer) walk(h uint32, ms []*Member) []*Member {
+	b.ringOnce.Do(func() {
+		for _, m := range b.Members {
+			for i := 0; i < ringReplicas; i++ {
+				b.ring = append(b.ring, ringPoint{hash(m.Name + "#" + strconv.Itoa(i)), m})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	})
+
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	order := make([]*Member, 0, len(ms))
+	for i := 0; i < len(b.ring) && len(order) < len(ms); i++ {
+		m := b.ring[(start+i)%len(b.ring)].member
+		if slices.Contains(ms, m) && !slices.Contains(order, m) {
+			order = append(order, m)
+		}
+	}
+	return order
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,44 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/mobile"
+)
+
+// Check connects to the server of s, the way a flow would, without
+// asking it for a destination: SOCKS5 servers negotiate the
+// authentication method, mux ones authenticate the session and HTTPS
+// ones the TLS session. A relay has no
+// TCP side and direct no server, ErrUnsupported is returned for them.
+func Check(ctx context.Context, s *Spec, p mobile.ProtectSocket) error {
+	if s.Scheme == Relay || s.Scheme == Direct {
+		return ErrUnsupported
+	}
+	conn, err := dialTCP(ctx, s.Addr(), p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	switch s.Scheme {
+	case SOCKS5, SOCKS5H:
+		var auth *socks5.Auth
+		if s.Username != "" {
+			auth = &socks5.Auth{Username: s.Username, Password: s.Password}
+		}
+		return authError(socks5.Negotiate(conn, auth), socks5.ErrAuthFailed)
+	case Mux:
+		return (&muxOutbound{spec: s}).handshake(ctx, conn)
+	case HTTPS:
+		return tls.Client(conn, &tls.Config{ServerName: s.Host}).HandshakeContext(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"tun2proxylib/mobile"
+	"tun2proxylib/socketbase"
+)
+
+type direct struct {
+	protect mobile.ProtectSocket
+}
+
+func (d *direct) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	return dialTCP(ctx, target, d.protect)
+}
+
+func (d *direct) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	pc, err := socketbase.UdpListen(d.protect)
+	if err != nil {
+		return nil, err
+	}
+	return &directConn{PacketConn: pc}, nil
+}
+
+// directConn resolves the HostAddr destinations of its datagrams. The
+// direct outbound is the far end of its flows, so it resolves them even
+// when asked to leave it to the proxy, as DialTCP does.
+type directConn struct {
+	net.PacketConn
+}
+
+func (c *directConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := udpAddr(addr, false)
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, dst)
+}
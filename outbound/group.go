@@ -0,0 +1,348 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tun2proxylib/lwipcore/common/httpconnect"
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+const (
+	// DefaultMaxFails is the number of consecutive failures after which
+	// a group member is marked down.
+	DefaultMaxFails = 3
+
+	// DefaultRetry is how long a down member is skipped before a flow
+	// tries it again.
+	DefaultRetry = 30 * time.Second
+)
+
+// Member is an outbound of a group along with the health the group
+// observed through it.
+type Member struct {
+	Name     string
+	Outbound Outbound
+
+	mu        sync.Mutex
+	fails     int
+	down      bool
+	downSince time.Time
+	probing   bool
+
+	active  atomic.Int64
+	flows   atomic.Uint64
+	latency atomic.Int64 // of the last health check, 0 if unknown
+}
+
+// NewMember returns a healthy member.
+func NewMember(name string, ob Outbound) *Member {
+	return &Member{Name: name, Outbound: ob}
+}
+
+// MemberStatus is the health of a member and the flows it carries.
+type MemberStatus struct {
+	Name  string
+	Up    bool
+	Fails int
+
+	// Active is the number of open flows, Flows the number of flows
+	// ever carried.
+	Active int64
+	Flows  uint64
+
+	// Latency is the one measured by the last health check, 0 if none
+	// succeeded.
+	Latency time.Duration
+}
+
+func (m *Member) status() MemberStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemberStatus{
+		Name:    m.Name,
+		Up:      !m.down,
+		Fails:   m.fails,
+		Active:  m.active.Load(),
+		Flows:   m.flows.Load(),
+		Latency: time.Duration(m.latency.Load()),
+	}
+}
+
+// Report records the outcome of an active health check of m: m is up
+// with latency if err is nil, down otherwise. Flows still probe a down
+// member once the Retry of its group has passed.
+func (m *Member) Report(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.fails = 0
+		m.down = false
+		m.latency.Store(int64(latency))
+		return
+	}
+	m.latency.Store(0)
+	if !m.down {
+		m.down = true
+		m.downSince = time.Now()
+	}
+}
+
+// open counts a new flow through m, the returned func ends it.
+func (m *Member) open() func() {
+	m.active.Add(1)
+	m.flows.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { m.active.Add(-1) })
+	}
+}
+
+// memberConn ends its flow when closed.
+type memberConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *memberConn) Close() error {
+	err := c.Conn.Close()
+	c.done()
+	return err
+}
+
+type memberPacketConn struct {
+	net.PacketConn
+	done func()
+}
+
+func (c *memberPacketConn) Close() error {
+	err := c.PacketConn.Close()
+	c.done()
+	return err
+}
+
+// acquire reports whether a flow may use m. Once its retry time has
+// come, a down member lets a single flow through to probe it.
+func (m *Member) acquire(now time.Time, retry time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.down {
+		return true
+	}
+	if m.probing || now.Sub(m.downSince) < retry {
+		return false
+	}
+	m.probing = true
+	return true
+}
+
+// release gives back the probe acquire may have granted.
+func (m *Member) release() {
+	m.mu.Lock()
+	m.probing = false
+	m.mu.Unlock()
+}
+
+// report records the outcome of a dial through m, a nil err is a
+// success. It returns true when m went up or down.
+func (m *Member) report(err error, now time.Time, maxFails int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probing = false
+	wasDown := m.down
+	if err == nil {
+		m.fails = 0
+		m.down = false
+		return wasDown
+	}
+	m.fails++
+	if m.fails >= maxFails {
+		m.down = true
+		m.downSince = now
+	}
+	return m.down != wasDown
+}
+
+// answered reports whether err comes from a server that is up but
+// could not reach the destination, or a failure no other member would
+// avoid.
+func answered(err error) bool {
+	var reply socks5.ReplyError
+	var status *httpconnect.StatusError
+	var dnsErr *net.DNSError
+	return errors.As(err, &reply) || errors.As(err, &status) || errors.As(err, &dnsErr)
+}
+
+// Failover dials through the first member that is up, in order. A
+// failed dial is retried on the next member, a member is marked down
+// after MaxFails consecutive failures and tried again by a flow once
+// Retry has passed. When every member is down they are all tried.
+type Failover struct {
+	Name    string
+	Members []*Member
+
+	// MaxFails defaults to DefaultMaxFails and Retry to DefaultRetry.
+	MaxFails int
+	Retry    time.Duration
+
+	// Timeout bounds the dial through each member, so that a dead one
+	// leaves time for the next. No bound when 0.
+	Timeout time.Duration
+
+	// Logger receives the member state changes. Defaults to
+	// slog.Default.
+	Logger *slog.Logger
+
+	now func() time.Time
+}
+
+func (f *Failover) String() string {
+	return f.Name
+}
+
+// Close closes the outbounds of the members, see Close.
+func (f *Failover) Close() error {
+	var errs []error
+	for _, m := range f.Members {
+		errs = append(errs, Close(m.Outbound))
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the health of every member, in order.
+func (f *Failover) Status() []MemberStatus {
+	st := make([]MemberStatus, len(f.Members))
+	for i, m := range f.Members {
+		st[i] = m.status()
+	}
+	return st
+}
+
+func (f *Failover) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	return f.dialTCP(ctx, target, nil)
+}
+
+func (f *Failover) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	return f.listenUDP(ctx, src, nil)
+}
+
+func (f *Failover) dialTCP(ctx context.Context, target string, order func([]*Member) []*Member) (net.Conn, error) {
+	var conn net.Conn
+	err := f.try(ctx, order, func(ctx context.Context, m *Member) (err error) {
+		conn, err = m.Outbound.DialTCP(ctx, target)
+		if err == nil {
+			conn = &memberConn{Conn: conn, done: m.open()}
+		}
+		return err
+	})
+	return conn, err
+}
+
+func (f *Failover) listenUDP(ctx context.Context, src *net.UDPAddr, order func([]*Member) []*Member) (net.PacketConn, error) {
+	var pc net.PacketConn
+	err := f.try(ctx, order, func(ctx context.Context, m *Member) (err error) {
+		pc, err = m.Outbound.ListenUDP(ctx, src)
+		if err == nil {
+			pc = &memberPacketConn{PacketConn: pc, done: m.open()}
+		}
+		return err
+	})
+	return pc, err
+}
+
+// try runs dial on the members until one succeeds, in their order or
+// the one order returns for the usable ones.
+func (f *Failover) try(ctx context.Context, order func([]*Member) []*Member, dial func(context.Context, *Member) error) error {
+	if len(f.Members) == 0 {
+		return fmt.Errorf("group %s has no member", f.Name)
+	}
+	now := f.clock()()
+	var candidates []*Member
+	for _, m := range f.Members {
+		if m.acquire(now, f.retry()) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = f.Members
+	}
+	if order != nil {
+		candidates = order(candidates)
+	}
+
+	var errs []error
+	for i, m := range candidates {
+		err := f.dial(ctx, m, dial)
+		if err == nil || answered(err) || ctx.Err() != nil {
+			// The members left keep their probe for the next flow.
+			for _, m := range candidates[i+1:] {
+				m.release()
+			}
+			if err == nil {
+				return nil
+			}
+			return errors.Join(append(errs, fmt.Errorf("%s: %w", m.Name, err))...)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// dial runs dial on m and records the outcome.
+func (f *Failover) dial(ctx context.Context, m *Member, dial func(context.Context, *Member) error) error {
+	dctx := ctx
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+	err := dial(dctx, m)
+	switch {
+	case err == nil, answered(err):
+		if m.report(nil, f.clock()(), f.maxFails()) {
+			f.logger().Info("outbound up", "group", f.Name, "member", m.Name)
+		}
+	case errors.Is(err, ErrUnsupported), ctx.Err() != nil:
+		// Neither the fault of the member.
+		m.release()
+	default:
+		if m.report(err, f.clock()(), f.maxFails()) {
+			f.logger().Warn("outbound down", "group", f.Name, "member", m.Name, "err", err)
+		}
+	}
+	return err
+}
+
+func (f *Failover) maxFails() int {
+	if f.MaxFails > 0 {
+		return f.MaxFails
+	}
+	return DefaultMaxFails
+}
+
+func (f *Failover) retry() time.Duration {
+	if f.Retry > 0 {
+		return f.Retry
+	}
+	return DefaultRetry
+}
+
+func (f *Failover) clock() func() time.Time {
+	if f.now != nil {
+		return f.now
+	}
+	return time.Now
+}
+
+func (f *Failover) logger() *slog.Logger {
+	if f.Logger != nil {
+		return f.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,166 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+// fakeOutbound fails its dials with err and counts them.
+type fakeOutbound struct {
+	err   error
+	dials int
+}
+
+func (f *fakeOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	f.dials++
+	if f.err != nil {
+		return nil, f.err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (f *fakeOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	return nil, ErrUnsupported
+}
+
+func TestFailover(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := &fakeOutbound{err: errors.New("connection refused")}
+	b := &fakeOutbound{}
+	f := &Failover{
+		Name:    "main",
+		Members: []*Member{NewMember("a", a), NewMember("b", b)},
+		now:     func() time.Time { return now },
+	}
+
+	for i := 0; i < DefaultMaxFails+2; i++ {
+		conn, err := f.DialTCP(context.Background(), "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if a.dials != DefaultMaxFails || b.dials != DefaultMaxFails+2 {
+		t.Fatal("a dialed", a.dials, "times, b", b.dials)
+	}
+	t.Log(f.Status())
+	if st := f.Status(); st[0].Up || !st[1].Up {
+		t.Fatal("unexpected status", st)
+	}
+
+	// Once Retry has passed a flow probes a again.
+	now = now.Add(DefaultRetry)
+	a.err = nil
+	if _, err := f.DialTCP(context.Background(), "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if a.dials != DefaultMaxFails+1 || !f.Status()[0].Up {
+		t.Fatal("a was not probed", a.dials, f.Status())
+	}
+
+	// A proxy refusing the destination is up, b is not tried.
+	a.err = socks5.ReplyError(5)
+	if _, err := f.DialTCP(context.Background(), "example.com:443"); !errors.As(err, new(socks5.ReplyError)) {
+		t.Fatal("unexpected error", err)
+	}
+	if b.dials != DefaultMaxFails+2 || f.Status()[0].Fails != 0 {
+		t.Fatal("destination error counted as a failure", f.Status())
+	}
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	a := &fakeOutbound{err: errors.New("timeout")}
+	f := &Failover{Name: "main", Members: []*Member{NewMember("a", a)}, MaxFails: 1}
+	for i := 0; i < 3; i++ {
+		if _, err := f.DialTCP(context.Background(), "example.com:443"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	// A group with every member down still tries them.
+	if a.dials != 3 {
+		t.Fatal("a dialed", a.dials, "times")
+	}
+	if _, err := f.ListenUDP(context.Background(), nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	obs := []*fakeOutbound{{}, {}, {}}
+	members := make([]*Member, len(obs))
+	for i, ob := range obs {
+		members[i] = NewMember(strconv.Itoa(i), ob)
+	}
+	b := &Balancer{Failover: Failover{Name: "lb", Members: members}, Strategy: RoundRobin}
+	var conns []net.Conn
+	for i := 0; i < 6; i++ {
+		conn, err := b.DialTCP(context.Background(), "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for i, ob := range obs {
+		if ob.dials != 2 {
+			t.Fatal("member", i, "dialed", ob.dials, "times")
+		}
+	}
+
+	// Closing the flows of member 0 makes it the least loaded.
+	conns[0].Close()
+	conns[3].Close()
+	b.Strategy = LeastConn
+	if _, err := b.DialTCP(context.Background(), "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	st := b.Status()
+	t.Log(st)
+	if obs[0].dials != 3 || st[0].Active != 1 || st[0].Flows != 3 {
+		t.Fatal("least loaded member not chosen", st)
+	}
+
+	// A client sticks to a member, and moves when it goes down.
+	b.Strategy = SourceHash
+	ctx := WithSource(context.Background(), netip.MustParseAddrPort("10.0.0.2:5000"))
+	dials := func() []int { return []int{obs[0].dials, obs[1].dials, obs[2].dials} }
+	before := dials()
+	for i := 0; i < 3; i++ {
+		b.DialTCP(ctx, "example.com:443")
+	}
+	after := dials()
+	sticky := -1
+	for i := range obs {
+		if after[i]-before[i] == 3 {
+			sticky = i
+		}
+	}
+	if sticky < 0 {
+		t.Fatal("source spread over members", before, after)
+	}
+	obs[sticky].err = errors.New("connection refused")
+	if _, err := b.DialTCP(ctx, "example.com:443"); err != nil {
+		t.Fatal("no failover", err)
+	}
+
+	// Measured members come first, the fastest one first.
+	b.Strategy = LowestLatency
+	members[1].Report(20*time.Millisecond, nil)
+	members[2].Report(10*time.Millisecond, nil)
+	members[0].Report(0, errors.New("timeout"))
+	obs[sticky].err = nil
+	before = dials()
+	if _, err := b.DialTCP(context.Background(), "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if after := dials(); after[2] != before[2]+1 {
+		t.Fatal("fastest member not chosen", before, after)
+	}
+}
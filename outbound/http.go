@@ -0,0 +1,52 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"tun2proxylib/lwipcore/common/httpconnect"
+	"tun2proxylib/mobile"
+)
+
+// httpOutbound tunnels TCP with HTTP CONNECT, over TLS for https.
+type httpOutbound struct {
+	spec    *Spec
+	protect mobile.ProtectSocket
+}
+
+func (h *httpOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := dialTCP(ctx, h.spec.Addr(), h.protect)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if h.spec.Scheme == HTTPS {
+		tc := tls.Client(conn, &tls.Config{ServerName: h.spec.Host})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	var auth *httpconnect.Auth
+	if h.spec.Username != "" {
+		auth = &httpconnect.Auth{Username: h.spec.Username, Password: h.spec.Password}
+	}
+	c, err := httpconnect.Handshake(conn, target, auth)
+	if err != nil {
+		conn.Close()
+		return nil, authError(err, httpconnect.ErrAuthFailed)
+	}
+	return c, nil
+}
+
+func (h *httpOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,167 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"tun2proxylib/mobile"
+	"tun2proxylib/mux"
+)
+
+const (
+	// muxSessions is the number of connections a mux outbound spreads
+	// its flows over, once each carries muxStreams of them.
+	muxSessions = 4
+	muxStreams  = 128
+)
+
+// muxOutbound carries every flow as a stream of a few long-lived
+// connections to a mux.Server.
+type muxOutbound struct {
+	spec    *Spec
+	protect mobile.ProtectSocket
+
+	dialMu   sync.Mutex
+	mu       sync.Mutex
+	sessions []*mux.Session
+	closed   bool
+}
+
+func (m *muxOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	if !remoteResolve(ctx) {
+		ip, port, err := resolve(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		target = (&net.TCPAddr{IP: ip, Port: port}).String()
+	}
+	s, err := m.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Connect(ctx, target)
+}
+
+func (m *muxOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	s, err := m.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := s.Associate(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	return &muxPacketConn{PacketConn: pc, remote: remoteResolve(ctx)}, nil
+}
+
+// muxPacketConn resolves the HostAddr destinations of its datagrams,
+// unless remote leaves them to the server.
+type muxPacketConn struct {
+	*mux.PacketConn
+	remote bool
+}
+
+func (c *muxPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.remote {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	dst, err := udpAddr(addr, false)
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+// session returns the least loaded open session, a new one is dialed
+// while there are fewer than muxSessions and all are busy.
+func (m *muxOutbound) session(ctx context.Context) (*mux.Session, error) {
+	if s, ok := m.pick(); ok {
+		return s, nil
+	}
+	// One dial at a time, the flows waiting for it share its session.
+	m.dialMu.Lock()
+	defer m.dialMu.Unlock()
+	best, ok := m.pick()
+	if ok {
+		return best, nil
+	}
+	if m.isClosed() {
+		return nil, net.ErrClosed
+	}
+	s, err := m.dial(ctx)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		s.Close()
+		return nil, net.ErrClosed
+	}
+	m.sessions = append(m.sessions, s)
+	return s, nil
+}
+
+func (m *muxOutbound) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// Close closes the sessions and so the flows they carry, the dials that
+// follow fail.
+func (m *muxOutbound) Close() error {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions, m.closed = nil, true
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+	return nil
+}
+
+// pick returns the least loaded open session, and whether it is the one
+// to use rather than a new one.
+func (m *muxOutbound) pick() (*mux.Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *mux.Session
+	open := m.sessions[:0]
+	for _, s := range m.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		open = append(open, s)
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	m.sessions = open
+	return best, best != nil && (best.NumStreams() < muxStreams || len(open) >= muxSessions)
+}
+
+func (m *muxOutbound) dial(ctx context.Context) (*mux.Session, error) {
+	conn, err := dialTCP(ctx, m.spec.Addr(), m.protect)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.handshake(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mux.ClientSession(conn, nil), nil
+}
+
+func (m *muxOutbound) handshake(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	return authError(mux.Handshake(conn, m.spec.Username, m.spec.Password), mux.ErrAuthFailed)
+}
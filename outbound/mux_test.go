@@ -0,0 +1,92 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"tun2proxylib/mux"
+)
+
+func TestMux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&mux.Server{Username: "u", Password: "p"}).Serve(ln)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	spec, _ := Parse("mux://u:p@"+ln.Addr().String(), SOCKS5)
+	ob, _ := New(spec, nil)
+	if err := Check(context.Background(), spec, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Many flows share the sessions.
+	var wg sync.WaitGroup
+	for i := 0; i < 2*muxStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := ob.DialTCP(context.Background(), echo.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("hi"))
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	sessions := len(ob.(*muxOutbound).sessions)
+	t.Log(sessions, "sessions")
+	if sessions == 0 || sessions > muxSessions {
+		t.Fatal("unexpected sessions", sessions)
+	}
+
+	// Close ends the sessions and their flows.
+	conn, err := ob.DialTCP(context.Background(), echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Close(ob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("flow outlived Close")
+	}
+	if _, err := ob.DialTCP(context.Background(), echo.Addr().String()); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("dial after Close:", err)
+	}
+
+	spec.Password = "wrong"
+	if err := Check(context.Background(), spec, nil); !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("unexpected error", err)
+	}
+}
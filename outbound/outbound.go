@@ -0,0 +1,146 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"tun2proxylib/mobile"
+	"tun2proxylib/socketbase"
+)
+
+var (
+	// ErrUnsupported is returned for a network the outbound cannot carry.
+	ErrUnsupported = errors.New("not supported by outbound")
+
+	// ErrAuthFailed is returned, wrapped, when a proxy rejects the
+	// credentials of an outbound.
+	ErrAuthFailed = errors.New("proxy authentication failed")
+
+	// ErrRemoteResolve is returned, wrapped, for a domain destination
+	// that should be resolved by the proxy, see WithRemoteResolve, when
+	// the outbound cannot send domains to it.
+	ErrRemoteResolve = errors.New("outbound cannot send domains to the proxy")
+)
+
+// authError wraps err with ErrAuthFailed if it is the authentication
+// failure protoErr of a proxy protocol.
+func authError(err, protoErr error) error {
+	if errors.Is(err, protoErr) {
+		return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	return err
+}
+
+// Outbound carries flows to their destination.
+type Outbound interface {
+	// DialTCP connects to target, a host:port.
+	DialTCP(ctx context.Context, target string) (net.Conn, error)
+
+	// ListenUDP returns a packet conn for the datagrams of the local
+	// client src. WriteTo sends to a destination, ReadFrom returns the
+	// replies with the address they came from.
+	ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error)
+}
+
+// Close releases what ob keeps between flows, the sessions of a mux
+// outbound or those of the members of a group. ob is not to be used
+// afterwards.
+func Close(ob Outbound) error {
+	if c, ok := ob.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type remoteResolveKey struct{}
+
+// WithRemoteResolve asks the outbounds dialing with ctx to send domain
+// targets to the proxy even when they would resolve them locally. The
+// domains behind fake IPs need it, they resolve to fake IPs again.
+func WithRemoteResolve(ctx context.Context) context.Context {
+	return context.WithValue(ctx, remoteResolveKey{}, true)
+}
+
+func remoteResolve(ctx context.Context) bool {
+	v, _ := ctx.Value(remoteResolveKey{}).(bool)
+	return v
+}
+
+// HostAddr is a host:port destination for ListenUDP conns, it lets
+// datagrams be sent to a domain.
+type HostAddr string
+
+func (a HostAddr) Network() string { return "udp" }
+func (a HostAddr) String() string  { return string(a) }
+
+// New returns the outbound described by s. Its sockets are protected
+// with p, see socketbase.
+func New(s *Spec, p mobile.ProtectSocket) (Outbound, error) {
+	switch s.Scheme {
+	case SOCKS5, SOCKS5H:
+		return &socks5Outbound{spec: s, protect: p}, nil
+	case Direct:
+		return &direct{protect: p}, nil
+	case HTTP, HTTPS:
+		return &httpOutbound{spec: s, protect: p}, nil
+	case Relay:
+		return &relay{spec: s, dialer: RelayDialer(s, p)}, nil
+	case Mux:
+		return &muxOutbound{spec: s, protect: p}, nil
+	case Shadowsocks:
+		ob, err := newShadowsocks(s, p)
+		if err != nil {
+			return nil, err
+		}
+		return ob, nil
+	default:
+		return nil, fmt.Errorf("%s outbound: %w", s.Scheme, ErrUnsupported)
+	}
+}
+
+// dialTCP connects to address through a protected socket. socketbase
+// only dials IPs, so host names are resolved first.
+func dialTCP(ctx context.Context, address string, p mobile.ProtectSocket) (net.Conn, error) {
+	ip, port, err := resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return socketbase.TcpDail(ip, port, p)
+}
+
+func dialUDP(ctx context.Context, address string, p mobile.ProtectSocket) (net.Conn, error) {
+	ip, port, err := resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return socketbase.UdpDail(ip, port, p)
+}
+
+func resolve(ctx context.Context, address string) (net.IP, int, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, port, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The protected sockets of socketbase are IPv4 ones.
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, port, nil
+		}
+	}
+	return ips[0], port, nil
+}
@@ -0,0 +1,120 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/mobile"
+	"tun2proxylib/udppackage"
+	"tun2proxylib/udprelay"
+)
+
+// relay carries UDP to a tun2proxy relay, every datagram is framed with
+// its destination and source by udppackage.
+type relay struct {
+	spec   *Spec
+	dialer *udprelay.Dialer
+}
+
+// RelayDialer returns the dialer of the relay s, its sockets are
+// protected with p.
+func RelayDialer(s *Spec, p mobile.ProtectSocket) *udprelay.Dialer {
+	d := &udprelay.Dialer{
+		Transport: s.Transport,
+		Probe:     s.Probe,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if network == "tcp" {
+				return dialTCP(ctx, address, p)
+			}
+			return dialUDP(ctx, address, p)
+		},
+	}
+	if s.TLS {
+		d.TLS = &tls.Config{ServerName: s.Host}
+	}
+	return d
+}
+
+func (r *relay) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
+
+func (r *relay) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := r.dialer.DialContext(ctx, r.spec.Addr())
+	if err != nil {
+		return nil, err
+	}
+	return &relayConn{Conn: conn, src: src, remote: remoteResolve(ctx), version: r.spec.Version}, nil
+}
+
+type relayConn struct {
+	net.Conn
+	src     *net.UDPAddr
+	remote  bool
+	version uint8
+}
+
+// WriteTo sends b to addr. A domain left to the proxy needs V2, V1
+// has no room for it.
+func (c *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := udppackage.Packet{Version: c.version, Source: c.src, Payload: b}
+	if p.Version == 0 {
+		p.Version = udppackage.V1
+	}
+	var err error
+	if _, ok := addr.(*net.UDPAddr); !ok && c.remote && p.Version == udppackage.V2 {
+		err = p.SetTarget(addr.String())
+	} else {
+		p.Target, err = udpAddr(addr, c.remote)
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *relayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Replies carry the remote host in the target field, as
+		// requests do.
+		from, _, payload, err := udppackage.UnpackUDPData(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), from, nil
+	}
+}
+
+// udpAddr returns the UDP address of a ListenUDP destination. A domain
+// is resolved locally, unless remote asks for it to be left to the proxy,
+// then ErrRemoteResolve is returned.
+func udpAddr(addr net.Addr, remote bool) (*net.UDPAddr, error) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a, nil
+	}
+	if !remote {
+		return net.ResolveUDPAddr("udp", addr.String())
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, ErrRemoteResolve)
+	}
+	return net.UDPAddrFromAddrPort(ap), nil
+}
@@ -0,0 +1,78 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"tun2proxylib/udprelay"
+)
+
+func TestRelay(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go (&udprelay.Server{}).ServeUDP(pc)
+
+	port := strconv.Itoa(echo.LocalAddr().(*net.UDPAddr).Port)
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	for _, c := range []struct {
+		query  string
+		remote bool
+		dst    net.Addr
+		err    error
+	}{
+		{"", false, echo.LocalAddr(), nil},
+		{"", false, HostAddr("localhost:" + port), nil},
+		{"", true, HostAddr("127.0.0.1:" + port), nil},
+		// The proxy is asked to resolve the domain, V1 cannot send it.
+		{"", true, HostAddr("localhost:" + port), ErrRemoteResolve},
+		{"?version=2", false, echo.LocalAddr(), nil},
+		{"?version=2", true, HostAddr("localhost:" + port), nil},
+	} {
+		spec, _ := Parse("relay://"+pc.LocalAddr().String()+c.query, Relay)
+		ob, _ := New(spec, nil)
+		ctx := context.Background()
+		if c.remote {
+			ctx = WithRemoteResolve(ctx)
+		}
+		conn, err := ob.ListenUDP(ctx, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.WriteTo([]byte("ping"), c.dst)
+		if !errors.Is(err, c.err) {
+			t.Fatal(c.query, c.dst, "unexpected error", err)
+		}
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 64)
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil || string(buf[:n]) != "ping" {
+				t.Fatal(c.query, c.dst, "unexpected reply", string(buf[:n]), err)
+			}
+			t.Log(c.query, c.dst, "answered from", from)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,54 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"tun2proxylib/lwipcore/common/shadowsocks"
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/mobile"
+)
+
+type shadowsocksOutbound struct {
+	spec    *Spec
+	cipher  *shadowsocks.Cipher
+	protect mobile.ProtectSocket
+}
+
+func newShadowsocks(s *Spec, p mobile.ProtectSocket) (*shadowsocksOutbound, error) {
+	c, err := shadowsocks.NewCipher(s.Username, s.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksOutbound{spec: s, cipher: c, protect: p}, nil
+}
+
+func (s *shadowsocksOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	addr := socks5.ParseAddr(target)
+	if addr == nil {
+		return nil, &net.AddrError{Err: "invalid shadowsocks target", Addr: target}
+	}
+	conn, err := dialTCP(ctx, s.spec.Addr(), s.protect)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.cipher.StreamConn(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *shadowsocksOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := dialUDP(ctx, s.spec.Addr(), s.protect)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := s.cipher.PacketConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
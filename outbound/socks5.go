@@ -0,0 +1,57 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+	"tun2proxylib/mobile"
+)
+
+type socks5Outbound struct {
+	spec    *Spec
+	protect mobile.ProtectSocket
+}
+
+func (s *socks5Outbound) auth() *socks5.Auth {
+	if s.spec.Username == "" {
+		return nil
+	}
+	return &socks5.Auth{Username: s.spec.Username, Password: s.spec.Password}
+}
+
+func (s *socks5Outbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	if s.spec.Scheme == SOCKS5 && !remoteResolve(ctx) {
+		ip, port, err := resolve(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		target = (&net.TCPAddr{IP: ip, Port: port}).String()
+	}
+	conn, _, err := s.handshake(ctx, socks5.CmdConnect, target)
+	return conn, err
+}
+
+// handshake connects to the server and sends the request cmd, it
+// returns the bound address of the reply.
+func (s *socks5Outbound) handshake(ctx context.Context, cmd byte, target string) (net.Conn, socks5.Addr, error) {
+	addr := socks5.ParseAddr(target)
+	if addr == nil {
+		return nil, nil, &net.AddrError{Err: "invalid socks target", Addr: target}
+	}
+	conn, err := dialTCP(ctx, s.spec.Addr(), s.protect)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	bound, err := socks5.Handshake(conn, cmd, addr, s.auth())
+	if err != nil {
+		conn.Close()
+		return nil, nil, authError(err, socks5.ErrAuthFailed)
+	}
+	return conn, bound, nil
+}
@@ -0,0 +1,93 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+// associateServer accepts one UDP ASSOCIATE and echoes the datagrams
+// sent to its relay. Closing the returned channel drops the control
+// connection.
+func associateServer(t *testing.T) (string, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drop := make(chan struct{})
+	go func() {
+		defer ln.Close()
+		defer relay.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 512)
+		io.ReadFull(conn, b[:2])
+		io.ReadFull(conn, b[:b[1]])
+		conn.Write([]byte{5, 0})
+		io.ReadFull(conn, b[:3])
+		socks5.ReadAddr(conn, b[3:])
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		conn.Write(append([]byte{5, 0, 0}, socks5.ParseAddr(net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))...))
+
+		go func() {
+			for {
+				n, from, err := relay.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				relay.WriteTo(b[:n], from)
+			}
+		}()
+		<-drop
+	}()
+	return ln.Addr().String(), drop
+}
+
+func TestSOCKS5Associate(t *testing.T) {
+	server, drop := associateServer(t)
+	spec, _ := Parse("socks5://"+server, SOCKS5)
+	ob, err := New(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := ob.ListenUDP(context.Background(), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	dst := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	if _, err := pc.WriteTo([]byte("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" || from.String() != dst.String() {
+		t.Fatal("unexpected reply", string(b[:n]), from)
+	}
+
+	close(drop)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := pc.ReadFrom(b); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("association outlived its control connection:", err)
+	}
+}
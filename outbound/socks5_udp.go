@@ -0,0 +1,104 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/lwipcore/common/socks5"
+)
+
+// ListenUDP opens a UDP ASSOCIATE, RFC 1928 section 7. The association
+// lives as long as its control connection, so the returned conn is
+// closed when the server drops it.
+func (s *socks5Outbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	// The address the client sends from is not known before the socket
+	// is bound, an unspecified one asks the server to accept any.
+	ctrl, bound, err := s.handshake(ctx, socks5.CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialUDP(ctx, relayAddr(ctrl, bound), s.protect)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &associateConn{Conn: conn, ctrl: ctrl}
+	go c.watch()
+	return c, nil
+}
+
+// relayAddr returns the relay address of a UDP ASSOCIATE reply. Servers
+// behind NAT often answer with an unspecified address, which stands for
+// the server itself.
+func relayAddr(ctrl net.Conn, bound socks5.Addr) string {
+	addr := bound.UDPAddr()
+	if addr == nil {
+		return bound.String()
+	}
+	if addr.IP.IsUnspecified() {
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			addr.IP = tcp.IP
+		}
+	}
+	return addr.String()
+}
+
+type associateConn struct {
+	net.Conn
+	ctrl net.Conn
+	once sync.Once
+}
+
+// watch tears the association down once the control connection ends.
+func (c *associateConn) watch() {
+	io.Copy(io.Discard, c.ctrl)
+	c.Close()
+}
+
+func (c *associateConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a := socks5.ParseAddr(addr.String())
+	if a == nil {
+		return 0, &net.AddrError{Err: "invalid socks target", Addr: addr.String()}
+	}
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+	if _, err := c.Conn.Write(socks5.AppendDatagram(buf[:0], a, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *associateConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		a, payload, err := socks5.SplitDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		from := a.UDPAddr()
+		if from == nil {
+			if from, err = net.ResolveUDPAddr("udp", a.String()); err != nil {
+				continue
+			}
+		}
+		return copy(b, payload), from, nil
+	}
+}
+
+func (c *associateConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.Conn.Close()
+	})
+	return err
+}
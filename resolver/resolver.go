@@ -0,0 +1,113 @@
+// Package resolver answers DNS queries inside the tunnel: from static
+// records, fake IPs, a cache and finally an upstream server.
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/lwipcore/common/dns/cache"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Resolver answers a DNS query.
+type Resolver interface {
+	Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error)
+}
+
+// hostsTTL is the TTL of the answers built from static records.
+const hostsTTL = 60
+
+// Hosts are static records, from a lower case domain without trailing
+// dot to its addresses.
+type Hosts map[string][]netip.Addr
+
+// answer builds the reply to m from h, ok is false if h has no entry
+// for the question.
+func (h Hosts) answer(m *mdns.Msg) (*mdns.Msg, bool) {
+	q := m.Question[0]
+	addrs, ok := h[strings.ToLower(strings.TrimSuffix(q.Name, "."))]
+	if !ok || q.Qclass != mdns.ClassINET {
+		return nil, false
+	}
+	resp := new(mdns.Msg)
+	resp.SetReply(m)
+	resp.RecursionAvailable = true
+	for _, addr := range addrs {
+		hdr := mdns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: mdns.ClassINET, Ttl: hostsTTL}
+		switch {
+		case q.Qtype == mdns.TypeA && addr.Is4():
+			resp.Answer = append(resp.Answer, &mdns.A{Hdr: hdr, A: addr.AsSlice()})
+		case q.Qtype == mdns.TypeAAAA && addr.Is6():
+			resp.Answer = append(resp.Answer, &mdns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	// Other types of a static name get an empty answer rather than
+	// leaking to the upstream.
+	return resp, true
+}
+
+// Pipeline tries its stages in order: Hosts, FakeDNS, Cache and then
+// Upstream. Every stage but Upstream is optional.
+type Pipeline struct {
+	Hosts    Hosts
+	FakeDNS  dns.FakeDns
+	Cache    *cache.DNSCache
+	Upstream Resolver
+}
+
+func (p *Pipeline) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	if len(m.Question) != 1 {
+		return refused(m), nil
+	}
+	if resp, ok := p.Hosts.answer(m); ok {
+		return resp, nil
+	}
+
+	if p.FakeDNS != nil {
+		packed, err := m.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if b, err := p.FakeDNS.GenerateFakeResponse(packed); err == nil {
+			resp := new(mdns.Msg)
+			if err := resp.Unpack(b); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+	}
+	if p.Cache != nil {
+		if resp := p.Cache.Get(m); resp != nil {
+			return resp, nil
+		}
+	}
+
+	resp, err := p.Upstream.Exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if p.Cache != nil {
+		p.Cache.Put(resp)
+	}
+	return resp, nil
+}
+
+// refused answers the queries no stage should see.
+func refused(m *mdns.Msg) *mdns.Msg {
+	resp := new(mdns.Msg)
+	resp.SetRcode(m, mdns.RcodeRefused)
+	return resp
+}
+
+// ServerFailure returns the SERVFAIL reply to m, for the queries that
+// could not be resolved.
+func ServerFailure(m *mdns.Msg) *mdns.Msg {
+	resp := new(mdns.Msg)
+	resp.SetRcode(m, mdns.RcodeServerFailure)
+	resp.RecursionAvailable = true
+	return resp
+}
@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"tun2proxylib/lwipcore/common/dns/cache"
+
+	mdns "github.com/miekg/dns"
+)
+
+// countingUpstream answers every A query with 1.2.3.4.
+type countingUpstream struct {
+	n int
+}
+
+func (u *countingUpstream) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	u.n++
+	resp := new(mdns.Msg)
+	resp.SetReply(m)
+	resp.Answer = []mdns.RR{&mdns.A{
+		Hdr: mdns.RR_Header{Name: m.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	}}
+	return resp, nil
+}
+
+func TestPipeline(t *testing.T) {
+	up := &countingUpstream{}
+	p := &Pipeline{
+		Hosts:    Hosts{"router.lan": {netip.MustParseAddr("192.168.1.1")}},
+		Cache:    cache.NewDNSCache(),
+		Upstream: up,
+	}
+
+	m := new(mdns.Msg)
+	m.SetQuestion("Router.LAN.", mdns.TypeA)
+	resp, err := p.Exchange(context.Background(), m)
+	if err != nil || len(resp.Answer) != 1 || resp.Answer[0].(*mdns.A).A.String() != "192.168.1.1" {
+		t.Fatal("static record not served", resp, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m := new(mdns.Msg)
+		m.SetQuestion("example.com.", mdns.TypeA)
+		resp, err := p.Exchange(context.Background(), m)
+		if err != nil || resp.Id != m.Id || len(resp.Answer) != 1 {
+			t.Fatal("unexpected answer", resp, err)
+		}
+	}
+	if up.n != 1 {
+		t.Fatal("cached answer not served, upstream queried", up.n, "times")
+	}
+	t.Log(resp)
+}
@@ -0,0 +1,294 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"tun2proxylib/outbound"
+
+	mdns "github.com/miekg/dns"
+)
+
+// DefaultTimeout bounds an exchange with an upstream server when the
+// context has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+// withTimeout applies DefaultTimeout to ctx unless it has a deadline.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, DefaultTimeout)
+}
+
+// NewUpstream returns the upstream described by raw, whose connections
+// are made through ob:
+//
+//	udp://8.8.8.8:53 or 8.8.8.8, DNS over UDP, retried over TCP when truncated
+//	tcp://8.8.8.8:53, DNS over TCP
+//	tls://dns.google:853, DNS over TLS
+//	https://dns.google/dns-query, DNS over HTTPS
+//
+// Use a direct outbound to reach the server without a proxy.
+func NewUpstream(raw string, ob outbound.Outbound) (Resolver, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in upstream %q", raw)
+	}
+	if u.Scheme != "https" && (u.Path != "" && u.Path != "/" || u.RawQuery != "") {
+		return nil, fmt.Errorf("unexpected path or query in upstream %q", raw)
+	}
+	server := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &UDPUpstream{Server: server("53"), Outbound: ob}, nil
+	case "tcp":
+		return &TCPUpstream{Server: server("53"), Outbound: ob}, nil
+	case "tls":
+		return &TCPUpstream{Server: server("853"), Outbound: ob, TLS: &tls.Config{ServerName: u.Hostname()}}, nil
+	case "https":
+		return &HTTPSUpstream{URL: u.String(), Outbound: ob}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream scheme %q", u.Scheme)
+	}
+}
+
+// UDPUpstream sends queries over UDP to Server, a host:port. Truncated
+// answers are retried over TCP.
+type UDPUpstream struct {
+	Server   string
+	Outbound outbound.Outbound
+}
+
+func (u *UDPUpstream) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := u.Outbound.ListenUDP(ctx, &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	deadline, _ := ctx.Deadline()
+	pc.SetDeadline(deadline)
+
+	if _, err := pc.WriteTo(query, outbound.HostAddr(u.Server)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, mdns.MaxMsgSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := new(mdns.Msg)
+		if resp.Unpack(buf[:n]) != nil || resp.Id != m.Id {
+			// A late answer to an earlier query, or garbage.
+			continue
+		}
+		if resp.Truncated {
+			tcp := &TCPUpstream{Server: u.Server, Outbound: u.Outbound}
+			return tcp.Exchange(ctx, m)
+		}
+		return resp, nil
+	}
+}
+
+// TCPUpstream sends queries over TCP to Server, a host:port, or over
+// TLS when TLS is set.
+type TCPUpstream struct {
+	Server   string
+	Outbound outbound.Outbound
+	TLS      *tls.Config
+}
+
+func (u *TCPUpstream) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	conn, err := u.Outbound.DialTCP(ctx, u.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if u.TLS != nil {
+		tc := tls.Client(conn, u.TLS)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	dc := &mdns.Conn{Conn: conn}
+	if err := dc.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	resp, err := dc.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, mdns.ErrId
+	}
+	return resp, nil
+}
+
+// HTTPSUpstream posts queries to URL as RFC 8484 describes.
+type HTTPSUpstream struct {
+	URL      string
+	Outbound outbound.Outbound
+
+	once   sync.Once
+	client *http.Client
+}
+
+// httpClient returns the client of u, built on first use. The server
+// name is left to the proxy, the local resolver may be the tunnel.
+func (u *HTTPSUpstream) httpClient() *http.Client {
+	u.once.Do(func() {
+		u.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return u.Outbound.DialTCP(outbound.WithRemoteResolve(ctx), addr)
+			},
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   time.Minute,
+		}}
+	})
+	return u.client
+}
+
+func (u *HTTPSUpstream) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// RFC 8484 section 4.1: the ID should be 0 for the sake of HTTP
+	// caches, the original one is put back in the answer.
+	q := m.Copy()
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server answered %s", res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, mdns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(mdns.Msg)
+	if err := resp.Unpack(b); err != nil {
+		return nil, err
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// Group queries several upstreams, one after the other until one
+// answers or, with Parallel, all at once taking the first answer.
+type Group struct {
+	Upstreams []Resolver
+	Parallel  bool
+
+	// Timeout bounds each upstream of a fallback group, so a dead
+	// server leaves time for the next ones. Defaults to DefaultTimeout.
+	// Under a context deadline an upstream gets at most its share of
+	// the time left, split evenly with the upstreams after it.
+	Timeout time.Duration
+}
+
+func (g *Group) Exchange(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	if len(g.Upstreams) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	if g.Parallel {
+		return g.race(ctx, m)
+	}
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	var errs []error
+	for i, u := range g.Upstreams {
+		t := timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			if share := time.Until(deadline) / time.Duration(len(g.Upstreams)-i); share < t {
+				t = share
+			}
+		}
+		uctx, cancel := context.WithTimeout(ctx, t)
+		resp, err := u.Exchange(uctx, m)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (g *Group) race(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	type result struct {
+		resp *mdns.Msg
+		err  error
+	}
+	results := make(chan result, len(g.Upstreams))
+	for _, u := range g.Upstreams {
+		go func() {
+			// Each upstream gets its own copy, some rewrite the ID.
+			resp, err := u.Exchange(ctx, m.Copy())
+			results <- result{resp, err}
+		}()
+	}
+	var errs []error
+	for range g.Upstreams {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,193 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+// plainOutbound dials without a proxy.
+type plainOutbound struct{}
+
+func (plainOutbound) DialTCP(ctx context.Context, target string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", target)
+}
+
+func (plainOutbound) ListenUDP(ctx context.Context, src *net.UDPAddr) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return resolvingConn{pc}, nil
+}
+
+type resolvingConn struct {
+	net.PacketConn
+}
+
+func (c resolvingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+// answer replies 1.2.3.4 to m, truncated if truncate is set.
+func answer(m *mdns.Msg, truncate bool) *mdns.Msg {
+	resp := new(mdns.Msg)
+	resp.SetReply(m)
+	if truncate {
+		resp.Truncated = true
+		return resp
+	}
+	resp.Answer = []mdns.RR{&mdns.A{
+		Hdr: mdns.RR_Header{Name: m.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+		A:   net.IPv4(1, 2, 3, 4),
+	}}
+	return resp
+}
+
+// dnsServer serves truncated answers over UDP and full ones over TCP on
+// the same port.
+func dnsServer(t *testing.T) string {
+	pc, ln := listenBoth(t)
+	udp := &mdns.Server{PacketConn: pc, Handler: mdns.HandlerFunc(func(w mdns.ResponseWriter, m *mdns.Msg) {
+		w.WriteMsg(answer(m, true))
+	})}
+	tcp := &mdns.Server{Listener: ln, Handler: mdns.HandlerFunc(func(w mdns.ResponseWriter, m *mdns.Msg) {
+		w.WriteMsg(answer(m, false))
+	})}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+// listenBoth listens on a UDP port and the same TCP one, another port
+// is tried when the TCP one is taken.
+func listenBoth(t *testing.T) (net.PacketConn, net.Listener) {
+	for range 10 {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, ln
+		}
+		pc.Close()
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("no port free for both UDP and TCP")
+	return nil, nil
+}
+
+func check(t *testing.T, r Resolver) {
+	t.Helper()
+	m := new(mdns.Msg)
+	m.SetQuestion("example.com.", mdns.TypeA)
+	resp, err := r.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != m.Id || len(resp.Answer) != 1 {
+		t.Fatal("unexpected answer", resp)
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	server := dnsServer(t)
+
+	udp, err := NewUpstream(server, plainOutbound{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, udp) // truncated over UDP, retried over TCP
+
+	tcp, _ := NewUpstream("tcp://"+server, plainOutbound{})
+	check(t, tcp)
+
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		m := new(mdns.Msg)
+		if r.Header.Get("Content-Type") != "application/dns-message" || m.Unpack(b) != nil || m.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		out, _ := answer(m, false).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	defer doh.Close()
+	// The client is shared by concurrent queries.
+	https := &HTTPSUpstream{URL: doh.URL + "/dns-query", Outbound: plainOutbound{}}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check(t, https)
+		}()
+	}
+	wg.Wait()
+
+	// The first server of a fallback group is dead.
+	dead, _ := NewUpstream("tcp://127.0.0.1:1", plainOutbound{})
+	check(t, &Group{Upstreams: []Resolver{dead, tcp}})
+	check(t, &Group{Upstreams: []Resolver{dead, udp}, Parallel: true})
+
+	if r, err := NewUpstream("tls://dns.google", plainOutbound{}); err != nil ||
+		r.(*TCPUpstream).Server != "dns.google:853" || r.(*TCPUpstream).TLS.ServerName != "dns.google" {
+		t.Fatal("unexpected tls upstream", r, err)
+	}
+	if r, err := NewUpstream("https://dns.google/dns-query", plainOutbound{}); err != nil ||
+		r.(*HTTPSUpstream).URL != "https://dns.google/dns-query" {
+		t.Fatal("unexpected https upstream", r, err)
+	}
+	if _, err := NewUpstream("quic://dns.google", plainOutbound{}); err == nil {
+		t.Fatal("unknown scheme accepted")
+	}
+}
+
+// TestGroupDeadline checks a fallback group gets to its second upstream
+// before the deadline of the query when the first never answers.
+func TestGroupDeadline(t *testing.T) {
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	dead, _ := NewUpstream(blackhole.LocalAddr().String(), plainOutbound{})
+	tcp, _ := NewUpstream("tcp://"+dnsServer(t), plainOutbound{})
+
+	g := &Group{Upstreams: []Resolver{dead, tcp}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m := new(mdns.Msg)
+	m.SetQuestion("example.com.", mdns.TypeA)
+	start := time.Now()
+	resp, err := g.Exchange(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("answered in", time.Since(start))
+	if len(resp.Answer) != 1 {
+		t.Fatal("unexpected answer", resp)
+	}
+}
@@ -0,0 +1,132 @@
+// Package router picks the outbound of every flow from an ordered list
+// of rules.
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/help"
+	"tun2proxylib/lwipcore/common/dns"
+	"tun2proxylib/tracker"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Reject is the built-in outbound that closes the flows sent to it.
+const Reject = "reject"
+
+// DefaultRule is the rule name reported for flows no rule matched.
+const DefaultRule = "default"
+
+// Domain is implemented by connections whose domain was learned by a
+// handler in front of the router, e.g. by sniffing or fake DNS.
+type Domain interface {
+	Domain() string
+}
+
+// Router is a TransportHandler that hands each flow to the outbound of
+// the first matching rule, or to the default outbound.
+type Router struct {
+	rules     []Rule
+	def       string
+	outbounds map[string]gvisorcore.TransportHandler
+
+	// FakeDNS, when set, gives the domain of the flows to its fake IPs.
+	FakeDNS dns.FakeDns
+
+	// Logger receives the routing decision of every flow at debug level.
+	// Defaults to slog.Default.
+	Logger *slog.Logger
+}
+
+// New returns a Router over rules. Every outbound named by the rules and
+// def must be in outbounds, except Reject.
+func New(rules []Rule, def string, outbounds map[string]gvisorcore.TransportHandler) (*Router, error) {
+	r := &Router{
+		rules:     make([]Rule, len(rules)),
+		def:       def,
+		outbounds: outbounds,
+	}
+	copy(r.rules, rules)
+	for i := range r.rules {
+		if r.rules[i].Name == "" {
+			r.rules[i].Name = "#" + strconv.Itoa(i+1)
+		}
+		if err := r.check(r.rules[i].Outbound); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.rules[i].Name, err)
+		}
+	}
+	if err := r.check(def); err != nil {
+		return nil, fmt.Errorf("default rule: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Router) check(name string) error {
+	if name == Reject {
+		return nil
+	}
+	if _, ok := r.outbounds[name]; !ok {
+		return fmt.Errorf("unknown outbound %q", name)
+	}
+	return nil
+}
+
+// Match returns the name of the rule matching m and its outbound.
+func (r *Router) Match(m *Metadata) (rule, outbound string) {
+	for i := range r.rules {
+		if r.rules[i].match(m) {
+			return r.rules[i].Name, r.rules[i].Outbound
+		}
+	}
+	return DefaultRule, r.def
+}
+
+func (r *Router) HandleTCP(conn gvisorcore.TCPConn) {
+	if h := r.route(conn, "tcp", conn.ID()); h != nil {
+		h.HandleTCP(conn)
+		return
+	}
+	conn.Close()
+}
+
+func (r *Router) HandleUDP(conn gvisorcore.UDPConn) {
+	if h := r.route(conn, "udp", conn.ID()); h != nil {
+		h.HandleUDP(conn)
+		return
+	}
+	conn.Close()
+}
+
+// route records the decision for conn and returns its handler, nil for
+// rejected flows.
+func (r *Router) route(conn any, network string, id *stack.TransportEndpointID) gvisorcore.TransportHandler {
+	m := &Metadata{
+		Network:     network,
+		Source:      netip.AddrPortFrom(help.ParseTCPIPAddress(id.RemoteAddress), id.RemotePort),
+		Destination: netip.AddrPortFrom(help.ParseTCPIPAddress(id.LocalAddress), id.LocalPort),
+	}
+	if d, ok := conn.(Domain); ok {
+		m.Domain = d.Domain()
+	}
+	if m.Domain == "" && r.FakeDNS != nil {
+		m.Domain = r.FakeDNS.QueryDomain(m.Destination.Addr().AsSlice())
+	}
+	rule, outbound := r.Match(m)
+	tracker.SetRule(conn, rule)
+	tracker.SetOutbound(conn, outbound)
+	r.logger().Debug("route flow", "network", network, "src", m.Source, "dst", m.Destination,
+		"domain", m.Domain, "rule", rule, "outbound", outbound)
+	return r.outbounds[outbound]
+}
+
+func (r *Router) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,48 @@
+package router
+
+import (
+	"net/netip"
+	"testing"
+
+	"tun2proxylib/gvisorcore"
+)
+
+func TestMatch(t *testing.T) {
+	outbounds := map[string]gvisorcore.TransportHandler{"proxy": nil, "direct": nil}
+	r, err := New([]Rule{
+		{Name: "lan", DestinationCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}, Outbound: "direct"},
+		{Name: "ads", Domains: []string{"ads.example.com"}, Outbound: Reject},
+		{Networks: []string{"udp"}, DestinationPorts: []PortRange{{From: 443, To: 443}}, Outbound: Reject},
+		{SourceCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.9/32")}, Outbound: "direct"},
+	}, "proxy", outbounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddrPort("10.0.0.2:40000")
+	cases := []struct {
+		m              Metadata
+		rule, outbound string
+	}{
+		{Metadata{Network: "tcp", Source: src, Destination: netip.MustParseAddrPort("192.168.1.1:80")}, "lan", "direct"},
+		{Metadata{Network: "tcp", Source: src, Destination: netip.MustParseAddrPort("1.1.1.1:80"), Domain: "x.Ads.example.com."}, "ads", Reject},
+		{Metadata{Network: "tcp", Source: src, Destination: netip.MustParseAddrPort("1.1.1.1:80"), Domain: "badads.example.com"}, DefaultRule, "proxy"},
+		{Metadata{Network: "udp", Source: src, Destination: netip.MustParseAddrPort("1.1.1.1:443")}, "#3", Reject},
+		{Metadata{Network: "tcp", Source: src, Destination: netip.MustParseAddrPort("1.1.1.1:443")}, DefaultRule, "proxy"},
+		{Metadata{Network: "tcp", Source: netip.MustParseAddrPort("10.0.0.9:1"), Destination: netip.MustParseAddrPort("1.1.1.1:443")}, "#4", "direct"},
+	}
+	for _, c := range cases {
+		rule, outbound := r.Match(&c.m)
+		if rule != c.rule || outbound != c.outbound {
+			t.Fatal("unexpected route for", c.m, rule, outbound)
+		}
+		t.Log(c.m.Destination, c.m.Domain, "->", rule, outbound)
+	}
+
+	if _, err := New([]Rule{{Outbound: "vpn"}}, "proxy", outbounds); err == nil {
+		t.Fatal("unknown outbound accepted")
+	}
+	if _, err := ParsePortRange("90-80"); err == nil {
+		t.Fatal("reversed port range accepted")
+	}
+}
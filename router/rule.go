@@ -0,0 +1,105 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Metadata is what rules are matched against. Domain is empty unless a
+// handler in front of the router learned it, see Domain.
+type Metadata struct {
+	Network     string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	Domain      string
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRange parses "443" or "8000-8080".
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+	a, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	b, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || b < a {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: uint16(a), To: uint16(b)}, nil
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// Rule sends the flows it matches to Outbound. Every condition set must
+// match, a condition matches if any of its values does.
+type Rule struct {
+	// Name shows up as the matched rule of a flow, defaults to the
+	// position of the rule.
+	Name string
+
+	Networks         []string // "tcp" or "udp"
+	DestinationCIDRs []netip.Prefix
+	DestinationPorts []PortRange
+	SourceCIDRs      []netip.Prefix
+
+	// Domains match a domain and its subdomains. A rule with domains
+	// never matches a flow whose domain is unknown.
+	Domains []string
+
+	Outbound string
+}
+
+func (r *Rule) match(m *Metadata) bool {
+	if len(r.Networks) > 0 && !matchAny(r.Networks, func(n string) bool { return n == m.Network }) {
+		return false
+	}
+	if len(r.DestinationCIDRs) > 0 && !matchAny(r.DestinationCIDRs, func(p netip.Prefix) bool {
+		return p.Contains(m.Destination.Addr().Unmap())
+	}) {
+		return false
+	}
+	if len(r.DestinationPorts) > 0 && !matchAny(r.DestinationPorts, func(p PortRange) bool {
+		return p.contains(m.Destination.Port())
+	}) {
+		return false
+	}
+	if len(r.SourceCIDRs) > 0 && !matchAny(r.SourceCIDRs, func(p netip.Prefix) bool {
+		return p.Contains(m.Source.Addr().Unmap())
+	}) {
+		return false
+	}
+	if len(r.Domains) > 0 && (m.Domain == "" || !matchAny(r.Domains, func(d string) bool {
+		return matchDomain(d, m.Domain)
+	})) {
+		return false
+	}
+	return true
+}
+
+func matchAny[T any](values []T, fn func(T) bool) bool {
+	for _, v := range values {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether domain is suffix or one of its subdomains.
+func matchDomain(suffix, domain string) bool {
+	suffix = strings.TrimSuffix(strings.ToLower(suffix), ".")
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
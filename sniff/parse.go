@@ -0,0 +1,170 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// tlsServerName returns the server name of a TLS ClientHello, RFC 8446
+// section 4.1.2 and RFC 6066 section 3. Only the first record is
+// looked at, it holds the whole ClientHello in practice.
+func tlsServerName(b []byte) (string, error) {
+	if len(b) < 5 {
+		if len(b) > 0 && b[0] != 0x16 || len(b) > 1 && b[1] != 3 {
+			return "", errNotMatched
+		}
+		return "", errNeedMore
+	}
+	if b[0] != 0x16 || b[1] != 3 {
+		return "", errNotMatched
+	}
+	recLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+recLen {
+		return "", errNeedMore
+	}
+	r := reader(b[5 : 5+recLen])
+
+	// Handshake type and length, then the legacy version and random.
+	if typ, ok := r.u8(); !ok || typ != 1 {
+		return "", errNotMatched
+	}
+	if !r.skip(3 + 2 + 32) {
+		return "", errNotMatched
+	}
+	sessionID, ok1 := r.vec8()
+	_, ok2 := r.vec16() // cipher suites
+	_, ok3 := r.vec8()  // compression methods
+	exts, ok4 := r.vec16()
+	if !ok1 || !ok2 || !ok3 || !ok4 || len(sessionID) > 32 {
+		return "", errNotMatched
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.u16()
+		data, ok2 := exts.vec16()
+		if !ok || !ok2 {
+			return "", errNotMatched
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		list, ok := data.vec16()
+		for ok && len(list) > 0 {
+			nameType, _ := list.u8()
+			name, ok2 := list.vec16()
+			if !ok2 {
+				break
+			}
+			if nameType == 0 {
+				if host := checkHost(string(name)); host != "" {
+					return host, nil
+				}
+			}
+		}
+		return "", errNotMatched
+	}
+	return "", errNotMatched
+}
+
+var methods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// httpHost returns the host of the Host header of an HTTP/1 request.
+func httpHost(b []byte) (string, error) {
+	matched := false
+	for _, m := range methods {
+		n := min(len(b), len(m))
+		if string(b[:n]) == m[:n] {
+			matched = true
+			if n < len(m) {
+				return "", errNeedMore
+			}
+		}
+	}
+	if !matched {
+		return "", errNotMatched
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", errNeedMore
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "host") {
+			host := strings.TrimSpace(value)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if host = checkHost(host); host != "" {
+				return host, nil
+			}
+			break
+		}
+	}
+	return "", errNotMatched
+}
+
+// checkHost returns host lower cased if it is a domain, "" for IPs and
+// garbage.
+func checkHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || len(host) > 253 || strings.ContainsAny(host, " /\\@[]") {
+		return ""
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return ""
+	}
+	return host
+}
+
+// reader consumes the fields of a TLS message.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) u8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) vec8() (reader, bool) {
+	n, ok := r.u8()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *reader) vec16() (reader, bool) {
+	n, ok := r.u16()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,133 @@
+// Package sniff learns the domain of TCP flows from their first bytes:
+// the SNI of a TLS ClientHello or the Host header of an HTTP request.
+package sniff
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/tracker"
+)
+
+// DefaultTimeout is how long the first client bytes are waited for.
+// Protocols where the server speaks first send nothing, so it is kept
+// short.
+const DefaultTimeout = 300 * time.Millisecond
+
+// maxPeek bounds the bytes buffered while sniffing, a TLS record fits.
+const maxPeek = 16*1024 + 5
+
+var (
+	errNeedMore   = errors.New("need more data")
+	errNotMatched = errors.New("not matched")
+)
+
+// Domain returns the domain announced by the client bytes b, "" if b is
+// neither a TLS ClientHello nor an HTTP request with a host name. need
+// is set when b is a prefix of one of them.
+func Domain(b []byte) (domain string, need bool) {
+	for _, parse := range []func([]byte) (string, error){tlsServerName, httpHost} {
+		d, err := parse(b)
+		if err == nil {
+			return d, false
+		}
+		if err == errNeedMore {
+			need = true
+		}
+	}
+	return "", need
+}
+
+// Handler returns a TransportHandler that sniffs the domain of every
+// TCP flow before handing it to next. The conn next gets implements
+// Domain() string. A timeout of 0 means DefaultTimeout.
+func Handler(next gvisorcore.TransportHandler, timeout time.Duration) gvisorcore.TransportHandler {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &handler{next: next, timeout: timeout}
+}
+
+type handler struct {
+	next    gvisorcore.TransportHandler
+	timeout time.Duration
+}
+
+func (h *handler) HandleTCP(conn gvisorcore.TCPConn) {
+	h.next.HandleTCP(h.sniff(conn))
+}
+
+func (h *handler) HandleUDP(conn gvisorcore.UDPConn) {
+	h.next.HandleUDP(conn)
+}
+
+// sniff reads the first bytes of conn until a domain is found, they
+// cannot hold one, or the timeout expires.
+func (h *handler) sniff(conn gvisorcore.TCPConn) *Conn {
+	c := &Conn{TCPConn: conn}
+	deadline := time.Now().Add(h.timeout)
+	buf := make([]byte, maxPeek)
+	n := 0
+	for n < len(buf) {
+		conn.SetReadDeadline(deadline)
+		m, err := conn.Read(buf[n:])
+		n += m
+		domain, need := Domain(buf[:n])
+		if domain != "" || !need {
+			c.domain = domain
+			break
+		}
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				c.err = err
+			}
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	c.peeked = buf[:n]
+	return c
+}
+
+// Conn replays the bytes read while sniffing before reading on.
+type Conn struct {
+	gvisorcore.TCPConn
+	peeked []byte
+	err    error
+	domain string
+}
+
+// Domain returns the sniffed domain, "" if none was found.
+func (c *Conn) Domain() string {
+	return c.domain
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.TCPConn.Read(b)
+}
+
+// The tracker methods of the wrapped conn stay reachable.
+
+func (c *Conn) SetOutbound(name string) {
+	tracker.SetOutbound(c.TCPConn, name)
+}
+
+func (c *Conn) SetRule(name string) {
+	tracker.SetRule(c.TCPConn, name)
+}
+
+func (c *Conn) FlowID() uint64 {
+	id, _ := tracker.FlowID(c.TCPConn)
+	return id
+}
@@ -0,0 +1,93 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	b := make([]byte, maxPeek)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := io.ReadAtLeast(server, b, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return b[:n]
+}
+
+func TestDomain(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+	if d, _ := Domain(hello); d != "example.com" {
+		t.Fatal("unexpected SNI", d)
+	}
+	if d, need := Domain(hello[:len(hello)/2]); d != "" || !need {
+		t.Fatal("partial ClientHello not waited for", d, need)
+	}
+
+	req := []byte("GET / HTTP/1.1\r\nUser-Agent: test\r\nhost: www.example.org:8080\r\n\r\n")
+	if d, _ := Domain(req); d != "www.example.org" {
+		t.Fatal("unexpected Host", d)
+	}
+	if _, need := Domain(req[:20]); !need {
+		t.Fatal("partial request not waited for")
+	}
+	if d, need := Domain([]byte("SSH-2.0-OpenSSH_9.6\r\n")); d != "" || need {
+		t.Fatal("ssh banner matched", d, need)
+	}
+	if d, _ := Domain([]byte("GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n")); d != "" {
+		t.Fatal("IP host accepted", d)
+	}
+}
+
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) ID() *stack.TransportEndpointID { return &stack.TransportEndpointID{} }
+
+type capture struct {
+	conns chan gvisorcore.TCPConn
+}
+
+func (c capture) HandleTCP(conn gvisorcore.TCPConn) { c.conns <- conn }
+func (c capture) HandleUDP(conn gvisorcore.UDPConn) {}
+
+func TestHandler(t *testing.T) {
+	next := capture{conns: make(chan gvisorcore.TCPConn, 1)}
+	h := Handler(next, 50*time.Millisecond)
+
+	// The client speaks first, its bytes are replayed.
+	client, server := net.Pipe()
+	req := "GET / HTTP/1.1\r\nHost: example.net\r\n\r\n"
+	go client.Write([]byte(req))
+	h.HandleTCP(pipeConn{server})
+	conn := (<-next.conns).(*Conn)
+	b := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != req || conn.Domain() != "example.net" {
+		t.Fatal("unexpected replay", string(b), conn.Domain(), err)
+	}
+
+	// The server speaks first, sniffing gives up after the timeout.
+	client, server = net.Pipe()
+	start := time.Now()
+	h.HandleTCP(pipeConn{server})
+	conn = (<-next.conns).(*Conn)
+	if conn.Domain() != "" || time.Since(start) > time.Second {
+		t.Fatal("unexpected sniff", conn.Domain())
+	}
+	go client.Write([]byte("hi"))
+	if _, err := io.ReadFull(conn, b[:2]); err != nil || string(b[:2]) != "hi" {
+		t.Fatal("read after timeout failed", err)
+	}
+	t.Log("gave up after", time.Since(start))
+}
@@ -1,32 +1,35 @@
 package socketbase
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"strconv"
 	"syscall"
+	"tun2proxylib/gvisorcore/dialer"
 	"tun2proxylib/mobile"
 )
 
 func TcpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 	if p == nil {
-		conn, err := net.Dial("tcp", net.JoinHostPort(IP.String(), strconv.Itoa(port)))
+		// Without a protector the socket is bound with the options of
+		// dialer.DefaultDialer instead.
+		conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort(IP.String(), strconv.Itoa(port)))
 		return conn, err
 	}
 
 	//1. prepare address
 	sa, err := netAddrToSockaddr(IP, port)
 	if err != nil {
-		log.Println("prepare sockaddr failed!!!", err)
+		logger().Debug("prepare sockaddr failed", "err", err)
 		return nil, err
 	}
 
 	//2. create socket
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
 	if err != nil {
-		log.Println("create tcp socket failed!!!", err)
+		logger().Debug("create tcp socket failed", "err", err)
 		return nil, err
 	}
 	// release fd, because net.FileConn will dup it
@@ -35,21 +38,21 @@ func TcpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 	//3. protect socket
 	ret := p.Protect(fd)
 	if ret != 0 {
-		log.Println("protect tcp socket failed!!!", ret)
+		logger().Warn("protect tcp socket failed", "ret", ret)
 		return nil, syscall.EINVAL
 	}
 
 	//4. set attribute
 	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, 128)
 	if err != nil {
-		log.Println("set socket attributes ", err)
+		logger().Debug("set socket attributes failed", "err", err)
 		return nil, err
 	}
 
 	//5. connect
 	err = syscall.Connect(fd, sa)
 	if err != nil {
-		log.Println("tcp connect failed!!!", err)
+		logger().Debug("tcp connect failed", "err", err)
 		return nil, err
 	}
 
@@ -59,20 +62,20 @@ func TcpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 
 func UdpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 	if p == nil {
-		conn, err := net.Dial("udp", net.JoinHostPort(IP.String(), strconv.Itoa(port)))
+		conn, err := dialer.DialContext(context.Background(), "udp", net.JoinHostPort(IP.String(), strconv.Itoa(port)))
 		return conn, err
 	}
 
 	//1. prepare address
 	sa, err := netAddrToSockaddr(IP, port)
 	if err != nil {
-		log.Println("prepare sockaddr failed!!!", err)
+		logger().Debug("prepare sockaddr failed", "err", err)
 		return nil, err
 	}
 
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
 	if err != nil {
-		log.Println("create udp socket failed!!!", err)
+		logger().Debug("create udp socket failed", "err", err)
 		return nil, err
 	}
 	defer syscall.Close(fd)
@@ -80,14 +83,14 @@ func UdpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 	//3. protect socket
 	ret := p.Protect(fd)
 	if ret != 0 {
-		log.Println("protect tcp socket failed!!!", ret)
+		logger().Warn("protect udp socket failed", "ret", ret)
 		return nil, syscall.EINVAL
 	}
 
 	//4. connect
 	err = syscall.Connect(fd, sa)
 	if err != nil {
-		log.Println("tcp connect failed!!!", err)
+		logger().Debug("udp connect failed", "err", err)
 		return nil, err
 	}
 
@@ -95,6 +98,39 @@ func UdpDail(IP net.IP, port int, p mobile.ProtectSocket) (net.Conn, error) {
 	return fdToConn(uintptr(fd))
 }
 
+// UdpListen returns an unconnected UDP socket protected by p, used to
+// send datagrams to several destinations.
+func UdpListen(p mobile.ProtectSocket) (net.PacketConn, error) {
+	if p == nil {
+		return dialer.ListenPacket("udp", "")
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		logger().Debug("create udp socket failed", "err", err)
+		return nil, err
+	}
+
+	ret := p.Protect(fd)
+	if ret != 0 {
+		syscall.Close(fd)
+		logger().Warn("protect udp socket failed", "ret", ret)
+		return nil, syscall.EINVAL
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrInet4{})
+	if err != nil {
+		syscall.Close(fd)
+		logger().Debug("udp bind failed", "err", err)
+		return nil, err
+	}
+
+	// net.FilePacketConn dups the fd, the file owns the original one.
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("socket-%d", fd))
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
 func TcpDailNetString(netString string, p mobile.ProtectSocket) (net.Conn, error) {
 	host, portStr, err := net.SplitHostPort(netString)
 	if err != nil {
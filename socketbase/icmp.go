@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package socketbase
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"tun2proxylib/mobile"
+)
+
+// IcmpListen returns an unprivileged ICMP datagram socket, ICMPv6 when
+// ipv6 is set, protected by p unless p is nil. Echo requests written to
+// it get their identifier from the kernel and only the matching replies
+// are read back. On Linux the process must be in
+// net.ipv4.ping_group_range, both families included.
+func IcmpListen(ipv6 bool, p mobile.ProtectSocket) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if ipv6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa = &syscall.SockaddrInet6{}
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		logger().Debug("create icmp socket failed", "err", err)
+		return nil, err
+	}
+
+	if p != nil {
+		ret := p.Protect(fd)
+		if ret != 0 {
+			syscall.Close(fd)
+			logger().Warn("protect icmp socket failed", "ret", ret)
+			return nil, syscall.EINVAL
+		}
+	}
+
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		syscall.Close(fd)
+		logger().Debug("icmp bind failed", "err", err)
+		return nil, err
+	}
+
+	// net.FilePacketConn dups the fd, the file owns the original one.
+	// The datagram socket comes back as a *net.UDPConn whose port is
+	// ignored.
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("socket-%d", fd))
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
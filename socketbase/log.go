@@ -0,0 +1,21 @@
+package socketbase
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var baseLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger used when creating sockets. A nil l restores
+// slog.Default.
+func SetLogger(l *slog.Logger) {
+	baseLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := baseLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,121 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"tun2proxylib/gvisorcore"
+)
+
+type handler struct {
+	t    *Tracker
+	next gvisorcore.TransportHandler
+}
+
+func (h *handler) HandleTCP(conn gvisorcore.TCPConn) {
+	h.next.HandleTCP(&tcpConn{TCPConn: conn, t: h.t, f: h.t.add("tcp", conn.ID())})
+}
+
+func (h *handler) HandleUDP(conn gvisorcore.UDPConn) {
+	h.next.HandleUDP(&udpConn{UDPConn: conn, t: h.t, f: h.t.add("udp", conn.ID())})
+}
+
+type tcpConn struct {
+	gvisorcore.TCPConn
+	t    *Tracker
+	f    *flow
+	once sync.Once
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	n, err := c.TCPConn.Read(b)
+	c.f.addUpload(n)
+	return n, err
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	n, err := c.TCPConn.Write(b)
+	c.f.addDownload(n)
+	return n, err
+}
+
+func (c *tcpConn) Close() error {
+	c.once.Do(func() { c.t.remove(c.f) })
+	return c.TCPConn.Close()
+}
+
+func (c *tcpConn) SetOutbound(name string) {
+	c.f.outbound.Store(name)
+}
+
+func (c *tcpConn) SetRule(name string) {
+	c.f.rule.Store(name)
+}
+
+func (c *tcpConn) FlowID() uint64 {
+	return c.f.id
+}
+
+type udpConn struct {
+	gvisorcore.UDPConn
+	t    *Tracker
+	f    *flow
+	once sync.Once
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	c.f.addUpload(n)
+	return n, err
+}
+
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	c.f.addUpload(n)
+	return n, addr, err
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	n, err := c.UDPConn.Write(b)
+	c.f.addDownload(n)
+	return n, err
+}
+
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.UDPConn.WriteTo(b, addr)
+	c.f.addDownload(n)
+	return n, err
+}
+
+func (c *udpConn) Close() error {
+	c.once.Do(func() { c.t.remove(c.f) })
+	return c.UDPConn.Close()
+}
+
+func (c *udpConn) SetOutbound(name string) {
+	c.f.outbound.Store(name)
+}
+
+func (c *udpConn) SetRule(name string) {
+	c.f.rule.Store(name)
+}
+
+func (c *udpConn) FlowID() uint64 {
+	return c.f.id
+}
+
+// Reverse tracks the reverse flows of c as flows of their own, see
+// gvisorcore.ReverseUDPConn.
+func (c *udpConn) Reverse(remote netip.AddrPort) (gvisorcore.UDPConn, error) {
+	r, ok := c.UDPConn.(gvisorcore.ReverseUDPConn)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	conn, err := r.Reverse(remote)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{UDPConn: conn, t: c.t, f: c.t.add("udp", conn.ID())}, nil
+}
@@ -0,0 +1,217 @@
+// Package tracker keeps a live table of the flows going through the
+// tunnel together with their traffic statistics.
+package tracker
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/gvisorcore/help"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Flow is a snapshot of a tracked flow. Upload counts the bytes sent by
+// the local client, Download the bytes written back to it.
+type Flow struct {
+	ID          uint64
+	Network     string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	Outbound    string
+	Rule        string
+	Start       time.Time
+	LastActive  time.Time
+	Upload      uint64
+	Download    uint64
+}
+
+type flow struct {
+	id          uint64
+	network     string
+	source      netip.AddrPort
+	destination netip.AddrPort
+	start       time.Time
+
+	outbound   atomic.Value // string
+	rule       atomic.Value // string
+	lastActive atomic.Int64
+	upload     atomic.Uint64
+	download   atomic.Uint64
+}
+
+func (f *flow) snapshot() Flow {
+	outbound, _ := f.outbound.Load().(string)
+	rule, _ := f.rule.Load().(string)
+	return Flow{
+		ID:          f.id,
+		Network:     f.network,
+		Source:      f.source,
+		Destination: f.destination,
+		Outbound:    outbound,
+		Rule:        rule,
+		Start:       f.start,
+		LastActive:  time.Unix(0, f.lastActive.Load()),
+		Upload:      f.upload.Load(),
+		Download:    f.download.Load(),
+	}
+}
+
+func (f *flow) addUpload(n int) {
+	if n > 0 {
+		f.upload.Add(uint64(n))
+		f.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+func (f *flow) addDownload(n int) {
+	if n > 0 {
+		f.download.Add(uint64(n))
+		f.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// Tracker records every flow passed through its Handler.
+type Tracker struct {
+	mu     sync.RWMutex
+	flows  map[uint64]*flow
+	nextID atomic.Uint64
+
+	// Traffic of the flows that are already closed.
+	closedUpload   atomic.Uint64
+	closedDownload atomic.Uint64
+}
+
+func New() *Tracker {
+	return &Tracker{flows: make(map[uint64]*flow)}
+}
+
+// Handler returns a TransportHandler that tracks every flow before
+// handing it to next.
+func (t *Tracker) Handler(next gvisorcore.TransportHandler) gvisorcore.TransportHandler {
+	return &handler{t: t, next: next}
+}
+
+func (t *Tracker) add(network string, id *stack.TransportEndpointID) *flow {
+	now := time.Now()
+	f := &flow{
+		id:          t.nextID.Add(1),
+		network:     network,
+		source:      netip.AddrPortFrom(help.ParseTCPIPAddress(id.RemoteAddress), id.RemotePort),
+		destination: netip.AddrPortFrom(help.ParseTCPIPAddress(id.LocalAddress), id.LocalPort),
+		start:       now,
+	}
+	f.lastActive.Store(now.UnixNano())
+
+	t.mu.Lock()
+	t.flows[f.id] = f
+	t.mu.Unlock()
+	return f
+}
+
+func (t *Tracker) remove(f *flow) {
+	t.mu.Lock()
+	_, ok := t.flows[f.id]
+	delete(t.flows, f.id)
+	t.mu.Unlock()
+	if ok {
+		t.closedUpload.Add(f.upload.Load())
+		t.closedDownload.Add(f.download.Load())
+	}
+}
+
+// Len returns the number of live TCP and UDP flows.
+func (t *Tracker) Len() (tcp, udp int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, f := range t.flows {
+		if f.network == "tcp" {
+			tcp++
+		} else {
+			udp++
+		}
+	}
+	return tcp, udp
+}
+
+// Traffic returns the bytes uploaded and downloaded by all flows seen
+// so far, live or closed.
+func (t *Tracker) Traffic() (upload, download uint64) {
+	upload, download = t.closedUpload.Load(), t.closedDownload.Load()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, f := range t.flows {
+		upload += f.upload.Load()
+		download += f.download.Load()
+	}
+	return upload, download
+}
+
+// Snapshot returns the live flows ordered by ID.
+func (t *Tracker) Snapshot() []Flow {
+	t.mu.RLock()
+	flows := make([]Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f.snapshot())
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(flows, func(i, j int) bool { return flows[i].ID < flows[j].ID })
+	return flows
+}
+
+// Range calls fn for every live flow until fn returns false. The table
+// is not locked while fn runs.
+func (t *Tracker) Range(fn func(Flow) bool) {
+	t.mu.RLock()
+	flows := make([]*flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f)
+	}
+	t.mu.RUnlock()
+
+	for _, f := range flows {
+		if !fn(f.snapshot()) {
+			return
+		}
+	}
+}
+
+// Lookup returns the live flow with the given ID.
+func (t *Tracker) Lookup(id uint64) (Flow, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f, ok := t.flows[id]
+	if !ok {
+		return Flow{}, false
+	}
+	return f.snapshot(), true
+}
+
+// SetOutbound records the outbound chosen for conn if conn is tracked.
+// Handlers call it once they know where a flow goes.
+func SetOutbound(conn any, name string) {
+	if s, ok := conn.(interface{ SetOutbound(string) }); ok {
+		s.SetOutbound(name)
+	}
+}
+
+// SetRule records the routing rule that matched conn if conn is
+// tracked.
+func SetRule(conn any, name string) {
+	if s, ok := conn.(interface{ SetRule(string) }); ok {
+		s.SetRule(name)
+	}
+}
+
+// FlowID returns the tracker ID of conn if conn is tracked.
+func FlowID(conn any) (uint64, bool) {
+	if f, ok := conn.(interface{ FlowID() uint64 }); ok {
+		return f.FlowID(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,161 @@
+package tracker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"tun2proxylib/gvisorcore"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func endpointID(src, dst string) stack.TransportEndpointID {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	return stack.TransportEndpointID{
+		LocalAddress:  tcpip.AddrFromSlice(d.Addr().AsSlice()),
+		LocalPort:     d.Port(),
+		RemoteAddress: tcpip.AddrFromSlice(s.Addr().AsSlice()),
+		RemotePort:    s.Port(),
+	}
+}
+
+type fakeTCP struct {
+	net.Conn
+	id stack.TransportEndpointID
+}
+
+func (c *fakeTCP) ID() *stack.TransportEndpointID { return &c.id }
+
+type fakeUDP struct {
+	net.Conn
+	id stack.TransportEndpointID
+}
+
+func (c *fakeUDP) ID() *stack.TransportEndpointID { return &c.id }
+
+func (c *fakeUDP) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Conn.Read(b)
+	return n, nil, err
+}
+
+func (c *fakeUDP) WriteTo(b []byte, _ net.Addr) (int, error) { return c.Conn.Write(b) }
+
+// reverseUDP opens reverse flows, see gvisorcore.ReverseUDPConn.
+type reverseUDP struct {
+	fakeUDP
+}
+
+func (c *reverseUDP) Reverse(remote netip.AddrPort) (gvisorcore.UDPConn, error) {
+	client := netip.AddrPortFrom(netip.AddrFrom4(c.id.RemoteAddress.As4()), c.id.RemotePort)
+	local, _ := net.Pipe()
+	return &fakeUDP{Conn: local, id: endpointID(client.String(), remote.String())}, nil
+}
+
+// capture keeps the tracked conns handed to it.
+type capture struct {
+	tcp []gvisorcore.TCPConn
+	udp []gvisorcore.UDPConn
+}
+
+func (c *capture) HandleTCP(conn gvisorcore.TCPConn) { c.tcp = append(c.tcp, conn) }
+func (c *capture) HandleUDP(conn gvisorcore.UDPConn) { c.udp = append(c.udp, conn) }
+
+func TestTracker(t *testing.T) {
+	for _, c := range []struct {
+		network string
+		handle  func(h gvisorcore.TransportHandler, local net.Conn, id stack.TransportEndpointID) net.Conn
+	}{
+		{"tcp", func(h gvisorcore.TransportHandler, local net.Conn, id stack.TransportEndpointID) net.Conn {
+			capt := h.(*handler).next.(*capture)
+			h.HandleTCP(&fakeTCP{Conn: local, id: id})
+			return capt.tcp[len(capt.tcp)-1]
+		}},
+		{"udp", func(h gvisorcore.TransportHandler, local net.Conn, id stack.TransportEndpointID) net.Conn {
+			capt := h.(*handler).next.(*capture)
+			h.HandleUDP(&fakeUDP{Conn: local, id: id})
+			return capt.udp[len(capt.udp)-1]
+		}},
+	} {
+		t.Run(c.network, func(t *testing.T) {
+			tr := New()
+			h := tr.Handler(&capture{})
+			local, peer := net.Pipe()
+			defer peer.Close()
+			conn := c.handle(h, local, endpointID("10.0.0.2:5000", "1.1.1.1:443"))
+
+			SetOutbound(conn, "proxy")
+			SetRule(conn, "domain_suffix")
+			id, ok := FlowID(conn)
+			if !ok {
+				t.Fatal("conn not tracked")
+			}
+
+			// Reads of the handler are uploads, its writes downloads.
+			go peer.Write([]byte("hello"))
+			buf := make([]byte, 16)
+			if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+				t.Fatal(err)
+			}
+			go io.ReadFull(peer, buf[:3])
+			if _, err := conn.Write([]byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+
+			f, ok := tr.Lookup(id)
+			t.Logf("%+v", f)
+			if !ok || f.Network != c.network || f.Upload != 5 || f.Download != 3 ||
+				f.Outbound != "proxy" || f.Rule != "domain_suffix" ||
+				f.Source.String() != "10.0.0.2:5000" || f.Destination.String() != "1.1.1.1:443" {
+				t.Fatal("unexpected flow", f)
+			}
+			if tcp, udp := tr.Len(); tcp+udp != 1 {
+				t.Fatal("unexpected count", tcp, udp)
+			}
+
+			conn.Close()
+			conn.Close()
+			if _, ok := tr.Lookup(id); ok || len(tr.Snapshot()) != 0 {
+				t.Fatal("closed flow still tracked")
+			}
+			if up, down := tr.Traffic(); up != 5 || down != 3 {
+				t.Fatal("traffic of the closed flow lost", up, down)
+			}
+		})
+	}
+}
+
+func TestReverse(t *testing.T) {
+	tr := New()
+	capt := &capture{}
+	h := tr.Handler(capt)
+	local, _ := net.Pipe()
+	h.HandleUDP(&reverseUDP{fakeUDP{Conn: local, id: endpointID("10.0.0.2:5000", "1.1.1.1:3478")}})
+	local, _ = net.Pipe()
+	h.HandleUDP(&fakeUDP{Conn: local, id: endpointID("10.0.0.2:5001", "1.1.1.1:3478")})
+
+	rc, err := capt.udp[0].(gvisorcore.ReverseUDPConn).Reverse(netip.MustParseAddrPort("8.8.8.8:40000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := FlowID(rc)
+	if !ok {
+		t.Fatal("reverse flow not tracked")
+	}
+	f, _ := tr.Lookup(id)
+	t.Logf("%+v", f)
+	if f.Source.String() != "10.0.0.2:5000" || f.Destination.String() != "8.8.8.8:40000" {
+		t.Fatal("unexpected reverse flow", f)
+	}
+	rc.Close()
+	if _, ok := tr.Lookup(id); ok {
+		t.Fatal("closed reverse flow still tracked")
+	}
+
+	if _, err := capt.udp[1].(gvisorcore.ReverseUDPConn).Reverse(netip.MustParseAddrPort("8.8.8.8:40000")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatal("reverse of a plain flow:", err)
+	}
+}
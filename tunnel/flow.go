@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// endpointID builds the gvisor style id of a flow from src to dst: the
+// local end of a tunneled flow is its destination.
+func endpointID(src, dst netip.AddrPort) stack.TransportEndpointID {
+	return stack.TransportEndpointID{
+		LocalPort:     dst.Port(),
+		LocalAddress:  tcpipAddr(dst.Addr()),
+		RemotePort:    src.Port(),
+		RemoteAddress: tcpipAddr(src.Addr()),
+	}
+}
+
+func tcpipAddr(ip netip.Addr) tcpip.Address {
+	if !ip.IsValid() {
+		return tcpip.Address{}
+	}
+	return tcpip.AddrFromSlice(ip.Unmap().AsSlice())
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.AddrPort()
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.AddrPort()
+		}
+	}
+	return netip.AddrPort{}
+}
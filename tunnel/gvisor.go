@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type gvisorBackend struct {
+	opts Options
+
+	mu     sync.Mutex
+	engine *gvisorcore.Engine
+	done   chan struct{}
+}
+
+func newGVisorBackend(opts Options) (Backend, error) {
+	return &gvisorBackend{opts: opts, done: make(chan struct{})}, nil
+}
+
+func (b *gvisorBackend) Start(h Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.engine != nil {
+		return gvisorcore.ErrEngineRunning
+	}
+	e := gvisorcore.NewEngine(gvisorcore.EngineOptions{
+		FD:               b.opts.FD,
+		MTU:              b.opts.MTU,
+		TransportHandler: h,
+		Logger:           b.opts.Logger,
+		StackOptions:     b.opts.StackOptions,
+		ICMP:             b.opts.ICMP,
+	})
+	if err := e.Start(); err != nil {
+		return err
+	}
+	b.engine = e
+	go func() {
+		e.Wait()
+		close(b.done)
+	}()
+	return nil
+}
+
+// Engine returns the gvisorcore engine once the backend is started.
+func (b *gvisorBackend) Engine() *gvisorcore.Engine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.engine
+}
+
+// Stack returns the stack of the running engine, nil otherwise.
+func (b *gvisorBackend) Stack() *stack.Stack {
+	if e := b.Engine(); e != nil {
+		return e.Stack()
+	}
+	return nil
+}
+
+func (b *gvisorBackend) Stop(timeout time.Duration) error {
+	b.mu.Lock()
+	e := b.engine
+	b.mu.Unlock()
+	if e == nil {
+		return ErrStopped
+	}
+	if err := e.Stop(timeout); err != gvisorcore.ErrEngineStopped {
+		return err
+	}
+	return ErrStopped
+}
+
+func (b *gvisorBackend) Wait() {
+	<-b.done
+}
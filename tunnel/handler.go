@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"tun2proxylib/gvisorcore/buffer"
+	"tun2proxylib/lwipcore/core"
+)
+
+// udpIdleTimeout closes UDP flows handed to lwip style handlers after
+// this long without a datagram from the client.
+const udpIdleTimeout = 60 * time.Second
+
+// FromLWIP returns a Handler running the lwip style connection handlers,
+// e.g. those of lwipcore/proxy/socks, so they can be used on any backend.
+func FromLWIP(tcp core.TCPConnHandler, udp core.UDPConnHandler) Handler {
+	return &lwipHandlers{tcp: tcp, udp: udp}
+}
+
+type lwipHandlers struct {
+	tcp core.TCPConnHandler
+	udp core.UDPConnHandler
+}
+
+func (h *lwipHandlers) HandleTCP(conn TCPConn) {
+	id := conn.ID()
+	target := &net.TCPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+	if err := h.tcp.Handle(conn, target); err != nil {
+		conn.Close()
+	}
+}
+
+func (h *lwipHandlers) HandleUDP(conn UDPConn) {
+	id := conn.ID()
+	c := &coreUDPConn{
+		conn:    conn,
+		handler: h.udp,
+		local:   &net.UDPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)},
+	}
+	target := &net.UDPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+
+	go func() {
+		defer c.Close()
+		if err := h.udp.Connect(c, target); err != nil {
+			return
+		}
+
+		buf := buffer.Get()
+		defer buffer.Put(buf)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if err := c.ReceiveTo(buf[:n], target); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// coreUDPConn presents a UDP flow as the core.UDPConn the lwip style
+// handlers expect.
+type coreUDPConn struct {
+	conn    UDPConn
+	handler core.UDPConnHandler
+	local   *net.UDPAddr
+	closed  atomic.Bool
+}
+
+func (c *coreUDPConn) LocalAddr() *net.UDPAddr {
+	return c.local
+}
+
+func (c *coreUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	return c.handler.ReceiveTo(c, data, addr)
+}
+
+// WriteFrom writes data to the client. The source address of a flow is
+// fixed to its destination, so addr is not consulted.
+func (c *coreUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return c.conn.WriteTo(data, c.local)
+}
+
+func (c *coreUDPConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	err := c.conn.Close()
+	// Let handlers that keep per connection state release it.
+	if closer, ok := c.handler.(interface{ Close(core.UDPConn) }); ok {
+		closer.Close(c)
+	}
+	return err
+}
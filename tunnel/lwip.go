@@ -0,0 +1,124 @@
+//go:build !windows
+// +build !windows
+
+package tunnel
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/lwipcore/core"
+)
+
+// lwIP keeps its state in globals, only one lwip backend can run at a time.
+var lwipInUse atomic.Bool
+
+type lwipBackend struct {
+	opts Options
+
+	mu      sync.Mutex
+	started bool
+	dev     *os.File
+	stack   core.LWIPStack
+	flows   *gvisorcore.FlowSet
+	reading sync.WaitGroup
+	done    chan struct{}
+}
+
+func newLWIPBackend(opts Options) (Backend, error) {
+	return &lwipBackend{opts: opts, flows: gvisorcore.NewFlowSet(), done: make(chan struct{})}, nil
+}
+
+func (b *lwipBackend) Start(h Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started {
+		return errors.New("lwip backend already started")
+	}
+	if !lwipInUse.CompareAndSwap(false, true) {
+		return errors.New("another lwip backend is running")
+	}
+
+	// A non-blocking fd lets the runtime poller interrupt the read
+	// loop when the device is closed.
+	if err := unix.SetNonblock(b.opts.FD, true); err != nil {
+		lwipInUse.Store(false)
+		return err
+	}
+	dev := os.NewFile(uintptr(b.opts.FD), "tun")
+
+	if b.opts.Logger != nil {
+		core.SetLogger(b.opts.Logger)
+	}
+	core.RegisterTCPConnHandler(&lwipTCPHandler{h: h, flows: b.flows})
+	core.RegisterUDPConnHandler(newLWIPUDPHandler(h, b.flows))
+	core.RegisterOutputFn(dev.Write)
+
+	s := core.NewLWIPStack()
+	if s == nil {
+		dev.Close()
+		lwipInUse.Store(false)
+		return errors.New("create lwip stack failed")
+	}
+
+	b.dev = dev
+	b.stack = s
+	b.started = true
+	b.reading.Add(1)
+	go b.readLoop()
+	return nil
+}
+
+func (b *lwipBackend) readLoop() {
+	defer b.reading.Done()
+
+	mtu := int(b.opts.MTU)
+	if mtu <= 0 {
+		mtu = 1500
+	}
+	buf := make([]byte, mtu)
+	for {
+		n, err := b.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		b.stack.Write(buf[:n])
+	}
+}
+
+func (b *lwipBackend) Stop(timeout time.Duration) error {
+	b.mu.Lock()
+	if !b.started || b.stack == nil {
+		b.mu.Unlock()
+		return ErrStopped
+	}
+	s, dev := b.stack, b.dev
+	b.stack = nil
+	b.mu.Unlock()
+
+	b.flows.Shutdown(timeout)
+
+	core.RegisterTCPConnHandler(nil)
+	core.RegisterUDPConnHandler(nil)
+	// The read loop must be done before the stack goes, it would feed
+	// packets to a closed stack.
+	err := dev.Close()
+	b.reading.Wait()
+	s.Close()
+	core.RegisterOutputFn(func([]byte) (int, error) {
+		return 0, ErrStopped
+	})
+
+	lwipInUse.Store(false)
+	close(b.done)
+	return err
+}
+
+func (b *lwipBackend) Wait() {
+	<-b.done
+}
@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"tun2proxylib/gvisorcore"
+	"tun2proxylib/lwipcore/core"
+)
+
+// udpQueueLen is the number of datagrams queued per UDP flow before
+// new ones are dropped.
+const udpQueueLen = 64
+
+// lwipTCPHandler hands the TCP connections accepted by lwIP to a Handler.
+type lwipTCPHandler struct {
+	h     Handler
+	flows *gvisorcore.FlowSet
+}
+
+func (a *lwipTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	// lwIP names the client end of the connection LocalAddr.
+	c := &lwipTCPConn{
+		Conn:  conn,
+		id:    endpointID(addrPort(conn.LocalAddr()), addrPort(target)),
+		flows: a.flows,
+	}
+	if !a.flows.Add(c) {
+		return ErrStopped
+	}
+	a.h.HandleTCP(c)
+	return nil
+}
+
+type lwipTCPConn struct {
+	net.Conn
+	id    stack.TransportEndpointID
+	flows *gvisorcore.FlowSet
+	once  sync.Once
+	err   error
+}
+
+func (c *lwipTCPConn) ID() *stack.TransportEndpointID {
+	return &c.id
+}
+
+func (c *lwipTCPConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.Conn.Close()
+		c.flows.Remove(c)
+	})
+	return c.err
+}
+
+type lwipUDPKey struct {
+	conn   core.UDPConn
+	target string
+}
+
+// lwipUDPHandler splits the per-source UDP connections of lwIP into one
+// flow per destination, the way gvisor forwards them.
+type lwipUDPHandler struct {
+	h     Handler
+	flows *gvisorcore.FlowSet
+
+	mu    sync.Mutex
+	conns map[lwipUDPKey]*lwipUDPConn
+}
+
+func newLWIPUDPHandler(h Handler, flows *gvisorcore.FlowSet) *lwipUDPHandler {
+	return &lwipUDPHandler{
+		h:     h,
+		flows: flows,
+		conns: make(map[lwipUDPKey]*lwipUDPConn),
+	}
+}
+
+// Connect does nothing, flows are created by the first datagram to
+// each destination.
+func (a *lwipUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+// ReceiveTo is called from the lwIP thread and must not block.
+func (a *lwipUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	key := lwipUDPKey{conn: conn, target: addr.String()}
+
+	a.mu.Lock()
+	c, ok := a.conns[key]
+	if !ok {
+		c = newLWIPUDPConn(conn, addr, func(c *lwipUDPConn) {
+			a.mu.Lock()
+			if a.conns[key] == c {
+				delete(a.conns, key)
+			}
+			a.mu.Unlock()
+			a.flows.Remove(c)
+		})
+		if !a.flows.Add(c) {
+			a.mu.Unlock()
+			return ErrStopped
+		}
+		a.conns[key] = c
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		go a.h.HandleUDP(c)
+	}
+	c.push(data)
+	return nil
+}
+
+// lwipUDPConn is a UDP flow between a local client and one destination.
+type lwipUDPConn struct {
+	conn    core.UDPConn
+	target  *net.UDPAddr
+	id      stack.TransportEndpointID
+	in      chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	onClose func(*lwipUDPConn)
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func newLWIPUDPConn(conn core.UDPConn, target *net.UDPAddr, onClose func(*lwipUDPConn)) *lwipUDPConn {
+	return &lwipUDPConn{
+		conn:    conn,
+		target:  target,
+		id:      endpointID(addrPort(conn.LocalAddr()), addrPort(target)),
+		in:      make(chan []byte, udpQueueLen),
+		closed:  make(chan struct{}),
+		onClose: onClose,
+	}
+}
+
+func (c *lwipUDPConn) push(data []byte) {
+	select {
+	case c.in <- append([]byte(nil), data...):
+	default:
+		// Queue is full, drop it like a congested link would.
+	}
+}
+
+func (c *lwipUDPConn) ID() *stack.TransportEndpointID {
+	return &c.id
+}
+
+func (c *lwipUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p), c.conn.LocalAddr(), nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-expired:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *lwipUDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// WriteTo sends b to the client from the flow destination; the client
+// is the only peer of a flow, so addr is not consulted.
+func (c *lwipUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.conn.WriteFrom(b, c.target)
+}
+
+func (c *lwipUDPConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, nil)
+}
+
+func (c *lwipUDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.onClose(c)
+	})
+	return nil
+}
+
+// LocalAddr returns the flow destination, RemoteAddr the client, as
+// for gvisor flows.
+func (c *lwipUDPConn) LocalAddr() net.Addr {
+	return c.target
+}
+
+func (c *lwipUDPConn) RemoteAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *lwipUDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *lwipUDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *lwipUDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
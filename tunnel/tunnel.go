@@ -0,0 +1,76 @@
+// Package tunnel puts the lwip and gvisor cores behind one interface:
+// IP packets go in from a tun device and TCP/UDP flows come out to a
+// Handler, whichever core does the work.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"tun2proxylib/gvisorcore"
+)
+
+// Flows are described by the gvisorcore types on both backends, so
+// handlers written for one core run unchanged on the other.
+type (
+	TCPConn = gvisorcore.TCPConn
+	UDPConn = gvisorcore.UDPConn
+	Handler = gvisorcore.TransportHandler
+)
+
+var ErrStopped = errors.New("tunnel stopped")
+
+// Backend turns the packets of a tun device into flows.
+type Backend interface {
+	// Start starts reading packets from the device and hands every
+	// new flow to h.
+	Start(h Handler) error
+
+	// Stop stops accepting flows, gives live flows up to timeout to
+	// finish, aborts the rest and releases the device.
+	Stop(timeout time.Duration) error
+
+	// Wait blocks until the backend is stopped.
+	Wait()
+}
+
+type Kind string
+
+const (
+	GVisor Kind = "gvisor"
+	LWIP   Kind = "lwip"
+)
+
+type Options struct {
+	// FD is the file descriptor of the tun device. The backend takes
+	// ownership of it and closes it on Stop.
+	FD int
+
+	// MTU is the MTU of the tun device.
+	MTU uint32
+
+	// Logger receives the diagnostics of the backend. The lwip core is
+	// global, so its logger is replaced for every lwip backend started.
+	Logger *slog.Logger
+
+	// StackOptions tune the gvisor stack, they are ignored by lwip.
+	StackOptions []gvisorcore.Option
+
+	// ICMP says how the gvisor stack answers echo requests, it is
+	// ignored by lwip.
+	ICMP gvisorcore.ICMPOptions
+}
+
+// New returns a backend of the given kind for the tun device in opts.
+func New(kind Kind, opts Options) (Backend, error) {
+	switch kind {
+	case GVisor:
+		return newGVisorBackend(opts)
+	case LWIP:
+		return newLWIPBackend(opts)
+	default:
+		return nil, fmt.Errorf("unknown tunnel backend %q", kind)
+	}
+}
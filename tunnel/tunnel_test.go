@@ -0,0 +1,108 @@
+//go:build !windows
+// +build !windows
+
+package tunnel
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// holdHandler keeps the UDP flows it gets open, TCP ones are closed.
+type holdHandler chan UDPConn
+
+func (h holdHandler) HandleTCP(conn TCPConn) { conn.Close() }
+func (h holdHandler) HandleUDP(conn UDPConn) { h <- conn }
+
+// tunPair returns the fd of a fake tun device for the backend and the
+// peer end packets are written to.
+func tunPair(t *testing.T) (int, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	return fds[0], fds[1]
+}
+
+// datagram builds an IPv4 UDP packet, without UDP checksum.
+func datagram(src, dst netip.AddrPort, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	u := header.UDP(ip.Payload())
+	u.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(u.Payload(), payload)
+	return b
+}
+
+func TestBackends(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:5000")
+	server := netip.MustParseAddrPort("1.1.1.1:53")
+	for _, kind := range []Kind{GVisor, LWIP} {
+		t.Run(string(kind), func(t *testing.T) {
+			fd, peer := tunPair(t)
+			b, err := New(kind, Options{FD: fd, MTU: 1500})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Stop(0); err != ErrStopped {
+				t.Fatal("Stop before Start:", err)
+			}
+			h := make(holdHandler, 1)
+			if err := b.Start(h); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Start(h); err == nil {
+				t.Fatal("second Start succeeded")
+			}
+
+			if _, err := unix.Write(peer, datagram(client, server, []byte("query"))); err != nil {
+				t.Fatal(err)
+			}
+			var conn UDPConn
+			select {
+			case conn = <-h:
+			case <-time.After(2 * time.Second):
+				t.Fatal("no flow")
+			}
+			t.Log("flow", conn.ID().RemoteAddress, "->", conn.ID().LocalAddress)
+
+			// The held flow is given the drain timeout, then aborted.
+			start := time.Now()
+			if err := b.Stop(100 * time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d < 100*time.Millisecond {
+				t.Fatal("stopped in", d)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					break
+				}
+			}
+			b.Wait()
+			if err := b.Stop(0); err != ErrStopped {
+				t.Fatal("second Stop:", err)
+			}
+		})
+	}
+}
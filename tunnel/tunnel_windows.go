@@ -0,0 +1,11 @@
+package tunnel
+
+import "errors"
+
+func newGVisorBackend(opts Options) (Backend, error) {
+	return nil, errors.New("gvisor backend is not supported on windows")
+}
+
+func newLWIPBackend(opts Options) (Backend, error) {
+	return nil, errors.New("lwip backend is not supported on windows")
+}
@@ -44,41 +44,11 @@ func PackUDPData(target, src *net.UDPAddr, payload []byte) (full []byte, err err
 	return buffer.Bytes(), nil
 }
 
+// UnpackUDPData decodes a packet of either version, see Decode.
 func UnpackUDPData(data []byte) (target, src *net.UDPAddr, payload []byte, err error) {
-	if len(data) < 4 {
-		return nil, nil, nil, errors.New("data too short")
+	p, err := Decode(data)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-
-	var idx = 0
-	ipLen := int(data[idx])
-	idx++
-
-	var targetIP, srcIP net.IP
-	targetIP = net.IP(data[idx : idx+int(ipLen)])
-	idx += int(ipLen)
-	targetPort := int(data[idx])<<8 | int(data[idx+1])
-	idx += 2
-
-	ipLen = int(data[idx])
-	idx++
-	srcIP = net.IP(data[idx : idx+int(ipLen)])
-	idx += int(ipLen)
-	srcPort := int(data[idx])<<8 | int(data[idx+1])
-	idx += 2
-
-	payloadLen := uint32(data[idx])<<24 | uint32(data[idx+1])<<16 | uint32(data[idx+2])<<8 | uint32(data[idx+3])
-	idx += 4
-
-	payload = data[idx : idx+int(payloadLen)]
-
-	target = &net.UDPAddr{
-		IP:   targetIP,
-		Port: targetPort,
-	}
-	src = &net.UDPAddr{
-		IP:   srcIP,
-		Port: srcPort,
-	}
-
-	return target, src, payload, nil
+	return p.Target, p.Source, p.Payload, nil
 }
@@ -0,0 +1,334 @@
+package udppackage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The version 2 layout starts with a magic no version 1 packet starts
+// with, as their first byte is an IP length, so both decode alike:
+//
+//	magic (2 bytes) 0xF5 0x7A | version (1) | flags (1)
+//	| target type (1) | target address | target port (2)
+//	| source type (1) | source address | source port (2)
+//	| payload length (2) | payload
+//
+// The address types are 1 for IPv4, 3 for a domain and 4 for IPv6, as in
+// SOCKS5. A domain is a length byte and the name, it is only valid for
+// the target.
+const (
+	magic0 = 0xF5
+	magic1 = 0x7A
+
+	// V1 is the original layout, see PackUDPData, and V2 the one with a
+	// header.
+	V1 = 1
+	V2 = 2
+
+	// MaxPayload is the largest payload of a packet.
+	MaxPayload = 0xffff
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var (
+	// ErrMalformed is wrapped by all the errors of decoding a packet,
+	// telling them from those of reading it.
+	ErrMalformed = errors.New("udppackage: malformed packet")
+
+	// ErrTruncated is returned for a packet shorter than its header
+	// says.
+	ErrTruncated = fmt.Errorf("%w: truncated", ErrMalformed)
+
+	// ErrAddress is returned for an address of unknown type or length.
+	ErrAddress = fmt.Errorf("%w: invalid address", ErrMalformed)
+
+	// ErrLength is returned when the payload length does not match the
+	// packet, or exceeds MaxPayload.
+	ErrLength = fmt.Errorf("%w: invalid payload length", ErrMalformed)
+
+	// ErrFlags is returned for a packet with flags this version does
+	// not know.
+	ErrFlags = fmt.Errorf("%w: unknown flags", ErrMalformed)
+)
+
+// VersionError is returned for a packet of an unknown version.
+type VersionError uint8
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("udppackage: unknown version %d", uint8(e))
+}
+
+func (e VersionError) Unwrap() error { return ErrMalformed }
+
+// Packet is a datagram with its target and source.
+type Packet struct {
+	Version uint8
+	Flags   uint8
+	Target  *net.UDPAddr
+	Source  *net.UDPAddr
+	Payload []byte
+
+	// Domain, if set, is the host of the target, left to the far end to
+	// resolve, and Target only gives the port. V2 only.
+	Domain string
+}
+
+// SetTarget sets the target of p to addr, a host:port whose host is an
+// IP or a domain.
+func (p *Packet) SetTarget(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	p.Target, p.Domain = &net.UDPAddr{IP: net.ParseIP(host), Port: int(n)}, ""
+	if p.Target.IP == nil {
+		p.Domain = host
+	}
+	return nil
+}
+
+// TargetAddr returns the host:port of the target of p.
+func (p *Packet) TargetAddr() string {
+	if p.Domain != "" {
+		return net.JoinHostPort(p.Domain, strconv.Itoa(p.Target.Port))
+	}
+	return p.Target.String()
+}
+
+// Marshal encodes p in its version, V2 if unset.
+func (p *Packet) Marshal() ([]byte, error) {
+	if p.Target == nil || p.Source == nil || p.Payload == nil {
+		return nil, errors.New("invalid UDP address")
+	}
+	switch p.Version {
+	case V1:
+		if p.Domain != "" {
+			return nil, ErrAddress
+		}
+		return PackUDPData(p.Target, p.Source, p.Payload)
+	case 0, V2:
+	default:
+		return nil, VersionError(p.Version)
+	}
+	if p.Flags != 0 {
+		return nil, ErrFlags
+	}
+	if len(p.Payload) > MaxPayload {
+		return nil, ErrLength
+	}
+	b := make([]byte, 0, 4+2*(1+net.IPv6len+2)+len(p.Domain)+2+len(p.Payload))
+	b = append(b, magic0, magic1, V2, p.Flags)
+	var err error
+	if p.Domain != "" {
+		if len(p.Domain) > 0xff {
+			return nil, ErrAddress
+		}
+		b = append(b, atypDomain, byte(len(p.Domain)))
+		b = append(b, p.Domain...)
+		b = binary.BigEndian.AppendUint16(b, uint16(p.Target.Port))
+	} else if b, err = appendAddr(b, p.Target); err != nil {
+		return nil, err
+	}
+	if b, err = appendAddr(b, p.Source); err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p.Payload)))
+	return append(b, p.Payload...), nil
+}
+
+func appendAddr(b []byte, a *net.UDPAddr) ([]byte, error) {
+	if ip4 := a.IP.To4(); ip4 != nil {
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	} else if len(a.IP) == net.IPv6len {
+		b = append(b, atypIPv6)
+		b = append(b, a.IP...)
+	} else {
+		return nil, ErrAddress
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(a.Port)), nil
+}
+
+// Decode decodes a packet of either version. The addresses and payload
+// of the packet point into data.
+func Decode(data []byte) (*Packet, error) {
+	if len(data) >= 2 && data[0] == magic0 && data[1] == magic1 {
+		return decodeV2(data)
+	}
+	return decodeV1(data)
+}
+
+func decodeV1(data []byte) (*Packet, error) {
+	r := reader{b: data}
+	p := &Packet{Version: V1}
+	var err error
+	if p.Target, err = r.addrV1(); err != nil {
+		return nil, err
+	}
+	if p.Source, err = r.addrV1(); err != nil {
+		return nil, err
+	}
+	n, ok := r.next(4)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	length := binary.BigEndian.Uint32(n)
+	if length > MaxPayload {
+		return nil, ErrLength
+	}
+	if p.Payload, err = r.payload(int(length)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func decodeV2(data []byte) (*Packet, error) {
+	r := reader{b: data}
+	h, ok := r.next(4)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	p := &Packet{Version: h[2], Flags: h[3]}
+	if p.Version != V2 {
+		return nil, VersionError(p.Version)
+	}
+	if p.Flags != 0 {
+		return nil, ErrFlags
+	}
+	var err error
+	if p.Target, p.Domain, err = r.addrV2(true); err != nil {
+		return nil, err
+	}
+	if p.Source, _, err = r.addrV2(false); err != nil {
+		return nil, err
+	}
+	n, ok := r.next(2)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	if p.Payload, err = r.payload(int(binary.BigEndian.Uint16(n))); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reader takes bytes off b, never past its end.
+type reader struct {
+	b []byte
+}
+
+func (r *reader) next(n int) ([]byte, bool) {
+	if n > len(r.b) {
+		return nil, false
+	}
+	b := r.b[:n:n]
+	r.b = r.b[n:]
+	return b, true
+}
+
+// payload takes the last n bytes, which must be all that is left.
+func (r *reader) payload(n int) ([]byte, error) {
+	b, ok := r.next(n)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	if len(r.b) != 0 {
+		return nil, ErrLength
+	}
+	return b, nil
+}
+
+func (r *reader) addrV1() (*net.UDPAddr, error) {
+	l, ok := r.next(1)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	switch l[0] {
+	case 0, net.IPv4len, net.IPv6len:
+	default:
+		return nil, ErrAddress
+	}
+	return r.ipPort(int(l[0]))
+}
+
+// addrV2 reads an address, a domain one too if domain is set.
+func (r *reader) addrV2(domain bool) (*net.UDPAddr, string, error) {
+	t, ok := r.next(1)
+	if !ok {
+		return nil, "", ErrTruncated
+	}
+	switch t[0] {
+	case atypIPv4:
+		a, err := r.ipPort(net.IPv4len)
+		return a, "", err
+	case atypIPv6:
+		a, err := r.ipPort(net.IPv6len)
+		return a, "", err
+	case atypDomain:
+		if !domain {
+			return nil, "", ErrAddress
+		}
+		l, ok := r.next(1)
+		if !ok {
+			return nil, "", ErrTruncated
+		}
+		if l[0] == 0 {
+			return nil, "", ErrAddress
+		}
+		name, ok := r.next(int(l[0]))
+		if !ok {
+			return nil, "", ErrTruncated
+		}
+		a, err := r.ipPort(0)
+		return a, string(name), err
+	default:
+		return nil, "", ErrAddress
+	}
+}
+
+func (r *reader) ipPort(ipLen int) (*net.UDPAddr, error) {
+	b, ok := r.next(ipLen + 2)
+	if !ok {
+		return nil, ErrTruncated
+	}
+	a := &net.UDPAddr{Port: int(binary.BigEndian.Uint16(b[ipLen:]))}
+	if ipLen > 0 {
+		a.IP = net.IP(b[:ipLen])
+	}
+	return a, nil
+}
+
+// Decoder decodes the packets of a stream transport, framed as by
+// WriteStream.
+type Decoder struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewDecoder returns a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, buf: make([]byte, MaxStreamPacket)}
+}
+
+// Decode reads and decodes the next packet, which is valid until the
+// following call. A packet that fails to decode, with an error wrapping
+// ErrMalformed, leaves the stream in step: the next call reads the
+// packet after it.
+func (d *Decoder) Decode() (*Packet, error) {
+	frame, err := ReadStream(d.r, d.buf)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(frame)
+}
@@ -0,0 +1,137 @@
+package udppackage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPacket(t *testing.T) {
+	target := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	for _, version := range []uint8{V1, V2} {
+		p := &Packet{Version: version, Target: target, Source: src, Payload: []byte("query")}
+		data, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(data)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if got.Version != version || !got.Target.IP.Equal(target.IP) || got.Target.Port != 53 ||
+			!got.Source.IP.Equal(src.IP) || got.Source.Port != 5000 || string(got.Payload) != "query" {
+			t.Fatal("unexpected packet", got)
+		}
+		t.Log(version, len(data), got.Target, got.Source)
+
+		// No prefix of a packet decodes, nor does it with a byte more.
+		for i := range data {
+			if _, err := Decode(data[:i]); !errors.Is(err, ErrMalformed) {
+				t.Fatal(version, i, err)
+			}
+		}
+		if _, err := Decode(append(data, 0)); !errors.Is(err, ErrLength) {
+			t.Fatal(version, err)
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	p := &Packet{Source: src, Payload: []byte("query")}
+	if err := p.SetTarget("example.com:53"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(len(data), got.TargetAddr(), got.Source)
+	if got.Domain != "example.com" || got.TargetAddr() != "example.com:53" || string(got.Payload) != "query" {
+		t.Fatal("unexpected packet", got)
+	}
+	for i := range data {
+		if _, err := Decode(data[:i]); !errors.Is(err, ErrMalformed) {
+			t.Fatal(i, err)
+		}
+	}
+
+	// Version 1 has no room for a domain.
+	p.Version = V1
+	if _, err := p.Marshal(); !errors.Is(err, ErrAddress) {
+		t.Fatal(err)
+	}
+	if err := p.SetTarget("1.1.1.1:53"); err != nil || p.Domain != "" || p.TargetAddr() != "1.1.1.1:53" {
+		t.Fatal("unexpected target", p.TargetAddr(), err)
+	}
+	if err := p.SetTarget("example.com"); err == nil {
+		t.Fatal("target without port accepted")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrTruncated},
+		{[]byte{16, 1, 2}, ErrTruncated},
+		{[]byte{7, 1, 2, 3, 4, 5, 6, 7, 0, 0}, ErrAddress},
+		{[]byte{0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, ErrLength},
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 9, 'x'}, ErrTruncated},
+		{[]byte{magic0, magic1, 3, 0}, VersionError(3)},
+		{[]byte{magic0, magic1, V2, 0x80}, ErrFlags},
+		{[]byte{magic0, magic1, V2, 0, 3, 0, 0}, ErrAddress},
+		{[]byte{magic0, magic1, V2, 0, 3, 5, 'a'}, ErrTruncated},
+		// A domain source.
+		{[]byte{magic0, magic1, V2, 0, 1, 1, 1, 1, 1, 0, 53, 3, 1, 'a', 0, 1, 0, 0}, ErrAddress},
+	} {
+		_, err := Decode(c.data)
+		if !errors.Is(err, c.err) || !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%x: got %v, want %v", c.data, err, c.err)
+		}
+		t.Log(err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	var stream bytes.Buffer
+	for i, payload := range []string{"one", "", "three"} {
+		p := &Packet{Version: uint8(i%2 + 1), Target: target, Source: src, Payload: []byte(payload)}
+		data, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// A malformed packet in between is skipped.
+			data = data[:len(data)-1]
+		}
+		WriteStream(&stream, data)
+	}
+
+	dec := NewDecoder(&stream)
+	for _, want := range []string{"one", "", "three"} {
+		p, err := dec.Decode()
+		if want == "" {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil || string(p.Payload) != want {
+			t.Fatal("unexpected packet", p, err)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
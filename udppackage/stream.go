@@ -0,0 +1,42 @@
+package udppackage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxStreamPacket is the largest packet WriteStream takes.
+const MaxStreamPacket = 0xffff
+
+// WriteStream writes packet to the stream transport w, prefixed with
+// its length on 2 bytes, in a single Write.
+func WriteStream(w io.Writer, packet []byte) error {
+	if len(packet) > MaxStreamPacket {
+		return fmt.Errorf("packet of %d bytes too large for a stream", len(packet))
+	}
+	b := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(b, uint16(len(packet)))
+	copy(b[2:], packet)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadStream reads a packet written by WriteStream into buf, which must
+// hold MaxStreamPacket bytes.
+func ReadStream(r io.Reader, buf []byte) ([]byte, error) {
+	if len(buf) < MaxStreamPacket {
+		return nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(buf)
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,249 @@
+package udprelay
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// autoConn sends over UDP until the probe window of its first frame
+// passes without a reply, it then moves to TCP and sends its last
+// frame again there.
+type autoConn struct {
+	d       *Dialer
+	address string
+	udp     net.Conn
+
+	frames chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu           sync.Mutex
+	tcp          net.Conn
+	last         []byte
+	replied      bool
+	timer        *time.Timer
+	readErr      error
+	readDeadline time.Time
+	// deadline wakes a Read when its deadline changes.
+	deadline chan struct{}
+}
+
+func newAutoConn(d *Dialer, udp net.Conn, address string) *autoConn {
+	c := &autoConn{
+		d:        d,
+		address:  address,
+		udp:      udp,
+		frames:   make(chan []byte, 64),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}, 1),
+	}
+	go c.read(udp, false)
+	return c
+}
+
+// read feeds the frames of conn to Read until it fails.
+func (c *autoConn) read(conn net.Conn, tcp bool) {
+	buf := make([]byte, 0xffff)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			c.mu.Lock()
+			// The UDP socket is closed on purpose once on TCP, and an
+			// error before any reply, such as a port unreachable,
+			// moves the flow there at once.
+			moved := !tcp && c.tcp != nil
+			probe := !tcp && !moved && !c.replied
+			c.mu.Unlock()
+			if moved || probe && c.fallback() {
+				return
+			}
+			c.mu.Lock()
+			c.readErr = err
+			c.mu.Unlock()
+			c.Close()
+			return
+		}
+		c.mu.Lock()
+		if !c.replied {
+			c.replied = true
+			if c.timer != nil {
+				c.timer.Stop()
+			}
+		}
+		c.mu.Unlock()
+		select {
+		case c.frames <- append([]byte(nil), buf[:n]...):
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *autoConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+		var frame []byte
+		var err error
+		select {
+		case frame = <-c.frames:
+		case <-c.closed:
+			c.mu.Lock()
+			err = c.readErr
+			c.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.deadline:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if frame != nil || err != nil {
+			return copy(b, frame), err
+		}
+	}
+}
+
+func (c *autoConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.tcp != nil {
+		tcp := c.tcp
+		c.mu.Unlock()
+		return tcp.Write(b)
+	}
+	if !c.replied {
+		c.last = append(c.last[:0], b...)
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.d.probe(), func() { c.fallback() })
+		}
+	}
+	c.mu.Unlock()
+	n, err := c.udp.Write(b)
+	if err != nil {
+		// The flow may have just moved to TCP.
+		c.mu.Lock()
+		tcp := c.tcp
+		c.mu.Unlock()
+		if tcp != nil {
+			return tcp.Write(b)
+		}
+	}
+	return n, err
+}
+
+// fallback moves the flow to TCP, unless a reply came meanwhile. It
+// reports whether the flow is on TCP.
+func (c *autoConn) fallback() bool {
+	c.mu.Lock()
+	if c.replied || c.tcp != nil {
+		defer c.mu.Unlock()
+		return c.tcp != nil
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.d.probe())
+	tcp, err := c.d.dialTCP(ctx, c.address)
+	cancel()
+	if err != nil {
+		// Nothing better to offer, UDP stays.
+		return false
+	}
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		tcp.Close()
+		return false
+	default:
+	}
+	if c.replied || c.tcp != nil {
+		defer c.mu.Unlock()
+		tcp.Close()
+		return c.tcp != nil
+	}
+	c.tcp = tcp
+	last := c.last
+	c.last = nil
+	c.mu.Unlock()
+
+	c.d.blockUDP()
+	go c.read(tcp, true)
+	c.udp.Close()
+	if last != nil {
+		tcp.Write(last)
+	}
+	return true
+}
+
+// Transport returns the transport the flow uses now.
+func (c *autoConn) Transport() Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tcp != nil {
+		return TCP
+	}
+	return UDP
+}
+
+func (c *autoConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		tcp := c.tcp
+		c.mu.Unlock()
+		c.udp.Close()
+		if tcp != nil {
+			tcp.Close()
+		}
+	})
+	return nil
+}
+
+func (c *autoConn) LocalAddr() net.Addr  { return c.udp.LocalAddr() }
+func (c *autoConn) RemoteAddr() net.Addr { return c.udp.RemoteAddr() }
+
+func (c *autoConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *autoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadline <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *autoConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	tcp := c.tcp
+	c.mu.Unlock()
+	if tcp != nil {
+		return tcp.SetWriteDeadline(t)
+	}
+	return c.udp.SetWriteDeadline(t)
+}
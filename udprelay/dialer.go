@@ -0,0 +1,167 @@
+// Package udprelay carries udppackage frames between the tunnel and a
+// relay server, over UDP or, where UDP is blocked, over a TCP or TLS
+// connection with the frames prefixed by their length.
+package udprelay
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"tun2proxylib/udppackage"
+)
+
+// Transport is how frames reach the relay.
+type Transport string
+
+const (
+	// UDP sends every frame as a datagram, as relays always did.
+	UDP Transport = "udp"
+
+	// TCP sends the frames of a flow over a connection of its own.
+	TCP Transport = "tcp"
+
+	// Auto starts with UDP and switches a flow over to TCP when no
+	// reply came within the probe window of its first frame. The
+	// following flows then use TCP at once, until UDP is tried again
+	// after DefaultRecheck.
+	Auto Transport = "auto"
+)
+
+const (
+	// DefaultProbe is how long a flow waits for its first reply over
+	// UDP before switching to TCP.
+	DefaultProbe = 2 * time.Second
+
+	// DefaultRecheck is how long UDP is left alone once found blocked.
+	DefaultRecheck = 5 * time.Minute
+)
+
+// ParseTransport returns the transport named s, "" is UDP.
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(s); t {
+	case "":
+		return UDP, nil
+	case UDP, TCP, Auto:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown relay transport %q, want udp, tcp or auto", s)
+	}
+}
+
+// Dialer connects flows to a relay. The conns it returns carry one
+// frame per Read and Write, whatever the transport.
+type Dialer struct {
+	Transport Transport
+
+	// TLS, if set, secures the TCP connections.
+	TLS *tls.Config
+
+	// Probe defaults to DefaultProbe and Recheck to DefaultRecheck.
+	Probe   time.Duration
+	Recheck time.Duration
+
+	// Dial opens the sockets, network is "udp" or "tcp". Defaults to a
+	// net.Dialer.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// DialContext connects a new flow to the relay at address.
+func (d *Dialer) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	switch d.Transport {
+	case TCP:
+		return d.dialTCP(ctx, address)
+	case Auto:
+		if d.udpBlocked() {
+			return d.dialTCP(ctx, address)
+		}
+		conn, err := d.dial(ctx, "udp", address)
+		if err != nil {
+			return nil, err
+		}
+		return newAutoConn(d, conn, address), nil
+	default:
+		return d.dial(ctx, "udp", address)
+	}
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial(ctx, network, address)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if d.TLS != nil {
+		tc := tls.Client(conn, d.TLS)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return &streamConn{Conn: conn, buf: make([]byte, udppackage.MaxStreamPacket)}, nil
+}
+
+func (d *Dialer) udpBlocked() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Now().Before(d.blockedUntil)
+}
+
+func (d *Dialer) blockUDP() {
+	recheck := d.Recheck
+	if recheck <= 0 {
+		recheck = DefaultRecheck
+	}
+	d.mu.Lock()
+	d.blockedUntil = time.Now().Add(recheck)
+	d.mu.Unlock()
+}
+
+func (d *Dialer) probe() time.Duration {
+	if d.Probe > 0 {
+		return d.Probe
+	}
+	return DefaultProbe
+}
+
+// streamConn carries frames over a stream, see udppackage.WriteStream.
+type streamConn struct {
+	net.Conn
+
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	buf     []byte
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := udppackage.WriteStream(c.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	frame, err := udppackage.ReadStream(c.Conn, c.buf)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, frame), nil
+}
@@ -0,0 +1,322 @@
+package udprelay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tun2proxylib/udppackage"
+)
+
+// DefaultTimeout is how long the server keeps the socket of an idle
+// client.
+const DefaultTimeout = 2 * time.Minute
+
+// Server is a relay: it sends the payload of every frame to its target
+// from a socket of the client, and the datagrams coming back to the
+// client with their sender in the target field. Clients reach it over
+// UDP, or over TCP with length prefixed frames. Domain targets are
+// resolved by the server.
+type Server struct {
+	// TLS, if set, is required on the TCP connections.
+	TLS *tls.Config
+
+	// Timeout defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Resolver resolves the domain targets, it defaults to
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// Logger defaults to slog.Default.
+	Logger *slog.Logger
+}
+
+// ListenAndServe serves UDP and TCP on addr.
+func (srv *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- srv.ServeUDP(pc) }()
+	go func() { errs <- srv.ServeTCP(ln) }()
+	err = <-errs
+	pc.Close()
+	ln.Close()
+	<-errs
+	return err
+}
+
+// ServeUDP serves the clients sending to pc until it fails.
+func (srv *Server) ServeUDP(pc net.PacketConn) error {
+	defer pc.Close()
+	var mu sync.Mutex
+	clients := make(map[string]*client)
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// The frame waits in the queue of its client, it must not share
+		// buf.
+		p, err := decode(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			srv.logger().Debug("drop invalid frame", "client", addr, "err", err)
+			continue
+		}
+
+		mu.Lock()
+		c := clients[addr.String()]
+		if c == nil {
+			c, err = srv.newClient(func(frame []byte) error {
+				_, err := pc.WriteTo(frame, addr)
+				return err
+			})
+			if err != nil {
+				mu.Unlock()
+				srv.logger().Warn("relay socket failed", "err", err)
+				continue
+			}
+			clients[addr.String()] = c
+			go c.sendQueued()
+			go func() {
+				c.relay()
+				mu.Lock()
+				delete(clients, addr.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		c.enqueue(p)
+	}
+}
+
+// ServeTCP serves the connections of ln until it fails.
+func (srv *Server) ServeTCP(ln net.Listener) error {
+	if srv.TLS != nil {
+		ln = tls.NewListener(ln, srv.TLS)
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// ServeConn relays the frames of the stream conn until it ends.
+func (srv *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	var writeMu sync.Mutex
+	c, err := srv.newClient(func(frame []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(srv.timeout()))
+		return udppackage.WriteStream(conn, frame)
+	})
+	if err != nil {
+		srv.logger().Warn("relay socket failed", "err", err)
+		return
+	}
+	go c.relay()
+	defer c.out.Close()
+
+	dec := udppackage.NewDecoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(srv.timeout()))
+		p, err := dec.Decode()
+		if err == nil {
+			err = checkTarget(p)
+		}
+		if errors.Is(err, udppackage.ErrMalformed) {
+			srv.logger().Debug("drop invalid frame", "client", conn.RemoteAddr(), "err", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.send(p)
+	}
+}
+
+// client is the socket the datagrams of a client leave from.
+type client struct {
+	srv   *Server
+	out   net.PacketConn
+	reply func(frame []byte) error
+
+	// queue holds the frames of a UDP client, its domain targets are
+	// resolved off the read loop shared by all clients.
+	queue chan *udppackage.Packet
+	// done is closed once relay returns.
+	done chan struct{}
+
+	mu  sync.Mutex
+	src *net.UDPAddr
+	// version is that of the last frame, replies use it too.
+	version uint8
+	// resolved holds the addresses of the domain targets sent to.
+	resolved map[string]*net.UDPAddr
+}
+
+// maxResolved bounds the domain targets a client keeps resolved.
+const maxResolved = 256
+
+// queueLen bounds the frames of a UDP client waiting to be sent.
+const queueLen = 64
+
+func (srv *Server) newClient(reply func([]byte) error) (*client, error) {
+	out, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		srv:   srv,
+		out:   out,
+		reply: reply,
+		queue: make(chan *udppackage.Packet, queueLen),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// enqueue hands p to sendQueued, it is dropped if the client is behind.
+func (c *client) enqueue(p *udppackage.Packet) {
+	select {
+	case c.queue <- p:
+	default:
+		c.srv.logger().Debug("drop frame, client queue full", "target", p.TargetAddr())
+	}
+}
+
+// sendQueued sends the queued frames until relay returns.
+func (c *client) sendQueued() {
+	for {
+		select {
+		case p := <-c.queue:
+			c.send(p)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) send(p *udppackage.Packet) {
+	c.mu.Lock()
+	c.src = &net.UDPAddr{IP: append(net.IP(nil), p.Source.IP...), Port: p.Source.Port}
+	c.version = p.Version
+	c.mu.Unlock()
+	c.out.SetReadDeadline(time.Now().Add(c.srv.timeout()))
+	target, err := c.target(p)
+	if err != nil {
+		c.srv.logger().Debug("resolve target failed", "target", p.TargetAddr(), "err", err)
+		return
+	}
+	if _, err := c.out.WriteTo(p.Payload, target); err != nil {
+		c.srv.logger().Debug("send to target failed", "target", p.TargetAddr(), "err", err)
+	}
+}
+
+// target returns the address to send p to, a domain is resolved once.
+func (c *client) target(p *udppackage.Packet) (*net.UDPAddr, error) {
+	if p.Domain == "" {
+		return p.Target, nil
+	}
+	addr := p.TargetAddr()
+	c.mu.Lock()
+	a, ok := c.resolved[addr]
+	c.mu.Unlock()
+	if ok {
+		return a, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.srv.timeout())
+	defer cancel()
+	ips, err := c.srv.resolver().LookupNetIP(ctx, "ip", p.Domain)
+	if err != nil {
+		return nil, err
+	}
+	a = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(p.Target.Port)))
+	c.mu.Lock()
+	if c.resolved == nil || len(c.resolved) >= maxResolved {
+		c.resolved = make(map[string]*net.UDPAddr)
+	}
+	c.resolved[addr] = a
+	c.mu.Unlock()
+	return a, nil
+}
+
+// relay sends the datagrams coming back to the client until the socket
+// is idle for the timeout of the server.
+func (c *client) relay() {
+	defer close(c.done)
+	defer c.out.Close()
+	buf := make([]byte, 0xffff)
+	for {
+		n, from, err := c.out.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.out.SetReadDeadline(time.Now().Add(c.srv.timeout()))
+		c.mu.Lock()
+		p := udppackage.Packet{Version: c.version, Target: from.(*net.UDPAddr), Source: c.src, Payload: buf[:n]}
+		c.mu.Unlock()
+		frame, err := p.Marshal()
+		if err != nil {
+			continue
+		}
+		if err := c.reply(frame); err != nil {
+			return
+		}
+	}
+}
+
+// decode decodes a frame of a client, which may be anything.
+func decode(data []byte) (*udppackage.Packet, error) {
+	p, err := udppackage.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return p, checkTarget(p)
+}
+
+func checkTarget(p *udppackage.Packet) error {
+	if p.Target.IP == nil && p.Domain == "" || p.Target.Port == 0 {
+		return fmt.Errorf("%w: frame without target", udppackage.ErrMalformed)
+	}
+	return nil
+}
+
+func (srv *Server) timeout() time.Duration {
+	if srv.Timeout > 0 {
+		return srv.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (srv *Server) resolver() *net.Resolver {
+	if srv.Resolver != nil {
+		return srv.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,174 @@
+package udprelay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"tun2proxylib/udppackage"
+)
+
+func echoServer(t *testing.T) *net.UDPAddr {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// roundTrip sends a frame of version for echo through conn and checks
+// the reply. A domain, if given, stands for the echo host.
+func roundTrip(t *testing.T, conn net.Conn, echo *net.UDPAddr, version uint8, domain ...string) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	p := &udppackage.Packet{Version: version, Target: echo, Source: src, Payload: []byte("ping")}
+	if len(domain) > 0 {
+		p.Target, p.Domain = &net.UDPAddr{Port: echo.Port}, domain[0]
+	}
+	frame, _ := p.Marshal()
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := udppackage.Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Version != version || string(reply.Payload) != "ping" || reply.Target.Port != echo.Port || !reply.Source.IP.Equal(src.IP) {
+		t.Fatal("unexpected reply", reply)
+	}
+}
+
+func TestServer(t *testing.T) {
+	echo := echoServer(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	go srv.ServeUDP(pc)
+	go srv.ServeTCP(ln)
+	defer pc.Close()
+	defer ln.Close()
+
+	// A malformed frame is dropped, not fatal.
+	bad, _ := net.Dial("udp", pc.LocalAddr().String())
+	bad.Write([]byte{16, 1, 2})
+	bad.Close()
+
+	for _, c := range []struct {
+		transport Transport
+		addr      string
+	}{{UDP, pc.LocalAddr().String()}, {TCP, ln.Addr().String()}} {
+		d := &Dialer{Transport: c.transport}
+		conn, err := d.DialContext(context.Background(), c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, echo, udppackage.V1)
+		roundTrip(t, conn, echo, udppackage.V2)
+		roundTrip(t, conn, echo, udppackage.V2, "localhost")
+		conn.Close()
+	}
+}
+
+func TestStalledResolve(t *testing.T) {
+	echo := echoServer(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	// The lookups of the domain targets hang until the test ends.
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-release
+			return nil, errors.New("no dns")
+		},
+	}}
+	go srv.ServeUDP(pc)
+
+	d := &Dialer{Transport: UDP}
+	stalled, err := d.DialContext(context.Background(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000}
+	p := &udppackage.Packet{Version: udppackage.V2, Target: &net.UDPAddr{Port: echo.Port}, Domain: "stall.test", Source: src, Payload: []byte("ping")}
+	frame, _ := p.Marshal()
+	if _, err := stalled.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client is served meanwhile.
+	conn, err := d.DialContext(context.Background(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, echo, udppackage.V1)
+}
+
+func TestAutoFallback(t *testing.T) {
+	echo := echoServer(t)
+	// UDP is swallowed, TCP is served on the same port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	hole, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hole.Close()
+	go (&Server{}).ServeTCP(ln)
+
+	d := &Dialer{Transport: Auto, Probe: 100 * time.Millisecond}
+	conn, err := d.DialContext(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The frame sent over UDP is sent again over TCP.
+	roundTrip(t, conn, echo, udppackage.V1)
+	if tr := conn.(*autoConn).Transport(); tr != TCP {
+		t.Fatal("flow still on", tr)
+	}
+
+	// The next flows skip the probe.
+	conn, err = d.DialContext(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*streamConn); !ok {
+		t.Fatalf("unexpected conn %T", conn)
+	}
+	roundTrip(t, conn, echo, udppackage.V1)
+}